@@ -0,0 +1,280 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// redacted the value recorded in place of a secret parameter
+const redacted = "REDACTED"
+
+// secretParams substrings of the names of parameters whose values are not
+// recorded, such as power parameter passwords and cloud-init user data
+var secretParams = []string{"pass", "secret", "token", "key", "user_data"}
+
+// AuditEntry a change automation made, or attempted to make, in MAAS
+type AuditEntry struct {
+	Time     time.Time           `json:"time"`
+	Actor    string              `json:"actor"`
+	NodeID   string              `json:"node_id"`
+	Hostname string              `json:"hostname"`
+	Action   string              `json:"action"`
+	Params   map[string][]string `json:"params,omitempty"`
+	Result   string              `json:"result"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// AuditQuery selects audit entries. Node matches either the system ID or the
+// hostname of the node at the time of the change. Limit keeps only the most
+// recent entries.
+type AuditQuery struct {
+	Node   string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+// matches returns true if the entry is selected by the query
+func (q AuditQuery) matches(entry AuditEntry) bool {
+	if q.Node != "" && q.Node != entry.NodeID && q.Node != entry.Hostname {
+		return false
+	}
+	if q.Action != "" && q.Action != entry.Action {
+		return false
+	}
+	return !entry.Time.Before(q.Since)
+}
+
+// AuditLog records every change automation makes in MAAS, appending an entry
+// per change to a JSON-lines file and, optionally, storing it in Consul.
+// The file is opened for each entry, so that it may be rotated. A nil log
+// records nothing.
+type AuditLog struct {
+	Actor string
+
+	mutex  sync.Mutex
+	file   string
+	kv     *consul.KV
+	prefix string
+}
+
+// NewAuditLog returns a log that appends to the given file and stores entries
+// under the given key prefix of the Consul agent at the given URL, either of
+// which may be empty. The actor identifies this replica in the entries.
+func NewAuditLog(file string, consulURL string, prefix string, actor string) (*AuditLog, error) {
+	audit := &AuditLog{
+		Actor:  actor,
+		file:   file,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+	if consulURL != "" {
+		client, err := newConsulClient(consulURL)
+		if err != nil {
+			return nil, err
+		}
+		audit.kv = client.KV()
+	}
+	return audit, nil
+}
+
+// redactParams returns a copy of the parameters with the values of secrets
+// replaced
+func redactParams(params url.Values) map[string][]string {
+	if len(params) == 0 {
+		return nil
+	}
+	result := make(map[string][]string, len(params))
+	for name, values := range params {
+		result[name] = values
+		lower := strings.ToLower(name)
+		for _, secret := range secretParams {
+			if strings.Contains(lower, secret) {
+				result[name] = []string{redacted}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Record records the result of a change made to the given node. A failure to
+// record the change is logged, but does not fail the change.
+func (a *AuditLog) Record(node MaasNode, action string, params url.Values, err error) {
+	if a == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		Actor:    a.Actor,
+		NodeID:   node.ID(),
+		Hostname: node.Hostname(),
+		Action:   action,
+		Params:   redactParams(params),
+		Result:   "ok",
+	}
+	if err != nil {
+		entry.Result = "error"
+		entry.Error = err.Error()
+	}
+	if err := a.write(entry); err != nil {
+		log.Warnf("Unable to record '%s' of node '%s' in the audit log : %s", action, node.Hostname(), err)
+	}
+}
+
+// write appends the entry to the file and stores it in Consul
+func (a *AuditLog) write(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file != "" {
+		if err := os.MkdirAll(filepath.Dir(a.file), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(data, '\n'))
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.kv != nil {
+		key := fmt.Sprintf("%s/%s/%d-%s", a.prefix, entry.NodeID, entry.Time.UnixNano(), entry.Action)
+		if _, err := a.kv.Put(&consul.KVPair{Key: key, Value: data}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the recorded entries selected by the query, oldest first.
+// Entries are read from the file if there is one, otherwise from Consul.
+func (a *AuditLog) Query(query AuditQuery) ([]AuditEntry, error) {
+	if a == nil {
+		return []AuditEntry{}, nil
+	}
+	var entries []AuditEntry
+	var err error
+	switch {
+	case a.file != "":
+		entries, err = a.readFile(query)
+	case a.kv != nil:
+		entries, err = a.readConsul(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Stable(auditEntriesByTime(entries))
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return entries, nil
+}
+
+// readFile reads the selected entries from the file
+func (a *AuditLog) readFile(query AuditQuery) ([]AuditEntry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	file, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit entry on line %d of '%s' : %s", line, a.file, err)
+		}
+		if query.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// readConsul reads the selected entries from Consul
+func (a *AuditLog) readConsul(query AuditQuery) ([]AuditEntry, error) {
+	pairs, _, err := a.kv.List(a.prefix+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	for _, pair := range pairs {
+		var entry AuditEntry
+		if err := json.Unmarshal(pair.Value, &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit entry '%s' : %s", pair.Key, err)
+		}
+		if query.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// auditEntriesByTime sorts audit entries, oldest first
+type auditEntriesByTime []AuditEntry
+
+func (e auditEntriesByTime) Len() int           { return len(e) }
+func (e auditEntriesByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e auditEntriesByTime) Less(i, j int) bool { return e[i].Time.Before(e[j].Time) }
+
+// parseSince parses the start of an audit query, given either as a time in
+// RFC3339 format or as a duration before now
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', expected RFC3339 or a duration", value)
+	}
+	return time.Now().Add(-d), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestAuditLog(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create directory : %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server.AddNode(maasfake.Node{SystemID: "ready", Hostname: "ready", Status: maasfake.Ready})
+	server.AddNode(maasfake.Node{SystemID: "deployed", Hostname: "deployed", Status: maasfake.Deployed})
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Audit, err = NewAuditLog(filepath.Join(dir, "log", "audit.jsonl"), "", "", "replica-a")
+	if err != nil {
+		t.Fatalf("unable to create audit log : %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+	}
+
+	entries, err := options.Audit.Query(AuditQuery{Node: "ready"})
+	if err != nil {
+		t.Fatalf("unable to query audit log : %s", err)
+	}
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		if entry.Actor != "replica-a" || entry.NodeID != "ready" || entry.Result != "ok" {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+	}
+	if !reflect.DeepEqual(actions, []string{"acquire", "start"}) {
+		t.Errorf("expected the node to be acquired and deployed, got %v", actions)
+	}
+
+	if entries, _ := options.Audit.Query(AuditQuery{Node: "deployed"}); len(entries) != 0 {
+		t.Errorf("expected no changes to the deployed node, got %+v", entries)
+	}
+	if entries, _ := options.Audit.Query(AuditQuery{Action: "start", Limit: 1}); len(entries) != 1 {
+		t.Errorf("expected a single deploy, got %+v", entries)
+	}
+
+	// Creating a tag for a node is recorded against the node
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	if err := addNodeTag(client, nodes[0], options, "audited", "audit test"); err != nil {
+		t.Fatalf("unable to tag node : %s", err)
+	}
+	entries, _ = options.Audit.Query(AuditQuery{Action: "create_tag"})
+	if len(entries) != 1 || entries[0].NodeID != nodes[0].ID() || entries[0].Params["name"][0] != "audited" {
+		t.Errorf("expected the creation of the tag to be recorded, got %+v", entries)
+	}
+
+	params := redactParams(powerValues("ipmi", map[string]string{
+		"power_address": "10.6.0.5",
+		"power_pass":    "secret",
+	}))
+	if params["power_parameters_power_pass"][0] != redacted {
+		t.Errorf("expected the power password to be redacted, got %v", params)
+	}
+	if params["power_parameters_power_address"][0] != "10.6.0.5" {
+		t.Errorf("expected the power address to be recorded, got %v", params)
+	}
+}
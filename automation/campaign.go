@@ -0,0 +1,591 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	maas "github.com/juju/gomaasapi"
+)
+
+// DefaultHealthCheckTimeout how long a health check may run before the node
+// is considered unhealthy, if the campaign does not specify otherwise
+const DefaultHealthCheckTimeout = 5 * time.Minute
+
+// The states of a campaign
+const (
+	CampaignRunning   = "running"
+	CampaignHalted    = "halted"
+	CampaignComplete  = "complete"
+	CampaignCancelled = "cancelled"
+)
+
+// The phases through which each node of a campaign moves
+const (
+	PhasePending     = "pending"
+	PhaseReleasing   = "releasing"
+	PhaseRedeploying = "redeploying"
+	PhaseChecking    = "checking"
+	PhaseDone        = "done"
+	PhaseFailed      = "failed"
+)
+
+// CampaignSpec a request to release and redeploy the deployed nodes matched
+// by the selector, BatchSize nodes at a time. Once redeployed and
+// provisioned each node is passed to the script of the named HealthCheck, if
+// any, as its ID, hostname and IP address, and is healthy if the script exits
+// with a zero status.
+type CampaignSpec struct {
+	Name               string     `json:"name"`
+	Selector           HostFilter `json:"selector"`
+	BatchSize          int        `json:"batch_size"`
+	HealthCheck        string     `json:"health_check,omitempty"`
+	HealthCheckTimeout string     `json:"health_check_timeout,omitempty"`
+}
+
+// CampaignNode the progress of a node through a campaign
+type CampaignNode struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Phase    string `json:"phase"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Campaign a rolling release and redeploy of a set of nodes. Batch is the
+// index of the batch of nodes being redeployed.
+type Campaign struct {
+	CampaignSpec
+	State   string          `json:"state"`
+	Reason  string          `json:"reason,omitempty"`
+	Batch   int             `json:"batch"`
+	Nodes   []*CampaignNode `json:"nodes"`
+	Created int64           `json:"created"`
+	Updated int64           `json:"updated"`
+}
+
+// batch returns the nodes of the current batch
+func (c *Campaign) batch() []*CampaignNode {
+	start := c.Batch * c.BatchSize
+	if start >= len(c.Nodes) {
+		return nil
+	}
+	end := start + c.BatchSize
+	if end > len(c.Nodes) {
+		end = len(c.Nodes)
+	}
+	return c.Nodes[start:end]
+}
+
+// CampaignManager runs campaigns, one at a time, persisting their progress
+// to a file and, optionally, to Consul so that a campaign resumes where it
+// stopped when automation is restarted or another replica is elected leader.
+// A nil manager runs no campaigns.
+type CampaignManager struct {
+	// Checks the health check scripts, by name, that campaigns may run
+	Checks map[string]string
+
+	mutex     sync.Mutex
+	file      string
+	kv        *consul.KV
+	key       string
+	campaigns map[string]*Campaign
+	checking  map[string]bool
+}
+
+// NewCampaignManager returns a manager that persists campaigns to the given
+// file and under the given key of the Consul agent at the given URL, either
+// of which may be empty, loading any campaigns already saved.
+func NewCampaignManager(file string, consulURL string, key string) (*CampaignManager, error) {
+	m := &CampaignManager{
+		file:      file,
+		key:       key,
+		campaigns: make(map[string]*Campaign),
+		checking:  make(map[string]bool),
+	}
+	if consulURL != "" {
+		client, err := newConsulClient(consulURL)
+		if err != nil {
+			return nil, err
+		}
+		m.kv = client.KV()
+	}
+	if err := m.Load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Load replaces the campaigns with those saved, read from Consul if it is
+// used and holds them, otherwise from the file. A replica loads them when
+// elected leader, so that it resumes the campaigns of the previous leader.
+func (m *CampaignManager) Load() error {
+	if m == nil {
+		return nil
+	}
+	data, err := m.read()
+	if err != nil || data == nil {
+		return err
+	}
+	campaigns := make(map[string]*Campaign)
+	if err := json.Unmarshal(data, &campaigns); err != nil {
+		return fmt.Errorf("unable to parse saved campaigns : %s", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.campaigns = campaigns
+	// Health checks that were in progress when the campaigns were saved are
+	// run again, as none are recorded as running
+	m.checking = make(map[string]bool)
+	if active := m.active(); active != nil {
+		log.Infof("Resuming campaign '%s', which is %s at batch %d", active.Name, active.State, active.Batch+1)
+	}
+	return nil
+}
+
+// read returns the saved campaigns, or nil if none are saved
+func (m *CampaignManager) read() ([]byte, error) {
+	if m.kv != nil {
+		pair, _, err := m.kv.Get(m.key, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read campaigns from Consul key '%s' : %s", m.key, err)
+		}
+		if pair != nil {
+			return pair.Value, nil
+		}
+	}
+	if m.file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// save writes the campaigns to the file and to Consul. The caller must hold
+// the lock.
+func (m *CampaignManager) save() error {
+	if m.file == "" && m.kv == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.campaigns, "", "  ")
+	if err != nil {
+		return err
+	}
+	if m.kv != nil {
+		if _, err := m.kv.Put(&consul.KVPair{Key: m.key, Value: data}, nil); err != nil {
+			return err
+		}
+	}
+	if m.file == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.file), 0755); err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// update marks a campaign as changed and saves the campaigns. The caller
+// must hold the lock.
+func (m *CampaignManager) update(campaign *Campaign) {
+	campaign.Updated = time.Now().Unix()
+	if err := m.save(); err != nil {
+		log.Errorf("Unable to save the progress of campaign '%s' : %s", campaign.Name, err)
+	}
+}
+
+// active returns the campaign that is running or halted, if any. The caller
+// must hold the lock.
+func (m *CampaignManager) active() *Campaign {
+	for _, campaign := range m.campaigns {
+		if campaign.State == CampaignRunning || campaign.State == CampaignHalted {
+			return campaign
+		}
+	}
+	return nil
+}
+
+// Start starts a campaign over the deployed nodes, of those given, that the
+// selector of the campaign matches
+func (m *CampaignManager) Start(spec CampaignSpec, nodes []MaasNode) (*Campaign, error) {
+	if spec.Name == "" {
+		return nil, fmt.Errorf("campaign has no name")
+	}
+	if spec.BatchSize <= 0 {
+		return nil, fmt.Errorf("batch size of campaign '%s' must be at least 1", spec.Name)
+	}
+	if spec.HealthCheck != "" {
+		if _, ok := m.Checks[spec.HealthCheck]; !ok {
+			return nil, fmt.Errorf("unknown health check '%s' of campaign '%s'", spec.HealthCheck, spec.Name)
+		}
+	}
+	if spec.HealthCheckTimeout != "" {
+		if _, err := time.ParseDuration(spec.HealthCheckTimeout); err != nil {
+			return nil, fmt.Errorf("invalid health check timeout of campaign '%s' : %s", spec.Name, err)
+		}
+	}
+	if err := spec.Selector.Compile(); err != nil {
+		return nil, fmt.Errorf("invalid selector of campaign '%s' : %s", spec.Name, err)
+	}
+
+	selected := []*CampaignNode{}
+	for _, node := range nodes {
+		status, err := node.Status()
+		if err != nil || status != Deployed || spec.Selector.Excludes(node, status.String()) != "" {
+			continue
+		}
+		selected = append(selected, &CampaignNode{ID: node.ID(), Hostname: node.Hostname(), Phase: PhasePending})
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("campaign '%s' selects no deployed nodes", spec.Name)
+	}
+	sort.Sort(campaignNodesByHostname(selected))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if active := m.active(); active != nil {
+		return nil, &CampaignConflictError{fmt.Sprintf("campaign '%s' is %s", active.Name, active.State)}
+	}
+	campaign := &Campaign{
+		CampaignSpec: spec,
+		State:        CampaignRunning,
+		Nodes:        selected,
+		Created:      time.Now().Unix(),
+	}
+	m.campaigns[spec.Name] = campaign
+	log.Infof("Starting campaign '%s' over %d node(s), %d at a time", spec.Name, len(selected), spec.BatchSize)
+	m.update(campaign)
+	result := m.copy(campaign)
+	return &result, nil
+}
+
+// CampaignConflictError is returned when a campaign cannot be started
+// because of another campaign
+type CampaignConflictError struct {
+	Reason string
+}
+
+func (e *CampaignConflictError) Error() string {
+	return e.Reason
+}
+
+type campaignNodesByHostname []*CampaignNode
+
+func (n campaignNodesByHostname) Len() int           { return len(n) }
+func (n campaignNodesByHostname) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n campaignNodesByHostname) Less(i, j int) bool { return n[i].Hostname < n[j].Hostname }
+
+// Resume restarts a halted campaign, retrying the nodes that failed
+func (m *CampaignManager) Resume(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign, ok := m.campaigns[name]
+	if !ok {
+		return fmt.Errorf("unknown campaign '%s'", name)
+	}
+	if campaign.State != CampaignHalted {
+		return &CampaignConflictError{fmt.Sprintf("campaign '%s' is %s, not halted", name, campaign.State)}
+	}
+	for _, node := range campaign.batch() {
+		if node.Phase == PhaseFailed {
+			node.Phase = PhasePending
+			node.Error = ""
+		}
+	}
+	campaign.State = CampaignRunning
+	campaign.Reason = ""
+	log.Infof("Resuming campaign '%s'", name)
+	m.update(campaign)
+	return nil
+}
+
+// Cancel stops a campaign. Nodes that were released are redeployed as
+// their target state dictates.
+func (m *CampaignManager) Cancel(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign, ok := m.campaigns[name]
+	if !ok {
+		return fmt.Errorf("unknown campaign '%s'", name)
+	}
+	if campaign.State != CampaignRunning && campaign.State != CampaignHalted {
+		return &CampaignConflictError{fmt.Sprintf("campaign '%s' is already %s", name, campaign.State)}
+	}
+	campaign.State = CampaignCancelled
+	log.Infof("Cancelled campaign '%s'", name)
+	m.update(campaign)
+	return nil
+}
+
+// List returns a copy of all the campaigns
+func (m *CampaignManager) List() []Campaign {
+	if m == nil {
+		return []Campaign{}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := make([]string, 0, len(m.campaigns))
+	for name := range m.campaigns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]Campaign, len(names))
+	for i, name := range names {
+		result[i] = m.copy(m.campaigns[name])
+	}
+	return result
+}
+
+// Get returns a copy of the named campaign, or nil if there is none
+func (m *CampaignManager) Get(name string) *Campaign {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign, ok := m.campaigns[name]
+	if !ok {
+		return nil
+	}
+	result := m.copy(campaign)
+	return &result
+}
+
+// copy returns a copy of a campaign. The caller must hold the lock.
+func (m *CampaignManager) copy(campaign *Campaign) Campaign {
+	result := *campaign
+	result.Nodes = make([]*CampaignNode, len(campaign.Nodes))
+	for i, node := range campaign.Nodes {
+		n := *node
+		result.Nodes[i] = &n
+	}
+	return result
+}
+
+// Target returns the state toward which the running campaign moves the
+// given node, or the empty string if the node is not being redeployed
+func (m *CampaignManager) Target(node MaasNode) string {
+	if m == nil {
+		return ""
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign := m.active()
+	if campaign == nil || campaign.State != CampaignRunning {
+		return ""
+	}
+	for _, n := range campaign.batch() {
+		if n.ID != node.ID() {
+			continue
+		}
+		switch n.Phase {
+		case PhaseReleasing:
+			return "Released"
+		case PhaseRedeploying, PhaseChecking:
+			return "Deployed"
+		}
+	}
+	return ""
+}
+
+// Progress moves the nodes of the current batch of the running campaign
+// through their phases given their state in MAAS, which must be done before
+// the nodes are processed. A batch starts once the previous batch is done,
+// and the campaign halts if a node of the batch fails to redeploy, to
+// provision or its health check.
+func (m *CampaignManager) Progress(client *maas.MAASObject, nodes []MaasNode, options ProcessingOptions) {
+	// In preview mode campaigns are left as they are, so that their nodes
+	// are planned toward the targets of their current phases
+	if m == nil || options.Preview {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	campaign := m.active()
+	if campaign == nil || campaign.State != CampaignRunning {
+		return
+	}
+
+	byID := make(map[string]MaasNode, len(nodes))
+	for _, node := range nodes {
+		byID[node.ID()] = node
+	}
+
+	changed := false
+	for {
+		done := true
+		for _, n := range campaign.batch() {
+			node, ok := byID[n.ID]
+			if ok && m.progressNode(campaign, n, node, options) {
+				changed = true
+			}
+			switch n.Phase {
+			case PhaseDone:
+			case PhaseFailed:
+				campaign.State = CampaignHalted
+				campaign.Reason = fmt.Sprintf("node '%s' failed : %s", n.Hostname, n.Error)
+				log.Errorf("Halting campaign '%s', %s", campaign.Name, campaign.Reason)
+				m.update(campaign)
+				return
+			default:
+				done = false
+			}
+		}
+		if !done {
+			break
+		}
+
+		// Move on to the next batch straight away, so that its nodes are
+		// released in this pass
+		campaign.Batch++
+		changed = true
+		if len(campaign.batch()) == 0 {
+			campaign.State = CampaignComplete
+			log.Infof("Campaign '%s' is complete", campaign.Name)
+			break
+		}
+		log.Infof("Campaign '%s' starting batch %d", campaign.Name, campaign.Batch+1)
+	}
+	if changed {
+		m.update(campaign)
+	}
+}
+
+// progressNode moves a node to its next phase if its state in MAAS allows,
+// returning true if it did. The caller must hold the lock.
+func (m *CampaignManager) progressNode(campaign *Campaign, n *CampaignNode, node MaasNode,
+	options ProcessingOptions) bool {
+	status, err := node.Status()
+	if err != nil {
+		return false
+	}
+	fail := func(reason string) bool {
+		n.Phase = PhaseFailed
+		n.Error = reason
+		return true
+	}
+
+	switch n.Phase {
+	case PhasePending:
+		log.Infof("Campaign '%s' releasing node '%s'", campaign.Name, n.Hostname)
+		n.Phase = PhaseReleasing
+		return true
+	case PhaseReleasing:
+		switch status {
+		case Ready:
+			// Clear the provisioning of the node so it is provisioned again
+			// once redeployed
+			if options.ProvisionURL != "" {
+				if err := options.Provisioner.Clear(n.ID); err != nil {
+					log.Warnf("Unable to clear provisioning state of node '%s' : %s", n.Hostname, err)
+					return false
+				}
+			}
+			log.Infof("Campaign '%s' redeploying node '%s'", campaign.Name, n.Hostname)
+			n.Phase = PhaseRedeploying
+			return true
+		case FailedReleasing, FailedDiskErasing, Broken:
+			return fail("release failed, node is " + status.String())
+		}
+	case PhaseRedeploying:
+		switch status {
+		case Deployed:
+			if options.ProvisionURL != "" {
+				record, err := options.Provisioner.Get(n.ID)
+				if err != nil || record == nil {
+					return false
+				}
+				switch record.Status {
+				case Failed:
+					return fail("provisioning failed")
+				case Complete:
+				default:
+					return false
+				}
+			}
+			n.Phase = PhaseChecking
+			return true
+		case FailedDeployment, Broken:
+			return fail("deployment failed, node is " + status.String())
+		}
+	case PhaseChecking:
+		if campaign.HealthCheck == "" {
+			log.Infof("Campaign '%s' completed node '%s'", campaign.Name, n.Hostname)
+			n.Phase = PhaseDone
+			return true
+		}
+		if !m.checking[n.ID] {
+			m.checking[n.ID] = true
+			go m.healthCheck(campaign, n, node)
+		}
+	}
+	return false
+}
+
+// healthCheck runs the health check of a campaign on a node and records the
+// result
+func (m *CampaignManager) healthCheck(campaign *Campaign, n *CampaignNode, node MaasNode) {
+	timeout := DefaultHealthCheckTimeout
+	if campaign.HealthCheckTimeout != "" {
+		timeout, _ = time.ParseDuration(campaign.HealthCheckTimeout)
+	}
+	ip := ""
+	if ips := node.IPs(); len(ips) > 0 {
+		ip = ips[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	script := m.Checks[campaign.HealthCheck]
+	log.Debugf("Campaign '%s' checking health of node '%s' with '%s'", campaign.Name, n.Hostname, script)
+	err := fmt.Errorf("unknown health check")
+	if script != "" {
+		err = exec.CommandContext(ctx, script, n.ID, n.Hostname, ip).Run()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.checking, n.ID)
+	if n.Phase != PhaseChecking {
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		n.Phase = PhaseFailed
+		n.Error = fmt.Sprintf("health check '%s' failed : %s", campaign.HealthCheck, err)
+	} else {
+		log.Infof("Campaign '%s' completed node '%s'", campaign.Name, n.Hostname)
+		n.Phase = PhaseDone
+	}
+	m.update(campaign)
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+	consul "github.com/hashicorp/consul/api"
+	maas "github.com/juju/gomaasapi"
+)
+
+// newCampaignTest starts a fake MAAS with the given number of deployed and
+// provisioned nodes
+func newCampaignTest(t *testing.T, count int) (*maasfake.Server, *maas.MAASObject, *testProvisioner) {
+	server, client := newTestServer(t, MaasAPIv1)
+	provisioner := newTestProvisioner()
+	for i := 0; i < count; i++ {
+		id := server.AddNode(maasfake.Node{
+			Hostname:   fmt.Sprintf("%c-node", 'a'+i),
+			Status:     maasfake.Deployed,
+			Interfaces: []maasfake.Interface{testInterface("dhcp")},
+		})
+		provisioner.records[id] = &ProvisionRecord{Status: Complete}
+	}
+	return server, client, provisioner
+}
+
+// runCampaign processes the nodes until the campaign is no longer running,
+// completing provisioning requests as they are made
+func runCampaign(t *testing.T, server *maasfake.Server, client *maas.MAASObject,
+	provisioner *testProvisioner, options ProcessingOptions, name string) *Campaign {
+	for cycle := 0; cycle < 50; cycle++ {
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+		if campaign := options.Campaigns.Get(name); campaign.State != CampaignRunning {
+			return campaign
+		}
+		server.Advance(5 * time.Minute)
+		provisioner.mutex.Lock()
+		for _, record := range provisioner.records {
+			record.Status = Complete
+		}
+		provisioner.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("campaign '%s' did not finish", name)
+	return nil
+}
+
+func TestCampaignRedeploysInBatches(t *testing.T) {
+	server, client, provisioner := newCampaignTest(t, 3)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "campaign")
+	if err != nil {
+		t.Fatalf("unable to create directory : %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "campaigns.json")
+
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+	options.Campaigns, err = NewCampaignManager(file, "", "")
+	if err != nil {
+		t.Fatalf("unable to create campaign manager : %s", err)
+	}
+	options.Campaigns.Checks = map[string]string{"healthy": "true"}
+
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	spec := CampaignSpec{Name: "image-update", BatchSize: 1, HealthCheck: "/bin/true"}
+	spec.Selector.Hosts.Include = []string{"^[ab]-"}
+	spec.Selector.Zones.Include = []string{".*"}
+	if _, err := options.Campaigns.Start(spec, nodes); err == nil {
+		t.Errorf("expected a campaign with an unknown health check to be refused")
+	}
+	spec.HealthCheck = "healthy"
+	if _, err := options.Campaigns.Start(spec, nodes); err != nil {
+		t.Fatalf("unable to start campaign : %s", err)
+	}
+	if _, err := options.Campaigns.Start(spec, nodes); err == nil {
+		t.Errorf("expected a second campaign to be refused while the first is running")
+	}
+
+	// The progress of the campaign survives a restart
+	options.Campaigns, err = NewCampaignManager(file, "", "")
+	if err != nil {
+		t.Fatalf("unable to reload campaigns : %s", err)
+	}
+	options.Campaigns.Checks = map[string]string{"healthy": "true"}
+	campaign := runCampaign(t, server, client, provisioner, options, "image-update")
+	if campaign.State != CampaignComplete {
+		t.Fatalf("expected campaign to complete, got %s : %s", campaign.State, campaign.Reason)
+	}
+	if len(campaign.Nodes) != 2 {
+		t.Errorf("expected the campaign to select 2 nodes, got %d", len(campaign.Nodes))
+	}
+	for _, n := range campaign.Nodes {
+		if n.Phase != PhaseDone {
+			t.Errorf("expected node '%s' to be done, got %s", n.Hostname, n.Phase)
+		}
+	}
+
+	// Only the selected nodes were released and provisioned again
+	releases := 0
+	for _, call := range server.Calls() {
+		if call.Op == "release" {
+			releases++
+		}
+	}
+	if releases != 2 || len(provisioner.Requests()) != 2 {
+		t.Errorf("expected 2 nodes to be released and provisioned, got %d and %d",
+			releases, len(provisioner.Requests()))
+	}
+	nodes, _ = fetchNodes(client, MaasAPIv1)
+	for _, node := range nodes {
+		if status, _ := node.Status(); status != Deployed {
+			t.Errorf("expected node '%s' to be deployed, got %s", node.Hostname(), status)
+		}
+	}
+}
+
+// newTestConsul starts a fake Consul agent that holds keys in memory
+func newTestConsul() (*httptest.Server, map[string][]byte) {
+	var mutex sync.Mutex
+	keys := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("X-Consul-LastContact", "0")
+		switch r.Method {
+		case "PUT":
+			keys[key], _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte("true"))
+		case "GET":
+			value, ok := keys[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode([]consul.KVPair{{Key: key, Value: value}})
+		}
+	}))
+	return server, keys
+}
+
+func TestCampaignResumedByNewLeader(t *testing.T) {
+	server, client, provisioner := newCampaignTest(t, 2)
+	defer server.Close()
+	agent, keys := newTestConsul()
+	defer agent.Close()
+	consulURL := "consul://" + strings.TrimPrefix(agent.URL, "http://")
+
+	leader, err := NewCampaignManager("", consulURL, "cord/automation/campaigns")
+	if err != nil {
+		t.Fatalf("unable to create campaign manager : %s", err)
+	}
+	standby, err := NewCampaignManager("", consulURL, "cord/automation/campaigns")
+	if err != nil {
+		t.Fatalf("unable to create campaign manager : %s", err)
+	}
+
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	spec := CampaignSpec{Name: "image-update", BatchSize: 1}
+	spec.Selector.Hosts.Include = []string{".*"}
+	spec.Selector.Zones.Include = []string{".*"}
+	if _, err := leader.Start(spec, nodes); err != nil {
+		t.Fatalf("unable to start campaign : %s", err)
+	}
+	if _, ok := keys["cord/automation/campaigns"]; !ok {
+		t.Fatalf("expected the campaign to be saved in Consul")
+	}
+
+	// The standby replica takes over the campaign when it is elected
+	if standby.Get("image-update") != nil {
+		t.Fatalf("expected the standby replica to not know of the campaign before it is elected")
+	}
+	if err := standby.Load(); err != nil {
+		t.Fatalf("unable to load campaigns : %s", err)
+	}
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+	options.Campaigns = standby
+	campaign := runCampaign(t, server, client, provisioner, options, "image-update")
+	if campaign.State != CampaignComplete {
+		t.Fatalf("expected campaign to complete, got %s : %s", campaign.State, campaign.Reason)
+	}
+}
+
+func TestCampaignHaltsOnFailedHealthCheck(t *testing.T) {
+	server, client, provisioner := newCampaignTest(t, 2)
+	defer server.Close()
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+	options.Campaigns, _ = NewCampaignManager("", "", "")
+	options.Campaigns.Checks = map[string]string{"unhealthy": "false"}
+
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	spec := CampaignSpec{Name: "image-update", BatchSize: 1, HealthCheck: "unhealthy"}
+	spec.Selector.Hosts.Include = []string{".*"}
+	spec.Selector.Zones.Include = []string{".*"}
+	if _, err := options.Campaigns.Start(spec, nodes); err != nil {
+		t.Fatalf("unable to start campaign : %s", err)
+	}
+
+	campaign := runCampaign(t, server, client, provisioner, options, "image-update")
+	if campaign.State != CampaignHalted {
+		t.Fatalf("expected campaign to halt, got %s", campaign.State)
+	}
+	if campaign.Batch != 0 || campaign.Nodes[0].Phase != PhaseFailed || campaign.Nodes[1].Phase != PhasePending {
+		t.Errorf("expected campaign to halt at the first node, got %+v %+v", campaign.Nodes[0], campaign.Nodes[1])
+	}
+}
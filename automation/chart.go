@@ -0,0 +1,401 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Pseudo nodes that mark the entry and exit of a chart. An edge to the end
+// node from the target state lists the actions taken once the target has
+// been reached.
+const (
+	chartStart = "(start)"
+	chartEnd   = "(end)"
+)
+
+// ChartEdge a single transition in a state machine chart. If the transition
+// is labeled, the label names the action automation invokes to move a node
+// along the edge, else MAAS is expected to move the node on its own.
+type ChartEdge struct {
+	From  string
+	To    string
+	Label string
+	Line  int
+}
+
+// StateChart the parsed form of a yUML style activity chart describing the
+// lifecycle of a node. States are written as (Name), decision nodes as |name|
+// and transitions as -> or -[Action]->, i.e.
+//
+//	(New)-[Commission]->(Commissioning)
+//	(Commissioning)->(Ready)
+//	(Deployed)-[Provision]->(end)
+type StateChart struct {
+	States    []string
+	Edges     []ChartEdge
+	decisions map[string]bool
+}
+
+// parseChartNode parses the state or decision node at the start of the given
+// text and returns the key of the node along with the remaining text
+func parseChartNode(text string) (string, string, error) {
+	if len(text) == 0 {
+		return "", "", fmt.Errorf("expected a state or decision, found end of line")
+	}
+
+	var close byte
+	switch text[0] {
+	case '(':
+		close = ')'
+	case '|':
+		close = '|'
+	default:
+		return "", "", fmt.Errorf("expected '(' or '|' at '%s'", text)
+	}
+	idx := strings.IndexByte(text[1:], close)
+	if idx == -1 {
+		return "", "", fmt.Errorf("missing closing '%c' in '%s'", close, text)
+	}
+	name := strings.TrimSpace(text[1 : idx+1])
+	if name == "" {
+		return "", "", fmt.Errorf("empty name in '%s'", text[:idx+2])
+	}
+	rest := strings.TrimSpace(text[idx+2:])
+
+	if close == '|' {
+		return "|" + name + "|", rest, nil
+	}
+	switch strings.ToLower(name) {
+	case "start":
+		return chartStart, rest, nil
+	case "end":
+		return chartEnd, rest, nil
+	}
+	return name, rest, nil
+}
+
+// parseChartArrow parses the transition at the start of the given text and
+// returns its label, if any, along with the remaining text
+func parseChartArrow(text string) (string, string, error) {
+	if strings.HasPrefix(text, "->") {
+		return "", strings.TrimSpace(text[2:]), nil
+	}
+	if strings.HasPrefix(text, "-[") {
+		idx := strings.Index(text, "]->")
+		if idx != -1 {
+			label := strings.TrimSpace(text[2:idx])
+			if label == "" {
+				return "", "", fmt.Errorf("empty action label in '%s'", text[:idx+3])
+			}
+			return label, strings.TrimSpace(text[idx+3:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("expected '->' or '-[Action]->' at '%s'", text)
+}
+
+// ParseChart parses the given chart text. Blank lines and lines starting with
+// '//' are ignored. A line may chain several transitions, i.e. (A)->(B)->(C).
+func ParseChart(chart string) (*StateChart, error) {
+	result := &StateChart{
+		decisions: make(map[string]bool),
+	}
+	seen := make(map[string]bool)
+	addNode := func(key string) {
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		switch {
+		case key == chartStart || key == chartEnd:
+		case strings.HasPrefix(key, "|"):
+			result.decisions[key] = true
+		default:
+			result.States = append(result.States, key)
+		}
+	}
+
+	for i, line := range strings.Split(chart, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		from, rest, err := parseChartNode(line)
+		if err != nil {
+			return nil, fmt.Errorf("chart line %d: %s", i+1, err)
+		}
+		if rest == "" {
+			return nil, fmt.Errorf("chart line %d: expected a transition after '%s'", i+1, from)
+		}
+		addNode(from)
+		for rest != "" {
+			var label, to string
+			if label, rest, err = parseChartArrow(rest); err != nil {
+				return nil, fmt.Errorf("chart line %d: %s", i+1, err)
+			}
+			if to, rest, err = parseChartNode(rest); err != nil {
+				return nil, fmt.Errorf("chart line %d: %s", i+1, err)
+			}
+			if from == chartEnd {
+				return nil, fmt.Errorf("chart line %d: '%s' cannot have outgoing transitions", i+1, chartEnd)
+			}
+			if to == chartStart {
+				return nil, fmt.Errorf("chart line %d: '%s' cannot be the destination of a transition", i+1, chartStart)
+			}
+			if label != "" && strings.HasPrefix(from, "|") {
+				return nil, fmt.Errorf("chart line %d: transitions out of decision '%s' cannot be labeled with an action",
+					i+1, from)
+			}
+			addNode(to)
+			result.Edges = append(result.Edges, ChartEdge{
+				From:  from,
+				To:    to,
+				Label: label,
+				Line:  i + 1,
+			})
+			from = to
+		}
+	}
+
+	if len(result.Edges) == 0 {
+		return nil, fmt.Errorf("chart contains no transitions")
+	}
+
+	// Every decision must lead somewhere, otherwise it is a dead end
+	for key := range result.decisions {
+		found := false
+		for _, edge := range result.Edges {
+			if edge.From == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("decision '%s' has no outgoing transitions", key)
+		}
+	}
+	return result, nil
+}
+
+// Goal returns the state a chart moves nodes toward, this is the state that
+// transitions to (end). As a target need not be named after a MAAS state,
+// i.e. released nodes are Ready, the target is used when there is no such
+// transition.
+func (c *StateChart) Goal(target string) (string, error) {
+	goal := ""
+	for _, edge := range c.Edges {
+		if edge.To != chartEnd {
+			continue
+		}
+		if goal != "" && goal != edge.From {
+			return "", fmt.Errorf("chart line %d: only one state may transition to '%s', found '%s' and '%s'",
+				edge.Line, chartEnd, goal, edge.From)
+		}
+		goal = edge.From
+	}
+	if goal == "" {
+		return target, nil
+	}
+	if strings.HasPrefix(goal, "|") {
+		return "", fmt.Errorf("decision '%s' cannot transition to '%s'", goal, chartEnd)
+	}
+	return goal, nil
+}
+
+// Transitions generates the "next step" table that moves nodes toward the
+// given target state. For each state the next step is the first edge on the
+// shortest path to the target. A labeled edge results in the named action, an
+// unlabeled edge in Wait, as MAAS will move the node. States from which the
+// target cannot be reached use their first labeled transition, if any. All
+// steps are preceded by Reset, while the target state itself runs the actions
+// on its transitions to (end) followed by Done.
+func (c *StateChart) Transitions(target string, actions map[string]Action) (map[string][]Action, error) {
+	for _, edge := range c.Edges {
+		if edge.Label == "" {
+			continue
+		}
+		if _, ok := actions[edge.Label]; !ok {
+			return nil, fmt.Errorf("chart line %d: unknown action '%s'", edge.Line, edge.Label)
+		}
+	}
+
+	steps, err := c.Steps(target)
+	if err != nil {
+		return nil, err
+	}
+
+	table := make(map[string][]Action)
+	for _, state := range c.States {
+		if state == target {
+			final := []Action{}
+			for _, edge := range c.Edges {
+				if edge.From == state && edge.To == chartEnd && edge.Label != "" {
+					final = append(final, actions[edge.Label])
+				}
+			}
+			table[state] = append(final, Done)
+			continue
+		}
+
+		next := steps[state]
+		switch {
+		case next == nil:
+			log.Debugf("no transition from state '%s' toward target state '%s'", state, target)
+		case next.Label == "":
+			table[state] = []Action{Reset, Wait}
+		default:
+			table[state] = []Action{Reset, actions[next.Label]}
+		}
+	}
+	return table, nil
+}
+
+// Steps returns, for each state other than the given target, the edge on
+// which nodes in that state are moved toward the target, i.e. the first edge
+// on the shortest path to the target or, if the target cannot be reached, the
+// first labeled edge. States with no such edge are left out.
+func (c *StateChart) Steps(target string) (map[string]*ChartEdge, error) {
+	found := false
+	for _, state := range c.States {
+		if state == target {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("target state '%s' does not appear in the chart", target)
+	}
+
+	// Walk the chart backwards from the target to find the distance from every
+	// node to the target
+	distance := map[string]int{target: 0}
+	queue := []string{target}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, edge := range c.Edges {
+			if edge.To != current || edge.From == chartStart {
+				continue
+			}
+			if _, ok := distance[edge.From]; !ok {
+				distance[edge.From] = distance[current] + 1
+				queue = append(queue, edge.From)
+			}
+		}
+	}
+	if len(distance) == 1 {
+		return nil, fmt.Errorf("no state in the chart leads to target state '%s'", target)
+	}
+
+	steps := make(map[string]*ChartEdge)
+	for _, state := range c.States {
+		if state == target {
+			continue
+		}
+
+		var next *ChartEdge
+		if dist, ok := distance[state]; ok {
+			for i, edge := range c.Edges {
+				if edge.From == state {
+					if d, ok := distance[edge.To]; ok && d == dist-1 {
+						next = &c.Edges[i]
+						break
+					}
+				}
+			}
+		} else {
+			for i, edge := range c.Edges {
+				if edge.From == state && edge.To != chartEnd && edge.Label != "" {
+					next = &c.Edges[i]
+					break
+				}
+			}
+		}
+
+		if next != nil {
+			steps[state] = next
+		}
+	}
+	return steps, nil
+}
+
+// loadChart returns the chart text for the given specification, which is
+// either the chart itself or a '@' followed by the name of a file that
+// contains the chart.
+func loadChart(spec string) (string, error) {
+	if !strings.HasPrefix(spec, "@") {
+		return spec, nil
+	}
+	name := os.ExpandEnv(spec[1:])
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to read chart from file '%s' : %s", name, err)
+	}
+	return string(data), nil
+}
+
+// LoadCharts parses the charts, by target state, from the given
+// specifications. Charts are specified as the chart text or as '@' followed by
+// the name of a file containing the chart. Targets not specified use the
+// charts that ship with automation.
+func LoadCharts(specs map[string]string) (map[string]*StateChart, error) {
+	charts := make(map[string]string)
+	for target, chart := range defaultCharts {
+		charts[target] = chart
+	}
+	for target, spec := range specs {
+		chart, err := loadChart(spec)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		charts[target] = chart
+	}
+
+	result := make(map[string]*StateChart)
+	for target, chart := range charts {
+		parsed, err := ParseChart(chart)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		result[target] = parsed
+	}
+	return result, nil
+}
+
+// BuildTransitions generates the transition tables, by target state, from the
+// charts given as for LoadCharts
+func BuildTransitions(specs map[string]string) (map[string]map[string][]Action, error) {
+	charts, err := LoadCharts(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string][]Action)
+	for target, parsed := range charts {
+		goal, err := parsed.Goal(target)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		table, err := parsed.Transitions(goal, Actions)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		result[target] = table
+	}
+	return result, nil
+}
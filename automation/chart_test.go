@@ -0,0 +1,103 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultChartTransitions(t *testing.T) {
+	charts, err := LoadCharts(map[string]string{})
+	if err != nil {
+		t.Fatalf("unable to load charts : %s", err)
+	}
+	table, err := charts["Deployed"].Transitions("Deployed", Actions)
+	if err != nil {
+		t.Fatalf("unable to generate transitions : %s", err)
+	}
+
+	// The states of the table that was maintained by hand before it was
+	// generated from the chart, followed by the states added since
+	expected := map[string][]string{
+		"New":                 {"Reset", "Commission"},
+		"Deployed":            {"Provision", "Done"},
+		"Ready":               {"Reset", "Aquire"},
+		"Allocated":           {"Reset", "Deploy"},
+		"Retired":             {"Reset", "AdminState"},
+		"Reserved":            {"Reset", "AdminState"},
+		"Releasing":           {"Reset", "Wait"},
+		"DiskErasing":         {"Reset", "Wait"},
+		"Deploying":           {"Reset", "Wait"},
+		"Commissioning":       {"Reset", "Wait"},
+		"Missing":             {"Reset", "Fail"},
+		"FailedReleasing":     {"Reset", "Fail"},
+		"FailedDiskErasing":   {"Reset", "Fail"},
+		"FailedDeployment":    {"Reset", "Fail"},
+		"Broken":              {"Reset", "Fail"},
+		"FailedCommissioning": {"Reset", "Fail"},
+
+		"Testing":                  {"Reset", "Wait"},
+		"FailedTesting":            {"Reset", "Fail"},
+		"EnteringRescueMode":       {"Reset", "Wait"},
+		"FailedEnteringRescueMode": {"Reset", "AdminState"},
+		"RescueMode":               {"Reset", "AdminState"},
+		"ExitingRescueMode":        {"Reset", "Wait"},
+		"FailedExitingRescueMode":  {"Reset", "AdminState"},
+	}
+	actual := make(map[string][]string)
+	for state, actions := range table {
+		actual[state] = ActionNames(actions)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected transitions\n%v\ngot\n%v", expected, actual)
+	}
+}
+
+func TestChartErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		chart  string
+		target string
+		err    string
+	}{
+		{"no transitions", "// nothing here", "Ready", "chart contains no transitions"},
+		{"missing arrow", "(New)", "Ready", "line 1: expected a transition after 'New'"},
+		{"malformed arrow", "(New)=>(Ready)", "Ready", "line 1: expected '->' or '-[Action]->' at '=>(Ready)'"},
+		{"unclosed state", "(New)->(Ready", "Ready", "line 1: missing closing ')' in '(Ready'"},
+		{"empty label", "(New)-[ ]->(Ready)", "Ready", "line 1: empty action label"},
+		{"leaving end", "(New)->(end)->(Ready)", "Ready", "'(end)' cannot have outgoing transitions"},
+		{"labeled decision", "(New)->|a|\n|a|-[Fail]->(Ready)", "Ready", "line 2: transitions out of decision '|a|' cannot be labeled"},
+		{"dead end decision", "(New)->|a|", "New", "decision '|a|' has no outgoing transitions"},
+		{"unknown action", "(New)-[Explode]->(Ready)", "Ready", "line 1: unknown action 'Explode'"},
+		{"missing target", "(New)-[Commission]->(Ready)", "Deployed", "target state 'Deployed' does not appear in the chart"},
+		{"unreachable target", "(New)-[Commission]->(Ready)\n(Deployed)->(end)", "Deployed", "no state in the chart leads to target state 'Deployed'"},
+		{"two goals", "(New)->(end)\n(Ready)->(end)", "Ready", "line 2: only one state may transition to '(end)'"},
+	}
+	for _, c := range cases {
+		chart, err := ParseChart(c.chart)
+		if err == nil {
+			var goal string
+			if goal, err = chart.Goal(c.target); err == nil {
+				_, err = chart.Transitions(goal, Actions)
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: expected chart to be rejected", c.name)
+		} else if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing '%s', got '%s'", c.name, c.err, err)
+		}
+	}
+}
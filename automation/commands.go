@@ -0,0 +1,245 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// Command a subcommand of maas-flow, run once with the given arguments in
+// place of automating nodes. The command returns the exit status. A command
+// that reports itself Offline for its arguments is run without a MAAS
+// client, before the MAAS configuration is required.
+type Command struct {
+	Usage   string
+	Run     func(client *maas.MAASObject, options ProcessingOptions, args []string, out io.Writer) int
+	Offline func(args []string) bool
+}
+
+// commands the subcommands of maas-flow by name
+var commands = map[string]Command{
+	"audit": {
+		Usage: auditUsage,
+		Run:   auditCommand,
+	},
+	"inventory": {
+		Usage: inventoryUsage,
+		Run:   inventoryCommand,
+	},
+	"lifecycle": {
+		Usage:   lifecycleUsage,
+		Run:     lifecycleCommand,
+		Offline: lifecycleOffline,
+	},
+}
+
+// runCommand runs the subcommand named by the first argument
+func runCommand(client *maas.MAASObject, options ProcessingOptions, args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", args[0])
+		commandUsage(os.Stderr)
+		return 2
+	}
+	return command.Run(client, options, args[1:], os.Stdout)
+}
+
+// commandOffline returns true if the subcommand named by the first argument
+// needs no MAAS client
+func commandOffline(args []string) bool {
+	command, ok := commands[args[0]]
+	return ok && command.Offline != nil && command.Offline(args[1:])
+}
+
+// commandUsage writes the usage of the subcommands
+func commandUsage(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].Usage)
+	}
+}
+
+// writeIndentedJSON writes a value as indented JSON
+func writeIndentedJSON(out io.Writer, v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", bytes)
+	return err
+}
+
+const inventoryUsage = "inventory [--list | --host <hostname>]\tprint an Ansible dynamic inventory of the deployed nodes"
+
+// inventoryCommand writes the Ansible inventory, or the variables of a single
+// host, as Ansible expects of a dynamic inventory script
+func inventoryCommand(client *maas.MAASObject, options ProcessingOptions, args []string, out io.Writer) int {
+	inventory, err := fetchInventory(client, options)
+	if err != nil {
+		log.Errorf("Unable to build the inventory : %s", err)
+		return 1
+	}
+	var result interface{} = inventory
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "--list"):
+	case len(args) == 2 && args[0] == "--host":
+		vars, ok := inventory.HostVars[args[1]]
+		if !ok {
+			result = map[string]string{}
+		} else {
+			result = vars
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: maas-flow", inventoryUsage)
+		return 2
+	}
+	if err := writeIndentedJSON(out, result); err != nil {
+		log.Errorf("Unable to write the inventory : %s", err)
+		return 1
+	}
+	return 0
+}
+
+const auditUsage = "audit [--node <id|hostname>] [--action <action>] [--since <time|duration>] [--limit <n>]\tprint the changes automation made in MAAS"
+
+// auditCommand writes the audit entries selected by the arguments
+func auditCommand(client *maas.MAASObject, options ProcessingOptions, args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	node := flags.String("node", "", "")
+	action := flags.String("action", "", "")
+	since := flags.String("since", "", "")
+	limit := flags.Int("limit", 0, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: maas-flow", auditUsage)
+		return 2
+	}
+	query := AuditQuery{Node: *node, Action: *action, Limit: *limit}
+	var err error
+	if query.Since, err = parseSince(*since); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	entries, err := options.Audit.Query(query)
+	if err != nil {
+		log.Errorf("Unable to query the audit log : %s", err)
+		return 1
+	}
+	if err := writeIndentedJSON(out, entries); err != nil {
+		log.Errorf("Unable to write the audit entries : %s", err)
+		return 1
+	}
+	return 0
+}
+
+const lifecycleUsage = "lifecycle [--format dot|mermaid|table] [--target <target>] [--counts] [--fixture <file>]\tprint the transitions automation takes, with the number of nodes in each state"
+
+// lifecycleOffline returns true unless the nodes are counted in MAAS itself
+// rather than in a fixture
+func lifecycleOffline(args []string) bool {
+	counted := false
+	for _, arg := range args {
+		switch arg {
+		case "--fixture":
+			return true
+		case "--counts":
+			counted = true
+		}
+	}
+	return !counted
+}
+
+// lifecycleCommand writes the diagrams of the transition charts, optionally
+// of a single target state and with the node counts from MAAS, or from a fake
+// MAAS loaded with the nodes of a fixture
+func lifecycleCommand(client *maas.MAASObject, options ProcessingOptions, args []string, out io.Writer) int {
+	format, target, fixture, counted := "dot", "", "", false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--format" && i+1 < len(args):
+			i++
+			format = args[i]
+		case args[i] == "--target" && i+1 < len(args):
+			i++
+			target = args[i]
+		case args[i] == "--counts":
+			counted = true
+		case args[i] == "--fixture" && i+1 < len(args):
+			i++
+			fixture = args[i]
+			counted = true
+		default:
+			fmt.Fprintln(os.Stderr, "usage: maas-flow", lifecycleUsage)
+			return 2
+		}
+	}
+
+	charts := TransitionCharts
+	if target != "" {
+		chart, ok := charts[target]
+		if !ok {
+			log.Errorf("No transition chart for target state '%s'", target)
+			return 2
+		}
+		charts = map[string]*StateChart{target: chart}
+	}
+
+	if fixture != "" {
+		fake, stop, err := fakeMAAS(fixture, options.API)
+		if err != nil {
+			log.Errorf("Unable to start a fake MAAS : %s", err)
+			return 1
+		}
+		defer stop()
+		client = fake
+	}
+
+	var counts map[string]map[string]int
+	if counted {
+		nodes, err := fetchNodes(client, options.API)
+		if err != nil {
+			log.Errorf("Unable to fetch the nodes : %s", err)
+			return 1
+		}
+		if counts, err = countNodes(nodes, options); err != nil {
+			log.Errorf("Unable to count the nodes : %s", err)
+			return 1
+		}
+	}
+
+	diagrams, err := BuildDiagrams(charts, counts)
+	if err != nil {
+		log.Errorf("Unable to build the lifecycle : %s", err)
+		return 1
+	}
+	if err := WriteDiagrams(out, diagrams, format); err != nil {
+		log.Errorf("Unable to write the lifecycle : %s", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// HardwareSpec the minimum hardware a node must have, as found when it was
+// commissioned, before it is deployed. Sizes are given in bytes or with a K,
+// M, G, T or P suffix, and NIC speeds in Mbps. Only the disks and NICs that
+// meet the minimum size or speed are counted.
+type HardwareSpec struct {
+	MinCores    int    `json:"min_cores,omitempty"`
+	MinMemory   string `json:"min_memory,omitempty"`
+	MinDisks    int    `json:"min_disks,omitempty"`
+	MinDiskSize string `json:"min_disk_size,omitempty"`
+	MinNICs     int    `json:"min_nics,omitempty"`
+	MinNICSpeed int    `json:"min_nic_speed,omitempty"`
+
+	memory   int64
+	diskSize int64
+}
+
+// HardwareSpecs the hardware specifications by node role
+type HardwareSpecs map[string]*HardwareSpec
+
+// Load verifies the specifications
+func (s HardwareSpecs) Load() error {
+	for role, spec := range s {
+		if spec == nil {
+			return fmt.Errorf("hardware specification of role '%s' is empty", role)
+		}
+		var err error
+		if spec.MinMemory != "" {
+			if spec.memory, err = parseSize(spec.MinMemory); err != nil {
+				return fmt.Errorf("invalid memory of hardware specification of role '%s' : %s", role, err)
+			}
+		}
+		if spec.MinDiskSize != "" {
+			if spec.diskSize, err = parseSize(spec.MinDiskSize); err != nil {
+				return fmt.Errorf("invalid disk size of hardware specification of role '%s' : %s", role, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Spec returns the hardware specification of the given role, or nil if
+// there is none
+func (s HardwareSpecs) Spec(role string) *HardwareSpec {
+	if role == "" {
+		return nil
+	}
+	return s[role]
+}
+
+// violations returns the ways in which the hardware of a node falls short of
+// the specification
+func (s *HardwareSpec) violations(node MaasNode, disks []*blockDevice, nics []*nodeInterface) []string {
+	result := []string{}
+	if cores := node.CPUCount(); cores < s.MinCores {
+		result = append(result, fmt.Sprintf("%d cores, %d required", cores, s.MinCores))
+	}
+	if memory := int64(node.Memory()) * 1024 * 1024; memory < s.memory {
+		result = append(result, fmt.Sprintf("%d MiB memory, %s required", node.Memory(), s.MinMemory))
+	}
+	if s.MinDisks > 0 {
+		count := 0
+		for _, disk := range disks {
+			if disk.Size >= s.diskSize {
+				count++
+			}
+		}
+		if count < s.MinDisks {
+			qualifier := ""
+			if s.MinDiskSize != "" {
+				qualifier = " of at least " + s.MinDiskSize
+			}
+			result = append(result, fmt.Sprintf("%d disks%s, %d required", count, qualifier, s.MinDisks))
+		}
+	}
+	if s.MinNICs > 0 {
+		count := 0
+		for _, nic := range nics {
+			if (nic.Type == "" || nic.Type == "physical") && nic.LinkSpeed >= s.MinNICSpeed {
+				count++
+			}
+		}
+		if count < s.MinNICs {
+			qualifier := ""
+			if s.MinNICSpeed > 0 {
+				qualifier = fmt.Sprintf(" of at least %d Mbps", s.MinNICSpeed)
+			}
+			result = append(result, fmt.Sprintf("%d NICs%s, %d required", count, qualifier, s.MinNICs))
+		}
+	}
+	return result
+}
+
+// noncompliantDescriptionPrefix starts the line of a node's description that
+// holds why its hardware does not meet its specification
+const noncompliantDescriptionPrefix = "Noncompliant: "
+
+// checkCompliance verifies that the hardware of a node meets the
+// specification of its role. A node that does not is tagged as non-compliant
+// in MAAS, with the reason in its description, and a BlockedError is returned
+// so that it is not deployed. Automation of the node resumes once an operator
+// removes the tag.
+func checkCompliance(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	role := options.Roles.Role(node)
+	spec := options.Hardware.Spec(role)
+	if spec == nil {
+		return nil
+	}
+	var disks []*blockDevice
+	if spec.MinDisks > 0 {
+		var err error
+		if disks, err = fetchBlockDevices(client, node); err != nil {
+			return err
+		}
+	}
+	var nics []*nodeInterface
+	if spec.MinNICs > 0 {
+		var err error
+		if nics, err = fetchInterfaces(client, node); err != nil {
+			return err
+		}
+	}
+
+	violations := spec.violations(node, disks, nics)
+	if len(violations) == 0 {
+		if options.Preview {
+			return nil
+		}
+		return describeNode(client, node, options, noncompliantDescriptionPrefix, "")
+	}
+	reason := fmt.Sprintf("hardware does not meet the specification of role '%s' : %s",
+		role, strings.Join(violations, "; "))
+	log.Errorf("NONCOMPLIANT: %s : %s", node.Hostname(), reason)
+	options.Tracker.SetNoncompliant(node.ID(), reason)
+	options.Plan.Skip(node, "noncompliant, "+reason)
+
+	if !options.Preview && options.NoncompliantTag != "" {
+		err := addNodeTag(client, node, options, options.NoncompliantTag,
+			"nodes whose hardware does not meet the specification of their role")
+		if err != nil {
+			log.Errorf("Unable to tag node '%s' as noncompliant : %s", node.Hostname(), err)
+			return err
+		}
+		err = describeNode(client, node, options, noncompliantDescriptionPrefix, noncompliantDescriptionPrefix+reason)
+		if err != nil {
+			log.Warnf("Unable to describe why node '%s' is noncompliant : %s", node.Hostname(), err)
+		}
+	}
+	return &BlockedError{Reason: reason}
+}
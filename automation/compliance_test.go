@@ -0,0 +1,110 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestHardwareCompliance(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+
+	compliant := maasfake.Node{
+		SystemID: "good",
+		Hostname: "good",
+		Status:   maasfake.Ready,
+		CPUCount: 16,
+		Memory:   65536,
+		BlockDevices: []maasfake.BlockDevice{
+			{Size: 500 * gigabyte},
+			{Size: 500 * gigabyte},
+		},
+		Interfaces: []maasfake.Interface{
+			{MAC: "00:00:00:00:01:01", LinkSpeed: 10000},
+			{MAC: "00:00:00:00:01:02", LinkSpeed: 10000},
+		},
+	}
+	server.AddNode(compliant)
+
+	degraded := compliant
+	degraded.SystemID = "bad"
+	degraded.Hostname = "bad"
+	degraded.Memory = 32768
+	degraded.Interfaces = []maasfake.Interface{
+		{MAC: "00:00:00:00:02:01", LinkSpeed: 10000},
+		{MAC: "00:00:00:00:02:02", LinkSpeed: 1000},
+	}
+	server.AddNode(degraded)
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Roles = &RoleSelector{Default: "compute"}
+	options.NoncompliantTag = "noncompliant"
+	options.Hardware = HardwareSpecs{"compute": {
+		MinCores:    8,
+		MinMemory:   "64G",
+		MinDisks:    2,
+		MinDiskSize: "400G",
+		MinNICs:     2,
+		MinNICSpeed: 10000,
+	}}
+	if err := options.Hardware.Load(); err != nil {
+		t.Fatalf("invalid hardware specifications : %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+	}
+
+	good, _ := server.Node("good")
+	if good.Status != maasfake.Deploying {
+		t.Errorf("expected compliant node to be deployed, got status %d", good.Status)
+	}
+	bad, _ := server.Node("bad")
+	if bad.Status != maasfake.Ready {
+		t.Errorf("expected noncompliant node not to be acquired, got status %d", bad.Status)
+	}
+	if !reflect.DeepEqual(bad.Tags, []string{"noncompliant"}) {
+		t.Errorf("expected noncompliant node to be tagged, got %v", bad.Tags)
+	}
+
+	reason := options.Tracker.Noncompliant("bad")
+	for _, expected := range []string{"32768 MiB memory", "1 NICs of at least 10000 Mbps"} {
+		if !strings.Contains(reason, expected) {
+			t.Errorf("expected reason to contain '%s', got '%s'", expected, reason)
+		}
+	}
+	if state := options.Tracker.Get("bad"); state.Failures != 0 || state.Quarantined {
+		t.Errorf("expected noncompliant node not to be counted as failing, got %+v", state)
+	}
+	if !strings.HasPrefix(bad.Description, noncompliantDescriptionPrefix+reason+" at ") {
+		t.Errorf("expected the reason to be described in MAAS, got '%s'", bad.Description)
+	}
+
+	// The reason is recovered from MAAS after a restart
+	options.Tracker = NewNodeTracker()
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	ProcessAll(client, nodes, options)
+	if recovered := options.Tracker.Noncompliant("bad"); recovered != reason {
+		t.Errorf("expected reason '%s' after a restart, got '%s'", reason, recovered)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Diagram the lifecycle of nodes toward one target state, as generated from
+// its chart. Steps are the edges automation follows from each state, and
+// Counts, if known, the number of nodes with the target in each state.
+type Diagram struct {
+	Target string
+	Goal   string
+	Chart  *StateChart
+	Steps  map[string]*ChartEdge
+	Table  map[string][]Action
+	Counts map[string]int
+}
+
+// BuildDiagrams returns the diagrams of the given charts, ordered by target
+// state. The node counts, by target state and then by MAAS state, are shown
+// if given.
+func BuildDiagrams(charts map[string]*StateChart, counts map[string]map[string]int) ([]*Diagram, error) {
+	targets := make([]string, 0, len(charts))
+	for target := range charts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	result := make([]*Diagram, 0, len(targets))
+	for _, target := range targets {
+		chart := charts[target]
+		goal, err := chart.Goal(target)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		steps, err := chart.Steps(goal)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		table, err := chart.Transitions(goal, Actions)
+		if err != nil {
+			return nil, fmt.Errorf("target state '%s' : %s", target, err)
+		}
+		diagram := &Diagram{
+			Target: target,
+			Goal:   goal,
+			Chart:  chart,
+			Steps:  steps,
+			Table:  table,
+		}
+		if counts != nil {
+			diagram.Counts = counts[target]
+			if diagram.Counts == nil {
+				diagram.Counts = map[string]int{}
+			}
+		}
+		result = append(result, diagram)
+	}
+	return result, nil
+}
+
+// countNodes returns the number of nodes automation manages, by target state
+// and then by MAAS state
+func countNodes(nodes []MaasNode, options ProcessingOptions) (map[string]map[string]int, error) {
+	counts := make(map[string]map[string]int)
+	for _, node := range nodes {
+		nodeStatus, err := node.Status()
+		if err != nil {
+			return nil, err
+		}
+		status := nodeStatus.String()
+		if options.Filter.Excludes(node, status) != "" {
+			continue
+		}
+		target := options.Targets.Target(node)
+		if counts[target] == nil {
+			counts[target] = make(map[string]int)
+		}
+		counts[target][status]++
+	}
+	return counts, nil
+}
+
+// invalidDiagramID matches the characters that may not appear in the ID of a
+// diagram node
+var invalidDiagramID = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// id returns the ID of a state of the diagram, unique across diagrams
+func (d *Diagram) id(key string) string {
+	switch key {
+	case chartStart:
+		key = "start"
+	case chartEnd:
+		key = "end"
+	}
+	return invalidDiagramID.ReplaceAllString(d.Target+"_"+key, "_")
+}
+
+// decisions returns the decisions of the chart in the order they appear
+func (d *Diagram) decisions() []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, edge := range d.Chart.Edges {
+		for _, key := range []string{edge.From, edge.To} {
+			if d.Chart.decisions[key] && !seen[key] {
+				seen[key] = true
+				result = append(result, key)
+			}
+		}
+	}
+	return result
+}
+
+// label returns the label of a state, with the number of nodes in the state
+// if known
+func (d *Diagram) label(state string) string {
+	label := strings.Trim(state, "|")
+	if d.Counts != nil && !strings.HasPrefix(state, "|") {
+		label += fmt.Sprintf(" (%d)", d.Counts[state])
+	}
+	return label
+}
+
+// edgeLabel returns the action on an edge, which is Wait for an edge that
+// automation follows but MAAS performs
+func (d *Diagram) edgeLabel(edge *ChartEdge) string {
+	if edge.Label == "" && d.Steps[edge.From] == edge {
+		return "Wait"
+	}
+	return edge.Label
+}
+
+// Unmanaged returns the number of nodes in states that do not appear in the
+// chart, which automation leaves alone
+func (d *Diagram) Unmanaged() int {
+	total := 0
+	for state, count := range d.Counts {
+		if _, ok := d.Table[state]; !ok {
+			total += count
+		}
+	}
+	return total
+}
+
+// WriteDOT writes the diagram as a Graphviz subgraph. Edges that automation
+// follows are bold, edges that MAAS follows on its own are dashed, and
+// states from which automation takes no action are grey.
+func (d *Diagram) WriteDOT(out io.Writer) {
+	fmt.Fprintf(out, "  subgraph \"cluster_%s\" {\n", d.id(""))
+	fmt.Fprintf(out, "    label=%q;\n", "target "+d.Target)
+	fmt.Fprintf(out, "    %s [shape=point];\n", d.id(chartStart))
+	fmt.Fprintf(out, "    %s [shape=doublecircle, label=\"\", width=0.2];\n", d.id(chartEnd))
+	for _, key := range d.decisions() {
+		fmt.Fprintf(out, "    %s [shape=diamond, label=%q];\n", d.id(key), d.label(key))
+	}
+	for _, state := range d.Chart.States {
+		attrs := fmt.Sprintf("label=%q", d.label(state))
+		switch _, ok := d.Table[state]; {
+		case state == d.Goal:
+			attrs += ", peripheries=2"
+		case !ok:
+			attrs += ", color=grey, fontcolor=grey"
+		}
+		fmt.Fprintf(out, "    %s [%s];\n", d.id(state), attrs)
+	}
+	for i := range d.Chart.Edges {
+		edge := &d.Chart.Edges[i]
+		attrs := []string{}
+		if label := d.edgeLabel(edge); label != "" {
+			attrs = append(attrs, fmt.Sprintf("label=%q", label))
+		}
+		if edge.Label == "" {
+			attrs = append(attrs, "style=dashed")
+		}
+		if d.Steps[edge.From] == edge {
+			attrs = append(attrs, "penwidth=2")
+		}
+		fmt.Fprintf(out, "    %s -> %s", d.id(edge.From), d.id(edge.To))
+		if len(attrs) > 0 {
+			fmt.Fprintf(out, " [%s]", strings.Join(attrs, ", "))
+		}
+		fmt.Fprintln(out, ";")
+	}
+	fmt.Fprintln(out, "  }")
+}
+
+// mermaidText escapes the text of a Mermaid label
+func mermaidText(text string) string {
+	return strings.Replace(text, "\"", "#quot;", -1)
+}
+
+// WriteMermaid writes the diagram as a Mermaid flowchart subgraph. Edges that
+// automation follows are thick, edges that MAAS follows on its own are dotted
+// and states from which automation takes no action are grey.
+func (d *Diagram) WriteMermaid(out io.Writer) {
+	fmt.Fprintf(out, "  subgraph %s[\"target %s\"]\n", d.id(""), mermaidText(d.Target))
+	fmt.Fprintf(out, "    %s((start))\n", d.id(chartStart))
+	fmt.Fprintf(out, "    %s(((end)))\n", d.id(chartEnd))
+	for _, key := range d.decisions() {
+		fmt.Fprintf(out, "    %s{\"%s\"}\n", d.id(key), mermaidText(d.label(key)))
+	}
+	for _, state := range d.Chart.States {
+		if state == d.Goal {
+			fmt.Fprintf(out, "    %s([\"%s\"])\n", d.id(state), mermaidText(d.label(state)))
+		} else {
+			fmt.Fprintf(out, "    %s[\"%s\"]\n", d.id(state), mermaidText(d.label(state)))
+		}
+	}
+	for i := range d.Chart.Edges {
+		edge := &d.Chart.Edges[i]
+		arrow := "-->"
+		switch {
+		case d.Steps[edge.From] == edge:
+			arrow = "==>"
+		case edge.Label == "":
+			arrow = "-.->"
+		}
+		if label := d.edgeLabel(edge); label != "" {
+			arrow += "|" + mermaidText(label) + "|"
+		}
+		fmt.Fprintf(out, "    %s %s %s\n", d.id(edge.From), arrow, d.id(edge.To))
+	}
+	for _, state := range d.Chart.States {
+		if _, ok := d.Table[state]; !ok {
+			fmt.Fprintf(out, "    class %s unmanaged\n", d.id(state))
+		}
+	}
+	fmt.Fprintln(out, "  end")
+}
+
+// WriteTable writes the transition table of the diagram, the actions
+// automation takes for a node in each state
+func (d *Diagram) WriteTable(out io.Writer) {
+	fmt.Fprintf(out, "target %s (goal %s)\n", d.Target, d.Goal)
+	for _, state := range d.Chart.States {
+		actions, ok := d.Table[state]
+		line := "-"
+		if ok {
+			line = strings.Join(ActionNames(actions), ", ")
+		}
+		if d.Counts != nil {
+			fmt.Fprintf(out, "  %-28s %-22s %d\n", state, line, d.Counts[state])
+		} else {
+			fmt.Fprintf(out, "  %-28s %s\n", state, line)
+		}
+	}
+	if unmanaged := d.Unmanaged(); unmanaged > 0 {
+		fmt.Fprintf(out, "  %-28s %-22s %d\n", "(not in chart)", "-", unmanaged)
+	}
+}
+
+// WriteDiagrams writes the diagrams in the given format, dot, mermaid or
+// table
+func WriteDiagrams(out io.Writer, diagrams []*Diagram, format string) error {
+	switch format {
+	case "dot":
+		fmt.Fprintln(out, "digraph lifecycle {")
+		fmt.Fprintln(out, "  rankdir=TB;")
+		fmt.Fprintln(out, "  node [shape=box, style=rounded];")
+		for _, d := range diagrams {
+			d.WriteDOT(out)
+		}
+		fmt.Fprintln(out, "}")
+	case "mermaid":
+		fmt.Fprintln(out, "flowchart TB")
+		for _, d := range diagrams {
+			d.WriteMermaid(out)
+		}
+		fmt.Fprintln(out, "  classDef unmanaged stroke:grey,color:grey")
+	case "table":
+		for i, d := range diagrams {
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			d.WriteTable(out)
+		}
+	default:
+		return fmt.Errorf("unsupported diagram format '%s', expected dot, mermaid or table", format)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testNodeFixture the nodes counted in the lifecycle diagrams
+const testNodeFixture = `[
+	{"Hostname": "new-a", "Status": "New"},
+	{"Hostname": "new-b", "Status": 0},
+	{"Hostname": "deployed", "Status": "Deployed"}
+]`
+
+func TestLifecycleDiagrams(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+
+	if _, err := server.LoadNodes(strings.NewReader(testNodeFixture)); err != nil {
+		t.Fatalf("unable to load nodes : %s", err)
+	}
+
+	charts, err := LoadCharts(map[string]string{})
+	if err != nil {
+		t.Fatalf("unable to load charts : %s", err)
+	}
+	saved := TransitionCharts
+	TransitionCharts = charts
+	defer func() { TransitionCharts = saved }()
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	cases := []struct {
+		args     []string
+		expected []string
+		missing  []string
+	}{
+		{
+			args: []string{"--target", "Deployed"},
+			expected: []string{
+				"digraph lifecycle {",
+				`Deployed_New -> Deployed_Commissioning [label="Commission", penwidth=2];`,
+				`Deployed_Commissioning -> Deployed_Ready [label="Wait", style=dashed, penwidth=2];`,
+				`Deployed_Deployed [label="Deployed", peripheries=2];`,
+				`Deployed__b_ [shape=diamond, label="b"];`,
+			},
+			missing: []string{"Ready_New"},
+		},
+		{
+			args: []string{"--format", "mermaid", "--counts"},
+			expected: []string{
+				"flowchart TB",
+				`Deployed_New["New (2)"]`,
+				`Deployed_Deployed(["Deployed (1)"])`,
+				"Deployed_Ready ==>|Aquire| Deployed_Allocated",
+				"Deployed_Commissioning -.-> Deployed_FailedCommissioning",
+				`Ready_New["New (0)"]`,
+				"class Deployed_Provisioning unmanaged",
+			},
+		},
+		{
+			args: []string{"--format", "table", "--target", "Released"},
+			expected: []string{
+				"target Released (goal Ready)",
+				"Deployed                     Reset, Release",
+				"Ready                        Done",
+			},
+		},
+	}
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		if status := lifecycleCommand(client, options, c.args, out); status != 0 {
+			t.Fatalf("%v: expected lifecycle to succeed, got status %d", c.args, status)
+		}
+		for _, expected := range c.expected {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("%v: expected output to contain '%s', got\n%s", c.args, expected, out)
+			}
+		}
+		for _, missing := range c.missing {
+			if strings.Contains(out.String(), missing) {
+				t.Errorf("%v: expected output not to contain '%s'", c.args, missing)
+			}
+		}
+	}
+
+	if status := lifecycleCommand(client, options, []string{"--format", "png"}, &bytes.Buffer{}); status != 2 {
+		t.Errorf("expected an unsupported format to fail, got status %d", status)
+	}
+}
+
+func TestLifecycleOffline(t *testing.T) {
+	for args, expected := range map[string]bool{
+		"--format table":                  true,
+		"--target Deployed --counts":      false,
+		"--counts --fixture nodes.json":   true,
+		"--fixture nodes.json --counts":   true,
+		"--format mermaid --target Ready": true,
+	} {
+		if offline := commandOffline(append([]string{"lifecycle"}, strings.Fields(args)...)); offline != expected {
+			t.Errorf("expected lifecycle %s to be offline %t, got %t", args, expected, offline)
+		}
+	}
+	if commandOffline([]string{"inventory"}) || commandOffline([]string{"unknown"}) {
+		t.Errorf("expected only the lifecycle to run offline")
+	}
+}
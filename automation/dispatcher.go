@@ -0,0 +1,139 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"sync"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// NodeWork the chain of actions to process for a node
+type NodeWork struct {
+	Client  *maas.MAASObject
+	Node    MaasNode
+	Actions []Action
+	Options ProcessingOptions
+}
+
+// Dispatcher processes the actions for nodes on a fixed number of workers.
+// Work is keyed by the system ID of the node, so that a node never has more
+// than one chain of actions queued or in flight.
+type Dispatcher struct {
+	WorkQueue  chan NodeWork
+	QuitChan   chan bool
+	NumWorkers int
+
+	mutex    sync.Mutex
+	inFlight map[string]bool
+}
+
+// NewDispatcher creates a dispatcher with the given number of workers
+func NewDispatcher(numWorkers int) *Dispatcher {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	return &Dispatcher{
+		WorkQueue:  make(chan NodeWork, 100),
+		QuitChan:   make(chan bool),
+		NumWorkers: numWorkers,
+		inFlight:   make(map[string]bool),
+	}
+}
+
+// Start starts the workers
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.NumWorkers; i++ {
+		log.Debugf("Starting worker%d", i+1)
+		go d.work(i + 1)
+	}
+}
+
+// Stop stops the workers once they complete their current work
+func (d *Dispatcher) Stop() {
+	go func() {
+		for i := 0; i < d.NumWorkers; i++ {
+			d.QuitChan <- true
+		}
+	}()
+}
+
+func (d *Dispatcher) work(id int) {
+	for {
+		select {
+		case work := <-d.WorkQueue:
+			log.Debugf("worker%d processing node '%s'", id, work.Node.Hostname())
+			ProcessActions(work.Actions, work.Client, work.Node, work.Options)
+			d.mutex.Lock()
+			delete(d.inFlight, work.Node.ID())
+			d.mutex.Unlock()
+		case <-d.QuitChan:
+			log.Infof("worker%d stopping", id)
+			return
+		}
+	}
+}
+
+// Dispatch queues the work for a node. If the node already has work queued or
+// in flight the work is dropped and false is returned.
+func (d *Dispatcher) Dispatch(work NodeWork) bool {
+	id := work.Node.ID()
+	d.mutex.Lock()
+	if d.inFlight[id] {
+		d.mutex.Unlock()
+		return false
+	}
+	d.inFlight[id] = true
+	d.mutex.Unlock()
+
+	d.WorkQueue <- work
+	return true
+}
+
+// InFlight returns true if the given node has work queued or in flight
+func (d *Dispatcher) InFlight(id string) bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.inFlight[id]
+}
+
+// MutationLimiter caps the number of concurrent MAAS calls that change the
+// state of nodes, i.e. commission and deploy. A nil limiter imposes no cap.
+type MutationLimiter chan bool
+
+// NewMutationLimiter creates a limiter allowing the given number of
+// concurrent calls, if the number is not positive no cap is imposed
+func NewMutationLimiter(max int) MutationLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(MutationLimiter, max)
+}
+
+// Acquire blocks until a call is allowed
+func (l MutationLimiter) Acquire() {
+	if l != nil {
+		l <- true
+	}
+}
+
+// Release signals the completion of a call
+func (l MutationLimiter) Release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+	maas "github.com/juju/gomaasapi"
+)
+
+// newDispatcherTest starts a fake MAAS with the given number of nodes and a
+// started dispatcher with as many workers
+func newDispatcherTest(t *testing.T, count int) (*maasfake.Server, *maas.MAASObject, []MaasNode, *Dispatcher) {
+	server, client := newTestServer(t, MaasAPIv1)
+	for i := 0; i < count; i++ {
+		server.AddNode(maasfake.Node{Hostname: fmt.Sprintf("node-%d", i), Status: maasfake.Ready})
+	}
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		server.Close()
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	dispatcher := NewDispatcher(count)
+	dispatcher.Start()
+	return server, client, nodes, dispatcher
+}
+
+// waitFor polls the condition until it holds, failing the test if it does
+// not within a second
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestDispatcherOneChainPerNode(t *testing.T) {
+	server, client, nodes, dispatcher := newDispatcherTest(t, 2)
+	defer server.Close()
+	defer dispatcher.Stop()
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+
+	release := make(chan bool)
+	blocking := func(*maas.MAASObject, MaasNode, ProcessingOptions) error {
+		<-release
+		return nil
+	}
+	node := nodes[0]
+	if !dispatcher.Dispatch(NodeWork{client, node, []Action{blocking}, options}) {
+		t.Fatalf("expected work for an idle node to be dispatched")
+	}
+	if dispatcher.Dispatch(NodeWork{client, node, []Action{blocking}, options}) {
+		t.Errorf("expected work for a node with work in flight to be refused")
+	}
+	if !dispatcher.InFlight(node.ID()) || dispatcher.InFlight(nodes[1].ID()) {
+		t.Errorf("expected only the dispatched node to be in flight")
+	}
+
+	close(release)
+	waitFor(t, "the actions of the node to complete", func() bool {
+		return !dispatcher.InFlight(node.ID())
+	})
+	if !dispatcher.Dispatch(NodeWork{client, node, []Action{blocking}, options}) {
+		t.Errorf("expected work to be dispatched once the previous work completed")
+	}
+	waitFor(t, "the actions of the node to complete", func() bool {
+		return !dispatcher.InFlight(node.ID())
+	})
+}
+
+func TestMutationLimiterCapsConcurrency(t *testing.T) {
+	server, client, nodes, dispatcher := newDispatcherTest(t, 5)
+	defer server.Close()
+	defer dispatcher.Stop()
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Mutations = NewMutationLimiter(2)
+
+	var mutex sync.Mutex
+	running, peak, done := 0, 0, 0
+	mutating := func(*maas.MAASObject, MaasNode, ProcessingOptions) error {
+		options.Mutations.Acquire()
+		defer options.Mutations.Release()
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		done++
+		mutex.Unlock()
+		return nil
+	}
+	for _, node := range nodes {
+		dispatcher.Dispatch(NodeWork{client, node, []Action{mutating}, options})
+	}
+	waitFor(t, "the actions of all nodes to complete", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return done == len(nodes)
+	})
+	if peak != 2 {
+		t.Errorf("expected at most 2 concurrent mutations, and that many to run, got %d", peak)
+	}
+	if NewMutationLimiter(0) != nil {
+		t.Errorf("expected no cap on mutations when the maximum is not positive")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// eventPageSize the number of events requested from MAAS at a time
+const eventPageSize = 100
+
+// EventWatcher follows the MAAS event log to find the nodes that have changed
+// since it was last polled
+type EventWatcher struct {
+	client  *maas.MAASObject
+	after   int
+	primed  bool
+	maxSize int
+}
+
+// NewEventWatcher returns a watcher of the event log of the given MAAS server
+func NewEventWatcher(client *maas.MAASObject) *EventWatcher {
+	return &EventWatcher{client: client, maxSize: eventPageSize}
+}
+
+// Prime positions the watcher after the latest event, so that only the
+// events that follow are reported
+func (w *EventWatcher) Prime() error {
+	events, err := w.query(url.Values{"limit": []string{"1"}})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.id > w.after {
+			w.after = event.id
+		}
+	}
+	w.primed = true
+	log.Debugf("Following MAAS events after event %d", w.after)
+	return nil
+}
+
+// Changed returns the IDs of the nodes for which there have been events
+// since it was last called, in the order they first changed
+func (w *EventWatcher) Changed() ([]string, error) {
+	if !w.primed {
+		return nil, w.Prime()
+	}
+
+	ids := []string{}
+	seen := make(map[string]bool)
+	for {
+		events, err := w.query(url.Values{
+			"after": []string{strconv.Itoa(w.after)},
+			"limit": []string{strconv.Itoa(w.maxSize)},
+		})
+		if err != nil {
+			return ids, err
+		}
+
+		// MAAS returns the newest events first
+		for i := len(events) - 1; i >= 0; i-- {
+			event := events[i]
+			if event.id > w.after {
+				w.after = event.id
+			}
+			if event.node != "" && !seen[event.node] {
+				seen[event.node] = true
+				ids = append(ids, event.node)
+			}
+		}
+		if len(events) < w.maxSize {
+			return ids, nil
+		}
+	}
+}
+
+// Watch polls the event log at the given interval and sends the IDs of the
+// nodes that changed on the returned channel
+func (w *EventWatcher) Watch(interval time.Duration) <-chan []string {
+	changes := make(chan []string)
+	go func() {
+		if err := w.Prime(); err != nil {
+			log.Warnf("Unable to query MAAS events : %s", err)
+		}
+		for {
+			time.Sleep(interval)
+			ids, err := w.Changed()
+			if err != nil {
+				log.Warnf("Unable to query MAAS events : %s", err)
+			}
+			if len(ids) > 0 {
+				changes <- ids
+			}
+		}
+	}()
+	return changes
+}
+
+type maasEvent struct {
+	id   int
+	node string
+}
+
+// query fetches a page of events from MAAS
+func (w *EventWatcher) query(params url.Values) ([]maasEvent, error) {
+	result, err := w.client.GetSubObject("events").CallGet("query", params)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := result.GetMap()
+	if err != nil {
+		return nil, err
+	}
+	list, err := obj["events"].GetArray()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]maasEvent, 0, len(list))
+	for _, item := range list {
+		event, err := item.GetMap()
+		if err != nil {
+			return nil, err
+		}
+		id, err := event["id"].GetFloat64()
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, maasEvent{id: int(id), node: jsonString(event, "node")})
+	}
+	return events, nil
+}
+
+// ProcessChanged fetches the nodes with the given IDs from MAAS and processes
+// them, as ProcessAll does for all the nodes
+func ProcessChanged(client *maas.MAASObject, ids []string, options ProcessingOptions) []error {
+	errors := make([]error, len(ids))
+	nodes := make([]MaasNode, len(ids))
+	fetched := []MaasNode{}
+	for i, id := range ids {
+		nodes[i], errors[i] = fetchNode(client, options.API, id)
+		if errors[i] == nil {
+			fetched = append(fetched, nodes[i])
+		}
+	}
+	options.Campaigns.Progress(client, fetched, options)
+
+	for i, node := range nodes {
+		if errors[i] != nil {
+			continue
+		}
+		log.Debugf("processing node '%s' as MAAS reported it changed", node.Hostname())
+		errors[i] = processFiltered(client, node, options)
+	}
+	return errors
+}
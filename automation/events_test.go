@@ -0,0 +1,104 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestEventWatcherReportsChangedNodes(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv2)
+	defer server.Close()
+	server.AddEvent("a", "Node powered on", "")
+
+	watcher := NewEventWatcher(client)
+	watcher.maxSize = 2
+	ids, err := watcher.Changed()
+	if err != nil {
+		t.Fatalf("unable to prime event watcher : %s", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected events before the watcher was primed to be ignored, got %v", ids)
+	}
+
+	// More events than fit on a page, some for the same node
+	for _, id := range []string{"b", "a", "b", "", "c"} {
+		server.AddEvent(id, "Node changed status", "")
+	}
+	ids, err = watcher.Changed()
+	if err != nil {
+		t.Fatalf("unable to query events : %s", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"b", "a", "c"}) {
+		t.Errorf("expected changed nodes [b a c], got %v", ids)
+	}
+
+	ids, err = watcher.Changed()
+	if err != nil {
+		t.Fatalf("unable to query events : %s", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected no changed nodes, got %v", ids)
+	}
+}
+
+func TestProcessChangedOnlyProcessesGivenNodes(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	changed := server.AddNode(maasfake.Node{
+		Hostname:   "node-a",
+		Status:     maasfake.Ready,
+		Interfaces: []maasfake.Interface{testInterface("dhcp")},
+	})
+	unchanged := server.AddNode(maasfake.Node{
+		Hostname:   "node-b",
+		Status:     maasfake.Ready,
+		Interfaces: []maasfake.Interface{testInterface("dhcp")},
+	})
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+
+	watcher := NewEventWatcher(client)
+	if err := watcher.Prime(); err != nil {
+		t.Fatalf("unable to prime event watcher : %s", err)
+	}
+	server.AddEvent(changed, "Node changed status", "")
+	ids, err := watcher.Changed()
+	if err != nil {
+		t.Fatalf("unable to query events : %s", err)
+	}
+	for _, err := range ProcessChanged(client, ids, options) {
+		if err != nil {
+			t.Errorf("unable to process changed node : %s", err)
+		}
+	}
+
+	if node, _ := server.Node(changed); node.Status == maasfake.Ready {
+		t.Errorf("expected changed node to be processed")
+	}
+	if node, _ := server.Node(unchanged); node.Status != maasfake.Ready {
+		t.Errorf("expected unchanged node not to be processed, got status %d", node.Status)
+	}
+
+	// The actions taken on the node are themselves reported as events
+	ids, err = watcher.Changed()
+	if err != nil {
+		t.Fatalf("unable to query events : %s", err)
+	}
+	if !reflect.DeepEqual(ids, []string{changed}) {
+		t.Errorf("expected actions on node '%s' to be reported, got %v", changed, ids)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build fakemaas
+// +build fakemaas
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gerrit.opencord.org/maas/maasfake"
+	maas "github.com/juju/gomaasapi"
+)
+
+// fakeMAAS starts an in-process fake MAAS with the nodes of the given fixture
+// file and returns a client for it, along with a function that stops the
+// fake. The fake is only built in with the fakemaas build tag, as the image of
+// automation is built from this directory alone.
+func fakeMAAS(file string, api *MaasAPI) (*maas.MAASObject, func(), error) {
+	fixture, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open node fixture '%s' : %s", file, err)
+	}
+	defer fixture.Close()
+
+	server := maasfake.NewServer()
+	if _, err := server.LoadNodes(fixture); err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("unable to load nodes from fixture '%s' : %s", file, err)
+	}
+	auth, err := maas.NewAuthenticatedClient(server.URL(), maasfake.APIKey, api.Version)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return maas.NewMAAS(*auth), server.Close, nil
+}
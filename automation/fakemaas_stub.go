@@ -0,0 +1,30 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !fakemaas
+// +build !fakemaas
+
+package main
+
+import (
+	"fmt"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// fakeMAAS is not available unless automation is built with the fakemaas
+// build tag, see fakemaas.go
+func fakeMAAS(file string, api *MaasAPI) (*maas.MAASObject, func(), error) {
+	return nil, nil, fmt.Errorf("counting the nodes of a fixture requires automation built with '-tags fakemaas'")
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build fakemaas
+// +build fakemaas
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLifecycleFixtureCounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatalf("unable to create directory : %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := filepath.Join(dir, "nodes.json")
+	if err := ioutil.WriteFile(fixture, []byte(testNodeFixture), 0644); err != nil {
+		t.Fatalf("unable to write fixture : %s", err)
+	}
+
+	charts, err := LoadCharts(map[string]string{})
+	if err != nil {
+		t.Fatalf("unable to load charts : %s", err)
+	}
+	saved := TransitionCharts
+	TransitionCharts = charts
+	defer func() { TransitionCharts = saved }()
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	out := &bytes.Buffer{}
+	args := []string{"--format", "table", "--target", "Deployed", "--fixture", fixture}
+	if status := lifecycleCommand(nil, options, args, out); status != 0 {
+		t.Fatalf("expected lifecycle to succeed, got status %d", status)
+	}
+	for _, expected := range []string{
+		"New                          Reset, Commission      2",
+		"Deployed                     Provision, Done        1",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected output to contain '%s', got\n%s", expected, out)
+		}
+	}
+
+	if status := lifecycleCommand(nil, options, []string{"--fixture", filepath.Join(dir, "missing.json")}, out); status != 1 {
+		t.Errorf("expected a missing fixture to fail, got status %d", status)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MatchList regular expressions that include or exclude a node by one of its
+// attributes. A node is excluded if any value of the attribute matches an
+// exclude expression, otherwise it is included if any value matches an
+// include expression.
+type MatchList struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// compile compiles the regular expressions of the list
+func (m *MatchList) compile(name string) error {
+	var err error
+	if m.include, err = compilePatterns(m.Include); err != nil {
+		return fmt.Errorf("invalid %s include expression : %s", name, err)
+	}
+	if m.exclude, err = compilePatterns(m.Exclude); err != nil {
+		return fmt.Errorf("invalid %s exclude expression : %s", name, err)
+	}
+	return nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = r
+	}
+	return result, nil
+}
+
+// reason returns why a node with the given values of the named attribute is
+// not matched, or the empty string if it is. emptyIncludes determines if an
+// empty include list includes all nodes or none.
+func (m *MatchList) reason(name string, values []string, emptyIncludes bool) string {
+	for i, r := range m.exclude {
+		for _, value := range values {
+			if r.MatchString(value) {
+				return fmt.Sprintf("%s '%s' matches exclude '%s'", name, value, m.Exclude[i])
+			}
+		}
+	}
+	if len(m.include) == 0 {
+		if emptyIncludes {
+			return ""
+		}
+		return fmt.Sprintf("no %s included", name)
+	}
+	for _, r := range m.include {
+		for _, value := range values {
+			if r.MatchString(value) {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("%s '%s' not included by %v", name, strings.Join(values, ","), m.Include)
+}
+
+// HostFilter determines the nodes on which automation acts. A node must be
+// matched by each of the attribute lists, as well as by all of the filters
+// in All, by at least one of the filters in Any, if any are given, and must
+// not be matched by Not.
+type HostFilter struct {
+	Zones         MatchList `json:"zones,omitempty"`
+	Hosts         MatchList `json:"hosts,omitempty"`
+	Tags          MatchList `json:"tags,omitempty"`
+	Pools         MatchList `json:"pools,omitempty"`
+	Architectures MatchList `json:"architectures,omitempty"`
+	PowerTypes    MatchList `json:"power_types,omitempty"`
+	Statuses      MatchList `json:"statuses,omitempty"`
+
+	All []*HostFilter `json:"all,omitempty"`
+	Any []*HostFilter `json:"any,omitempty"`
+	Not *HostFilter   `json:"not,omitempty"`
+}
+
+// Compile compiles the regular expressions of the filter, it must be called
+// before the filter is used
+func (f *HostFilter) Compile() error {
+	lists := []struct {
+		name string
+		list *MatchList
+	}{
+		{"zone", &f.Zones},
+		{"host", &f.Hosts},
+		{"tag", &f.Tags},
+		{"pool", &f.Pools},
+		{"architecture", &f.Architectures},
+		{"power type", &f.PowerTypes},
+		{"status", &f.Statuses},
+	}
+	for _, l := range lists {
+		if err := l.list.compile(l.name); err != nil {
+			return err
+		}
+	}
+	for _, sub := range append(append([]*HostFilter{}, f.All...), f.Any...) {
+		if err := sub.Compile(); err != nil {
+			return err
+		}
+	}
+	if f.Not != nil {
+		return f.Not.Compile()
+	}
+	return nil
+}
+
+// Excludes returns the rule that excludes the given node, in its current
+// status, from automation, or the empty string if the node is automated. As
+// documented for the original filter, an empty zone include list includes no
+// nodes.
+func (f *HostFilter) Excludes(node MaasNode, status string) string {
+	return f.excludes(node, status, false)
+}
+
+func (f *HostFilter) excludes(node MaasNode, status string, nested bool) string {
+	tags := node.Tags()
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	checks := []struct {
+		name          string
+		list          *MatchList
+		values        []string
+		emptyIncludes bool
+	}{
+		{"host", &f.Hosts, []string{node.Hostname()}, true},
+		{"zone", &f.Zones, []string{node.Zone()}, nested},
+		{"tag", &f.Tags, tags, true},
+		{"pool", &f.Pools, []string{node.Pool()}, true},
+		{"architecture", &f.Architectures, []string{node.Architecture()}, true},
+		{"power type", &f.PowerTypes, []string{node.PowerType()}, true},
+		{"status", &f.Statuses, []string{status}, true},
+	}
+	for _, c := range checks {
+		if reason := c.list.reason(c.name, c.values, c.emptyIncludes); reason != "" {
+			return reason
+		}
+	}
+
+	for i, sub := range f.All {
+		if reason := sub.excludes(node, status, true); reason != "" {
+			return fmt.Sprintf("all[%d]: %s", i, reason)
+		}
+	}
+	if len(f.Any) > 0 {
+		reasons := make([]string, len(f.Any))
+		matched := false
+		for i, sub := range f.Any {
+			reasons[i] = sub.excludes(node, status, true)
+			if reasons[i] == "" {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Sprintf("any: none matched (%s)", strings.Join(reasons, "; "))
+		}
+	}
+	if f.Not != nil && f.Not.excludes(node, status, true) == "" {
+		return "not: matched"
+	}
+	return ""
+}
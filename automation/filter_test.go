@@ -0,0 +1,130 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestHostFilter(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv2)
+	defer server.Close()
+	server.AddNode(maasfake.Node{SystemID: "a", Hostname: "compute-1", Status: maasfake.New})
+	server.AddNode(maasfake.Node{SystemID: "b", Hostname: "compute-2", Status: maasfake.Ready, Tags: []string{"lab-owned"}})
+	server.AddNode(maasfake.Node{SystemID: "c", Hostname: "compute-3", Status: maasfake.Deployed, Zone: "lab"})
+	server.AddNode(maasfake.Node{SystemID: "d", Hostname: "storage-1", Status: maasfake.New, PowerType: "ipmi", Pool: "storage"})
+	server.AddNode(maasfake.Node{SystemID: "e", Hostname: "arm-1", Status: maasfake.New, Architecture: "arm64/generic"})
+
+	nodes, err := fetchNodes(client, MaasAPIv2)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+
+	cases := []struct {
+		name     string
+		spec     string
+		included []string
+	}{
+		{
+			name:     "default zone",
+			spec:     `{"zones":{"include":["default"]}}`,
+			included: []string{"a", "b", "d", "e"},
+		},
+		{
+			name:     "empty zone include includes nothing",
+			spec:     `{"hosts":{"include":[".*"]}}`,
+			included: []string{},
+		},
+		{
+			name:     "excluded hosts",
+			spec:     `{"zones":{"include":[".*"]},"hosts":{"exclude":["^compute-[12]$"]}}`,
+			included: []string{"c", "d", "e"},
+		},
+		{
+			name:     "excluded tag",
+			spec:     `{"zones":{"include":["default"]},"tags":{"exclude":["^lab-owned$"]}}`,
+			included: []string{"a", "d", "e"},
+		},
+		{
+			name:     "architecture, power type and status",
+			spec:     `{"zones":{"include":[".*"]},"architectures":{"include":["^amd64/"]},"power_types":{"exclude":["ipmi"]},"statuses":{"include":["New","Ready"]}}`,
+			included: []string{"a", "b"},
+		},
+		{
+			name:     "pool",
+			spec:     `{"zones":{"include":[".*"]},"pools":{"include":["^storage$"]}}`,
+			included: []string{"d"},
+		},
+		{
+			name:     "any of hosts or tags, but not the lab zone",
+			spec:     `{"zones":{"include":[".*"]},"any":[{"hosts":{"include":["^compute-"]}},{"tags":{"include":["lab"]}}],"not":{"zones":{"include":["lab"]}}}`,
+			included: []string{"a", "b"},
+		},
+		{
+			name:     "all of",
+			spec:     `{"zones":{"include":[".*"]},"all":[{"statuses":{"include":["New"]}},{"hosts":{"exclude":["^arm"]}}]}`,
+			included: []string{"a", "d"},
+		},
+	}
+
+	for _, c := range cases {
+		var filter HostFilter
+		if err := json.Unmarshal([]byte(c.spec), &filter); err != nil {
+			t.Fatalf("%s: unable to parse filter : %s", c.name, err)
+		}
+		if err := filter.Compile(); err != nil {
+			t.Fatalf("%s: unable to compile filter : %s", c.name, err)
+		}
+		included := []string{}
+		for _, node := range nodes {
+			status, _ := node.Status()
+			reason := filter.Excludes(node, status.String())
+			if reason == "" {
+				included = append(included, node.ID())
+			}
+		}
+		if !reflect.DeepEqual(included, c.included) {
+			t.Errorf("%s: expected %v to be included, got %v", c.name, c.included, included)
+		}
+	}
+}
+
+func TestHostFilterReportsRule(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	server.AddNode(maasfake.Node{SystemID: "a", Hostname: "compute-1", Tags: []string{"lab-owned"}})
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Filter.Tags.Exclude = []string{"^lab-"}
+	if err := options.Filter.Compile(); err != nil {
+		t.Fatalf("invalid host filter : %s", err)
+	}
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	ProcessAll(client, nodes, options)
+
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("expected no calls for an excluded node, got %v", calls)
+	}
+	state := options.Tracker.Get("a")
+	if state == nil || state.Excluded != "tag 'lab-owned' matches exclude '^lab-'" {
+		t.Errorf("expected node to be reported as excluded by its tag, got %+v", state)
+	}
+}
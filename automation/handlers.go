@@ -0,0 +1,342 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// router routes the REST requests to their handlers
+func (c *AppContext) router() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/node/", c.ListNodesHandler).Methods("GET")
+	router.HandleFunc("/node/{nodeid}", c.GetNodeHandler).Methods("GET")
+	router.HandleFunc("/node/{nodeid}/plan", c.PlanHandler).Methods("GET")
+	router.HandleFunc("/node/{nodeid}/reconcile", c.authorized(c.ReconcileNodeHandler)).Methods("POST")
+	router.HandleFunc("/node/{nodeid}/pause", c.authorized(c.PauseHandler)).Methods("POST")
+	router.HandleFunc("/node/{nodeid}/resume", c.authorized(c.ResumeHandler)).Methods("POST")
+	router.HandleFunc("/reconcile/", c.authorized(c.ReconcileAllHandler)).Methods("POST")
+	router.HandleFunc("/leader/", c.LeaderHandler).Methods("GET")
+	router.HandleFunc("/inventory/", c.InventoryHandler).Methods("GET")
+	router.HandleFunc("/audit/", c.AuditHandler).Methods("GET")
+	router.HandleFunc("/campaign/", c.ListCampaignsHandler).Methods("GET")
+	router.HandleFunc("/campaign/", c.authorized(c.StartCampaignHandler)).Methods("POST")
+	router.HandleFunc("/campaign/{name}", c.GetCampaignHandler).Methods("GET")
+	router.HandleFunc("/campaign/{name}/resume", c.authorized(c.ResumeCampaignHandler)).Methods("POST")
+	router.HandleFunc("/campaign/{name}/cancel", c.authorized(c.CancelCampaignHandler)).Methods("POST")
+	return router
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+// authorized wraps a handler of requests that change nodes or campaigns, so
+// that they are refused unless they carry the configured API token
+func (c *AppContext) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.config.APIToken != "" {
+			expected := "Bearer " + c.config.APIToken
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				http.Error(w, "Missing or invalid API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// withProvisioning augments the node state with its provisioning record, if
+// a provisioner is configured
+func (c *AppContext) withProvisioning(state *NodeState) {
+	if c.options.ProvisionURL == "" {
+		return
+	}
+	record, err := c.options.Provisioner.Get(state.ID)
+	if err != nil {
+		log.Warnf("Unable to retrieve provisioning state of node '%s' : %s", state.Hostname, err)
+		return
+	}
+	state.Provision = record
+}
+
+func (c *AppContext) ListNodesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info("Request received for node list")
+	list := c.options.Tracker.List()
+	for i := range list {
+		list[i].InFlight = c.options.Dispatcher.InFlight(list[i].ID)
+		c.withProvisioning(&list[i])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (c *AppContext) GetNodeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["nodeid"]
+	state := c.options.Tracker.Get(id)
+	if state == nil {
+		http.Error(w, fmt.Sprintf("Unknown node '%s'", id), http.StatusNotFound)
+		return
+	}
+	state.InFlight = c.options.Dispatcher.InFlight(id)
+	c.withProvisioning(state)
+	writeJSON(w, http.StatusOK, state)
+}
+
+func (c *AppContext) PlanHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["nodeid"]
+	node, err := fetchNode(c.client, c.options.API, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	status, err := node.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The node is planned as it would be processed, but without clearing
+	// what it is held back for
+	options := c.options
+	options.Preview = true
+	plan := NodePlan{
+		ID:       node.ID(),
+		Hostname: node.Hostname(),
+		Status:   status.String(),
+		Actions:  []string{},
+	}
+	if reason := options.Filter.Excludes(node, plan.Status); reason != "" {
+		plan.Target = options.Targets.Target(node)
+		plan.Skipped = "excluded, " + reason
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+	plan.Target, plan.Skipped = resolveNode(node, options)
+	if plan.Skipped != "" {
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+	actions, err := findActions(plan.Target, plan.Status)
+	if err != nil {
+		plan.Error = err.Error()
+	} else {
+		plan.Actions = ActionNames(actions)
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// standby refuses a request to process nodes if this replica is not the
+// leader, returning true if it did
+func (c *AppContext) standby(w http.ResponseWriter) bool {
+	if c.options.Leader.IsLeader() {
+		return false
+	}
+	leader, _ := c.options.Leader.Leader()
+	http.Error(w, fmt.Sprintf("Nodes are processed by the leader '%s'", leader), http.StatusServiceUnavailable)
+	return true
+}
+
+func (c *AppContext) ReconcileNodeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["nodeid"]
+	if c.standby(w) {
+		return
+	}
+	if c.options.Tracker.Paused(id) {
+		http.Error(w, fmt.Sprintf("Automation of node '%s' is paused", id), http.StatusConflict)
+		return
+	}
+	node, err := fetchNode(c.client, c.options.API, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	nodeStatus, err := node.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason := c.options.Filter.Excludes(node, nodeStatus.String()); reason != "" {
+		http.Error(w, fmt.Sprintf("Node '%s' is excluded by the host filter : %s", id, reason), http.StatusConflict)
+		return
+	}
+	log.Infof("Reconcile of node '%s' requested", node.Hostname())
+	if err := ProcessNode(c.client, node, c.options); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *AppContext) ReconcileAllHandler(w http.ResponseWriter, r *http.Request) {
+	if c.standby(w) {
+		return
+	}
+	log.Info("Reconcile of all nodes requested")
+	select {
+	case c.reconcile <- true:
+	default:
+		// A reconcile is already pending
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *AppContext) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["nodeid"]
+	log.Infof("Pausing automation of node '%s'", id)
+	c.options.Tracker.SetPaused(id, true)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *AppContext) ResumeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["nodeid"]
+	log.Infof("Resuming automation of node '%s'", id)
+	c.options.Tracker.SetPaused(id, false)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *AppContext) LeaderHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.options.Leader.Status())
+}
+
+func (c *AppContext) InventoryHandler(w http.ResponseWriter, r *http.Request) {
+	inventory, err := fetchInventory(c.client, c.options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if host := r.URL.Query().Get("host"); host != "" {
+		vars, ok := inventory.HostVars[host]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown host '%s'", host), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, vars)
+		return
+	}
+	writeJSON(w, http.StatusOK, inventory)
+}
+
+func (c *AppContext) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query := AuditQuery{
+		Node:   values.Get("node"),
+		Action: values.Get("action"),
+	}
+	var err error
+	if query.Since, err = parseSince(values.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid limit '%s'", limit), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := c.options.Audit.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (c *AppContext) ListCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.options.Campaigns.List())
+}
+
+func (c *AppContext) StartCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if c.standby(w) {
+		return
+	}
+	var spec CampaignSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes, err := fetchNodes(c.client, c.options.API)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	campaign, err := c.options.Campaigns.Start(spec, nodes)
+	if err != nil {
+		c.campaignError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, campaign)
+}
+
+func (c *AppContext) GetCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	campaign := c.options.Campaigns.Get(name)
+	if campaign == nil {
+		http.Error(w, fmt.Sprintf("Unknown campaign '%s'", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, campaign)
+}
+
+func (c *AppContext) ResumeCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if c.standby(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if c.options.Campaigns.Get(name) == nil {
+		http.Error(w, fmt.Sprintf("Unknown campaign '%s'", name), http.StatusNotFound)
+		return
+	}
+	if err := c.options.Campaigns.Resume(name); err != nil {
+		c.campaignError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *AppContext) CancelCampaignHandler(w http.ResponseWriter, r *http.Request) {
+	if c.standby(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if c.options.Campaigns.Get(name) == nil {
+		http.Error(w, fmt.Sprintf("Unknown campaign '%s'", name), http.StatusNotFound)
+		return
+	}
+	if err := c.options.Campaigns.Cancel(name); err != nil {
+		c.campaignError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// campaignError reports a campaign request that could not be carried out
+func (c *AppContext) campaignError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*CampaignConflictError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,177 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+// newHandlerTest starts a fake MAAS with a node to be automated and one that
+// the host filter excludes, and the REST API of automation over it
+func newHandlerTest(t *testing.T) (*maasfake.Server, *AppContext, *httptest.Server) {
+	server, client := newTestServer(t, MaasAPIv1)
+	server.AddNode(maasfake.Node{SystemID: "ready", Hostname: "ready", Status: maasfake.Ready})
+	server.AddNode(maasfake.Node{SystemID: "lab", Hostname: "lab", Status: maasfake.Ready, Zone: "lab"})
+	context := &AppContext{
+		client:    client,
+		options:   newTestOptions(MaasAPIv1, newTestProvisioner()),
+		reconcile: make(chan bool, 1),
+	}
+	return server, context, httptest.NewServer(context.router())
+}
+
+// request makes a request of the REST API, returning the status and body of
+// the response
+func request(t *testing.T, api *httptest.Server, method string, path string) (int, string) {
+	req, err := http.NewRequest(method, api.URL+path, nil)
+	if err != nil {
+		t.Fatalf("unable to create request : %s", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to %s '%s' : %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response of '%s' : %s", path, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestPauseAndResumeHandlers(t *testing.T) {
+	server, context, api := newHandlerTest(t)
+	defer server.Close()
+	defer api.Close()
+
+	if status, _ := request(t, api, "POST", "/node/ready/pause"); status != http.StatusOK {
+		t.Fatalf("expected pause to succeed, got status %d", status)
+	}
+	if !context.options.Tracker.Paused("ready") {
+		t.Errorf("expected node to be paused")
+	}
+	status, body := request(t, api, "GET", "/node/ready/plan")
+	var plan NodePlan
+	if err := json.Unmarshal([]byte(body), &plan); err != nil || status != http.StatusOK {
+		t.Fatalf("unable to get the plan of the node, status %d : %s", status, body)
+	}
+	if plan.Skipped != "paused" || len(plan.Actions) != 0 {
+		t.Errorf("expected the paused node to be skipped, got %+v", plan)
+	}
+	if status, _ := request(t, api, "POST", "/node/ready/reconcile"); status != http.StatusConflict {
+		t.Errorf("expected reconcile of a paused node to conflict, got status %d", status)
+	}
+
+	if status, _ := request(t, api, "POST", "/node/ready/resume"); status != http.StatusOK {
+		t.Fatalf("expected resume to succeed, got status %d", status)
+	}
+	if context.options.Tracker.Paused("ready") {
+		t.Errorf("expected node to be resumed")
+	}
+	_, body = request(t, api, "GET", "/node/ready/plan")
+	plan = NodePlan{}
+	if err := json.Unmarshal([]byte(body), &plan); err != nil {
+		t.Fatalf("unable to parse plan '%s' : %s", body, err)
+	}
+	if plan.Skipped != "" || plan.Target != "Deployed" || len(plan.Actions) == 0 {
+		t.Errorf("expected the resumed node to be moved toward deployment, got %+v", plan)
+	}
+}
+
+func TestReconcileHandlers(t *testing.T) {
+	server, context, api := newHandlerTest(t)
+	defer server.Close()
+	defer api.Close()
+
+	if status, body := request(t, api, "POST", "/node/lab/reconcile"); status != http.StatusConflict ||
+		!strings.Contains(body, "excluded by the host filter") {
+		t.Errorf("expected reconcile of an excluded node to conflict, got status %d : %s", status, body)
+	}
+	if status, _ := request(t, api, "POST", "/node/missing/reconcile"); status != http.StatusNotFound {
+		t.Errorf("expected reconcile of an unknown node to not be found, got status %d", status)
+	}
+	if status, _ := request(t, api, "POST", "/node/ready/reconcile"); status != http.StatusAccepted {
+		t.Errorf("expected reconcile of the node to be accepted, got status %d", status)
+	}
+	if node, _ := server.Node("ready"); node.Status == maasfake.Ready {
+		t.Errorf("expected the reconciled node to be acquired")
+	}
+
+	status, body := request(t, api, "GET", "/node/")
+	var nodes []NodeState
+	if err := json.Unmarshal([]byte(body), &nodes); err != nil || status != http.StatusOK {
+		t.Fatalf("unable to list nodes, status %d : %s", status, body)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "ready" {
+		t.Errorf("expected the reconciled node to be listed, got %+v", nodes)
+	}
+
+	if status, _ := request(t, api, "POST", "/reconcile/"); status != http.StatusAccepted || len(context.reconcile) != 1 {
+		t.Errorf("expected reconcile of all nodes to be requested, got status %d", status)
+	}
+}
+
+func TestStandbyHandlers(t *testing.T) {
+	server, context, api := newHandlerTest(t)
+	defer server.Close()
+	defer api.Close()
+	agent, _ := newTestConsul()
+	defer agent.Close()
+	var err error
+	context.options.Leader, err = NewLeaderElector("consul://"+strings.TrimPrefix(agent.URL, "http://"),
+		"cord/automation/leader", "standby", time.Minute)
+	if err != nil {
+		t.Fatalf("unable to create leader elector : %s", err)
+	}
+
+	for _, path := range []string{"/node/ready/reconcile", "/reconcile/", "/campaign/"} {
+		if status, _ := request(t, api, "POST", path); status != http.StatusServiceUnavailable {
+			t.Errorf("expected '%s' to be refused by a standby replica, got status %d", path, status)
+		}
+	}
+	if status, _ := request(t, api, "POST", "/node/ready/pause"); status != http.StatusOK {
+		t.Errorf("expected a standby replica to pause a node, got status %d", status)
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	context := &AppContext{config: Config{APIToken: "secret"}}
+	handler := context.authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	for header, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusAccepted,
+	} {
+		request := httptest.NewRequest("POST", "/reconcile/", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != expected {
+			t.Errorf("expected status %d with authorization '%s', got %d", expected, header, recorder.Code)
+		}
+	}
+}
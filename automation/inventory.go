@@ -0,0 +1,139 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// InventoryGroup a group of hosts in an Ansible inventory
+type InventoryGroup struct {
+	Hosts []string `json:"hosts"`
+}
+
+// HostVars the variables of a host in an Ansible inventory
+type HostVars struct {
+	AnsibleHost     string   `json:"ansible_host,omitempty"`
+	ID              string   `json:"maas_id"`
+	Zone            string   `json:"maas_zone"`
+	Tags            []string `json:"maas_tags"`
+	IPs             []string `json:"ips"`
+	MACs            []string `json:"macs"`
+	PowerType       string   `json:"power_type"`
+	Role            string   `json:"provision_role,omitempty"`
+	ProvisionStatus string   `json:"provision_status,omitempty"`
+}
+
+// Inventory an Ansible dynamic inventory, as returned by an inventory script
+// invoked with --list. Groups are keyed by name alongside the "_meta" key
+// that holds the variables of every host.
+type Inventory struct {
+	Groups   map[string]*InventoryGroup
+	HostVars map[string]*HostVars
+}
+
+// MarshalJSON returns the inventory in the form Ansible expects
+func (i *Inventory) MarshalJSON() ([]byte, error) {
+	result := make(map[string]interface{}, len(i.Groups)+1)
+	for name, group := range i.Groups {
+		result[name] = group
+	}
+	result["_meta"] = map[string]interface{}{"hostvars": i.HostVars}
+	return json.Marshal(result)
+}
+
+// invalidGroupChars the characters Ansible does not allow in a group name
+var invalidGroupChars = regexp.MustCompile("[^A-Za-z0-9_]")
+
+// add adds a host to the group of the given kind and name
+func (i *Inventory) add(kind string, name string, host string) {
+	if name == "" {
+		return
+	}
+	group := kind + "_" + invalidGroupChars.ReplaceAllString(name, "_")
+	if _, ok := i.Groups[group]; !ok {
+		i.Groups[group] = &InventoryGroup{Hosts: []string{}}
+	}
+	i.Groups[group].Hosts = append(i.Groups[group].Hosts, host)
+}
+
+// BuildInventory builds an Ansible inventory of the deployed nodes, grouped
+// by zone, MAAS tag and provisioner role. The provisioner role is the one
+// the provisioner reports it provisioned the node with or, failing that,
+// the one automation would request.
+func BuildInventory(nodes []MaasNode, options ProcessingOptions) *Inventory {
+	inventory := &Inventory{
+		Groups:   make(map[string]*InventoryGroup),
+		HostVars: make(map[string]*HostVars),
+	}
+
+	for _, node := range nodes {
+		status, err := node.Status()
+		if err != nil || status != Deployed {
+			continue
+		}
+		host := node.Hostname()
+		vars := &HostVars{
+			ID:        node.ID(),
+			Zone:      node.Zone(),
+			Tags:      node.Tags(),
+			IPs:       node.IPs(),
+			MACs:      node.MACs(),
+			PowerType: node.PowerType(),
+		}
+		if len(vars.IPs) > 0 {
+			vars.AnsibleHost = vars.IPs[0]
+		}
+
+		var request ProvisionRequest
+		options.Provisioning.Apply(node, options.Roles.Role(node), &request)
+		vars.Role = request.Role
+		if options.ProvisionURL != "" {
+			record, err := options.Provisioner.Get(node.ID())
+			if err != nil {
+				log.Warnf("Unable to retrieve provisioning state of node '%s' : %s", host, err)
+			} else if record != nil {
+				vars.ProvisionStatus = record.Status.String()
+				if record.Request != nil && record.Request.Role != "" {
+					vars.Role = record.Request.Role
+				}
+			}
+		}
+		inventory.HostVars[host] = vars
+
+		inventory.add("zone", vars.Zone, host)
+		for _, tag := range vars.Tags {
+			inventory.add("tag", tag, host)
+		}
+		inventory.add("role", vars.Role, host)
+	}
+
+	for _, group := range inventory.Groups {
+		sort.Strings(group.Hosts)
+	}
+	return inventory
+}
+
+// fetchInventory builds an Ansible inventory of the nodes currently in MAAS
+func fetchInventory(client *maas.MAASObject, options ProcessingOptions) (*Inventory, error) {
+	nodes, err := fetchNodes(client, options.API)
+	if err != nil {
+		return nil, err
+	}
+	return BuildInventory(nodes, options), nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestInventory(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	computeID := server.AddNode(maasfake.Node{
+		Hostname:   "compute-1.cord.lab",
+		Status:     maasfake.Deployed,
+		Zone:       "rack-1",
+		Tags:       []string{"ssd"},
+		PowerType:  "ipmi",
+		Interfaces: []maasfake.Interface{testInterface("dhcp")},
+	})
+	server.AddNode(maasfake.Node{
+		Hostname: "storage-1.cord.lab",
+		Status:   maasfake.Deployed,
+		Zone:     "rack-1",
+		Tags:     []string{"ceph"},
+	})
+	server.AddNode(maasfake.Node{
+		Hostname: "spare-1.cord.lab",
+		Status:   maasfake.Ready,
+		Zone:     "rack-1",
+	})
+
+	provisioner := newTestProvisioner()
+	provisioner.records[computeID] = &ProvisionRecord{
+		Status:  Complete,
+		Request: &ProvisionWork{Role: "compute-node"},
+	}
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+	options.Provisioning = &ProvisionSelector{
+		Profiles: map[string]*ProvisionProfile{"storage": {Role: "storage-node"}},
+		Tags:     map[string]string{"ceph": "storage"},
+	}
+
+	var out bytes.Buffer
+	if status := inventoryCommand(client, options, []string{"--list"}, &out); status != 0 {
+		t.Fatalf("inventory command failed with status %d", status)
+	}
+	var inventory map[string]json.RawMessage
+	if err := json.Unmarshal(out.Bytes(), &inventory); err != nil {
+		t.Fatalf("unable to parse inventory '%s' : %s", out.String(), err)
+	}
+
+	groups := map[string][]string{}
+	for name, raw := range inventory {
+		if name == "_meta" {
+			continue
+		}
+		var group InventoryGroup
+		if err := json.Unmarshal(raw, &group); err != nil {
+			t.Fatalf("unable to parse group '%s' : %s", name, err)
+		}
+		groups[name] = group.Hosts
+	}
+	expected := map[string][]string{
+		"zone_rack_1":       {"compute-1.cord.lab", "storage-1.cord.lab"},
+		"tag_ssd":           {"compute-1.cord.lab"},
+		"tag_ceph":          {"storage-1.cord.lab"},
+		"role_compute_node": {"compute-1.cord.lab"},
+		"role_storage_node": {"storage-1.cord.lab"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("expected groups %v, got %v", expected, groups)
+	}
+
+	out.Reset()
+	if status := inventoryCommand(client, options, []string{"--host", "compute-1.cord.lab"}, &out); status != 0 {
+		t.Fatalf("inventory command failed with status %d", status)
+	}
+	var vars HostVars
+	if err := json.Unmarshal(out.Bytes(), &vars); err != nil {
+		t.Fatalf("unable to parse host variables '%s' : %s", out.String(), err)
+	}
+	if vars.AnsibleHost != "10.6.0.10" || vars.PowerType != "ipmi" || vars.ProvisionStatus != "COMPLETE" ||
+		!reflect.DeepEqual(vars.MACs, []string{"00:11:22:33:44:55"}) {
+		t.Errorf("unexpected host variables %+v", vars)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// LeaderStatus the state of leader election as reported by the REST API
+type LeaderStatus struct {
+	Enabled  bool   `json:"enabled"`
+	Identity string `json:"identity,omitempty"`
+	Leader   string `json:"leader,omitempty"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+// LeaderElector elects, through a Consul session lock, the one of a number of
+// automation replicas that processes nodes. A nil elector has leader election
+// disabled, and is always the leader.
+type LeaderElector struct {
+	Identity string
+
+	// OnElected, if set, is called whenever this replica is elected leader
+	OnElected func()
+
+	key    string
+	kv     *consul.KV
+	lock   *consul.Lock
+	mutex  sync.RWMutex
+	leader bool
+}
+
+// NewLeaderElector returns an elector that campaigns for the given key of
+// the Consul agent at the given URL, e.g. consul://consul:8500
+func NewLeaderElector(spec string, key string, identity string, ttl time.Duration) (*LeaderElector, error) {
+	client, err := newConsulClient(spec)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := client.LockOpts(&consul.LockOptions{
+		Key:         key,
+		Value:       []byte(identity),
+		SessionName: "maas-flow leader " + identity,
+		SessionTTL:  ttl.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{
+		Identity: identity,
+		key:      key,
+		kv:       client.KV(),
+		lock:     lock,
+	}, nil
+}
+
+// newConsulClient returns a client of the Consul agent at the given URL,
+// e.g. consul://consul:8500
+func newConsulClient(spec string) (*consul.Client, error) {
+	conn, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Scheme != "consul" {
+		return nil, fmt.Errorf("unsupported Consul URL '%s', expected consul://host:port", spec)
+	}
+
+	cfg := consul.Config{
+		Address: conn.Host,
+		Scheme:  "http",
+	}
+	log.Debugf("Consul config = %+v", cfg)
+	return consul.NewClient(&cfg)
+}
+
+// Start campaigns for leadership in the background, and campaigns again
+// whenever leadership is lost
+func (e *LeaderElector) Start() {
+	if e == nil {
+		return
+	}
+	go func() {
+		for {
+			lost, err := e.lock.Lock(nil)
+			if err != nil {
+				log.Warnf("Unable to campaign for leadership : %s", err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+			e.elected()
+
+			<-lost
+			e.setLeader(false)
+			log.Warnf("Lost leadership, no longer processing nodes")
+			if err := e.lock.Unlock(); err != nil && err != consul.ErrLockNotHeld {
+				log.Debugf("Unable to release leadership lock : %s", err)
+			}
+		}
+	}()
+}
+
+// elected makes this replica the leader and notifies OnElected
+func (e *LeaderElector) elected() {
+	e.setLeader(true)
+	log.Infof("Elected leader as '%s', processing nodes", e.Identity)
+	if e.OnElected != nil {
+		e.OnElected()
+	}
+}
+
+func (e *LeaderElector) setLeader(leader bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.leader = leader
+}
+
+// IsLeader returns true if this replica is to process nodes
+func (e *LeaderElector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leader
+}
+
+// Leader returns the identity of the current leader, or the empty string if
+// there is none
+func (e *LeaderElector) Leader() (string, error) {
+	if e == nil {
+		return "", nil
+	}
+	pair, _, err := e.kv.Get(e.key, nil)
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Session == "" {
+		return "", nil
+	}
+	return string(pair.Value), nil
+}
+
+// Status returns the state of leader election
+func (e *LeaderElector) Status() LeaderStatus {
+	if e == nil {
+		return LeaderStatus{IsLeader: true}
+	}
+	status := LeaderStatus{
+		Enabled:  true,
+		Identity: e.Identity,
+		IsLeader: e.IsLeader(),
+	}
+	leader, err := e.Leader()
+	if err != nil {
+		log.Warnf("Unable to determine the current leader : %s", err)
+	}
+	status.Leader = leader
+	return status
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func TestStandbyDoesNotChangeNodes(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{
+		Hostname:   "node-a",
+		Status:     maasfake.Ready,
+		Interfaces: []maasfake.Interface{testInterface("dhcp")},
+	})
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Leader = &LeaderElector{Identity: "standby"}
+
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	server.ResetCalls()
+	ProcessAll(client, nodes, options)
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("expected a standby not to call MAAS, got %v", operations(calls))
+	}
+
+	options.Leader.setLeader(true)
+	ProcessAll(client, nodes, options)
+	if node, _ := server.Node(id); node.Status == maasfake.Ready {
+		t.Errorf("expected the leader to process the node")
+	}
+}
+
+func TestElectedLeaderNotified(t *testing.T) {
+	elected := 0
+	elector := &LeaderElector{Identity: "standby", OnElected: func() { elected++ }}
+	elector.elected()
+	if !elector.IsLeader() || elected != 1 {
+		t.Errorf("expected the elected replica to lead and be notified once, got leader %t notified %d",
+			elector.IsLeader(), elected)
+	}
+}
+
+func TestLeaderElectionDisabled(t *testing.T) {
+	var elector *LeaderElector
+	status := elector.Status()
+	if !elector.IsLeader() || !status.IsLeader || status.Enabled {
+		t.Errorf("expected a replica without leader election to always lead, got %+v", status)
+	}
+}
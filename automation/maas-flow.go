@@ -16,9 +16,11 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
@@ -33,20 +35,64 @@ type Config struct {
 	PowerHelperUser   string        `default:"cord" envconfig:"POWER_HELPER_USER" desc:"user when integrating with virtual box power mgmt"`
 	PowerHelperHost   string        `default:"127.0.0.1" envconfig:"POWER_HELPER_HOST" desc:"virtual box host"`
 	PowerHelperScript string        `default:"" envconfig:"POWER_HELPER_SCRIPT" desc:"script for virtual box power mgmt support"`
+	PowerDrivers      string        `default:"{}" envconfig:"POWER_DRIVERS" desc:"external power driver scripts by discovered power type"`
 	ProvisionUrl      string        `default:"" envconfig:"PROVISION_URL" desc:"connection string to connect to provisioner uservice"`
 	ProvisionTtl      string        `default:"1h" envconfig:"PROVISION_TTL" desc:"duration to wait for a provisioning request to complete, before considered a failure"`
+	ProvisionSpec     string        `default:"{}" envconfig:"PROVISION_PROFILES" desc:"provisioner role and script, and their selection by tag, role or zone"`
+	ProvisionTags     bool          `default:"true" envconfig:"PROVISION_TAGS" desc:"mirror the provisioning status of nodes in MAAS tags and node descriptions"`
 	LogLevel          string        `default:"warning" envconfig:"LOG_LEVEL" desc:"detail level for logging"`
 	LogFormat         string        `default:"text" envconfig:"LOG_FORMAT" desc:"log output format, text or json"`
-	ApiKey            string        `envconfig:"MAAS_API_KEY" required:"true" desc:"API key to access MAAS server"`
+	Listen            string        `default:"" desc:"IP on which to listen for requests"`
+	Port              int           `default:"4247" desc:"port on which to listen for requests"`
+	ApiKey            string        `envconfig:"MAAS_API_KEY" desc:"API key to access MAAS server, read from MAAS_API_KEY_FILE if not set"`
 	ApiKeyFile        string        `default:"/secrets/maas_api_key" envconfig:"MAAS_API_KEY_FILE" desc:"file to hold the secret"`
 	ShowApiKey        bool          `default:"false" envconfig:"MAAS_SHOW_API_KEY" desc:"Show API in clear text in logs"`
 	MaasUrl           string        `default:"http://localhost/MAAS" envconfig:"MAAS_URL" desc:"URL to access MAAS server"`
 	ApiVersion        string        `default:"1.0" envconfig:"MAAS_API_VERSION" desc:"API version to use with MAAS server"`
 	QueryInterval     time.Duration `default:"15s" envconfig:"MAAS_QUERY_INTERVAL" desc:"frequency to query MAAS service for nodes"`
+	UseEvents         bool          `default:"false" envconfig:"USE_EVENTS" desc:"process nodes as MAAS reports events for them, querying all nodes only every resync interval"`
+	EventInterval     time.Duration `default:"2s" envconfig:"EVENT_POLL_INTERVAL" desc:"frequency to query MAAS service for events"`
+	ResyncInterval    time.Duration `default:"10m" envconfig:"RESYNC_INTERVAL" desc:"frequency to query MAAS service for all nodes when processing events"`
+	NumberOfWorkers   int           `default:"5" envconfig:"NUMBER_OF_WORKERS" desc:"number of nodes for which actions are processed concurrently"`
+	MaxMutations      int           `default:"2" envconfig:"MAX_CONCURRENT_MUTATIONS" desc:"cap on concurrent MAAS calls that change node state, 0 for no cap"`
+	MaxRetries        int           `default:"3" envconfig:"MAX_RETRIES" desc:"attempts to recover a failing node before it is quarantined"`
+	RetryBackoff      time.Duration `default:"1m" envconfig:"RETRY_BACKOFF" desc:"initial delay before retrying a failed node, doubled on every failure"`
+	RetryMaxBackoff   time.Duration `default:"1h" envconfig:"RETRY_MAX_BACKOFF" desc:"maximum delay before retrying a failed node"`
+	QuarantineTag     string        `default:"quarantine" envconfig:"QUARANTINE_TAG" desc:"MAAS tag used to quarantine failing nodes"`
 	PreviewOnly       bool          `default:"false" envconfig:"PREVIEW_ONLY" desc:"display actions that would be taken, but don't execute them"`
+	PlanOutput        string        `default:"" envconfig:"PLAN_OUTPUT" desc:"file to which the plan is written in preview mode, standard output if not set"`
+	PlanFormat        string        `default:"json" envconfig:"PLAN_FORMAT" desc:"format of the plan written in preview mode, json or yaml"`
 	AlwaysRename      bool          `default:"true" envconfig:"ALWAYS_RENAME" desc:"attempt to rename hosts at every stage or workflow"`
 	Mappings          string        `default:"{}" envconfig:"MAC_TO_NAME_MAPPINGS" desc:"custom MAC address to host name mappings"`
+	MappingsReload    time.Duration `default:"10s" envconfig:"MAC_TO_NAME_MAPPINGS_RELOAD" desc:"frequency to check the MAC address to host name mappings file for changes, 0 to never reload"`
 	FilterSpec        string        `default:"{\"hosts\":{\"include\":[\".*\"]},\"zones\":{\"include\":[\"default\"]}}" envconfig:"HOST_FILTER_SPEC" desc:"constrain hosts that are automated"`
+	Charts            string        `default:"{}" envconfig:"TRANSITION_CHARTS" desc:"state machine charts, by target state, from which transitions are generated"`
+	TargetSpec        string        `default:"{\"default\":\"Deployed\"}" envconfig:"TARGET_STATE_SPEC" desc:"selection of the target state of nodes by host, tag or zone"`
+	ProfileSpec       string        `default:"{}" envconfig:"DEPLOYMENT_PROFILES" desc:"deployment profiles and their selection by hostname, tag or zone"`
+	RoleSpec          string        `default:"{}" envconfig:"ROLES" desc:"selection of the role of nodes by hostname, tag or zone"`
+	NetworkSpec       string        `default:"{}" envconfig:"NETWORK_POLICIES" desc:"network interface policies by node role"`
+	StorageSpec       string        `default:"{}" envconfig:"STORAGE_POLICIES" desc:"storage layout policies and their selection by tag or role"`
+	HardwareSpec      string        `default:"{}" envconfig:"HARDWARE_SPECS" desc:"minimum hardware, by node role, required before a node is deployed"`
+	NoncompliantTag   string        `default:"noncompliant" envconfig:"NONCOMPLIANT_TAG" desc:"MAAS tag used to hold back nodes whose hardware does not meet its specification"`
+	MaintenanceSpec   string        `default:"{}" envconfig:"MAINTENANCE_WINDOWS" desc:"maintenance windows, and their selection by tag or zone, outside of which disruptive actions are deferred"`
+	AuditFile         string        `default:"/var/lib/maas-flow/audit.jsonl" envconfig:"AUDIT_LOG_FILE" desc:"file to which every change made in MAAS is appended, empty to not write it"`
+	AuditURL          string        `default:"" envconfig:"AUDIT_CONSUL_URL" desc:"connection string to the Consul agent in which every change made in MAAS is also stored, empty to not store it"`
+	AuditKey          string        `default:"cord/automation/audit" envconfig:"AUDIT_CONSUL_KEY" desc:"Consul key prefix under which changes are stored"`
+	CampaignFile      string        `default:"/var/lib/maas-flow/campaigns.json" envconfig:"CAMPAIGN_STATE_FILE" desc:"file to which the progress of redeploy campaigns is saved, empty to not save it"`
+	CampaignKey       string        `default:"cord/automation/campaigns" envconfig:"CAMPAIGN_CONSUL_KEY" desc:"Consul key under which the progress of redeploy campaigns is saved when leader election is used"`
+	HealthChecks      string        `default:"{}" envconfig:"HEALTH_CHECKS" desc:"health check scripts, by name, that redeploy campaigns may run"`
+	APIToken          string        `default:"" envconfig:"API_TOKEN" desc:"bearer token required of REST requests that change nodes or campaigns, empty to not require one"`
+	LeaderURL         string        `default:"" envconfig:"LEADER_ELECTION_URL" desc:"connection string to the Consul agent through which the replica that processes nodes is elected, empty to always process nodes"`
+	LeaderKey         string        `default:"cord/automation/leader" envconfig:"LEADER_ELECTION_KEY" desc:"Consul key locked by the leader"`
+	LeaderTTL         time.Duration `default:"15s" envconfig:"LEADER_ELECTION_TTL" desc:"time after which leadership is lost if the leader stops renewing it"`
+	LeaderIdentity    string        `default:"" envconfig:"LEADER_IDENTITY" desc:"name by which this replica is known when leader, the host name if not set"`
+}
+
+type AppContext struct {
+	config    Config
+	client    *maas.MAASObject
+	options   ProcessingOptions
+	reconcile chan bool
 }
 
 // checkError if the given err is not nil, then fatally log the message, else
@@ -68,10 +114,37 @@ func checkWarn(err error, message string, v ...interface{}) bool {
 	return false
 }
 
+// loadSpec decodes a JSON specification of the named setting into v. The
+// specification is given on the command line either as the JSON itself or as
+// '@' followed by the name of a file containing it. An empty specification
+// leaves v as it is.
+func loadSpec(spec string, v interface{}, what string) error {
+	if spec == "" {
+		return nil
+	}
+	if spec[0] != '@' {
+		if err := json.Unmarshal([]byte(spec), v); err != nil {
+			return fmt.Errorf("unable to parse %s: '%s' : %s", what, spec, err)
+		}
+		return nil
+	}
+
+	name := os.ExpandEnv(spec[1:])
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("unable to open file '%s' to load the %s : %s", name, what, err)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return fmt.Errorf("unable to parse %s from file '%s' : %s", what, name, err)
+	}
+	return nil
+}
+
 // fetchNodes do a HTTP GET to the MAAS server to query all the nodes
-func fetchNodes(client *maas.MAASObject) ([]MaasNode, error) {
-	nodeListing := client.GetSubObject("nodes")
-	listNodeObjects, err := nodeListing.CallGet("list", url.Values{})
+func fetchNodes(client *maas.MAASObject, api *MaasAPI) ([]MaasNode, error) {
+	nodeListing := client.GetSubObject(api.Nodes)
+	listNodeObjects, err := nodeListing.CallGet(api.ListOp, url.Values{})
 	if checkWarn(err, "unable to get the list of all nodes: %s", err) {
 		return nil, err
 	}
@@ -84,12 +157,21 @@ func fetchNodes(client *maas.MAASObject) ([]MaasNode, error) {
 	for index, nodeObj := range listNodes {
 		node, err := nodeObj.GetMAASObject()
 		if !checkWarn(err, "unable to retrieve object for node: %s", err) {
-			nodes[index] = MaasNode{node}
+			nodes[index] = MaasNode{node, api}
 		}
 	}
 	return nodes, nil
 }
 
+// fetchNode do a HTTP GET to the MAAS server to query a single node
+func fetchNode(client *maas.MAASObject, api *MaasAPI, id string) (MaasNode, error) {
+	node, err := client.GetSubObject(api.Nodes).GetSubObject(id).Get()
+	if checkWarn(err, "unable to get node '%s': %s", id, err) {
+		return MaasNode{}, err
+	}
+	return MaasNode{node, api}, nil
+}
+
 var log = logrus.New()
 var appFlags = flag.NewFlagSet("", flag.ContinueOnError)
 
@@ -98,6 +180,7 @@ func main() {
 	config := Config{}
 	appFlags.Usage = func() {
 		envconfig.Usage(appName, &config)
+		commandUsage(os.Stderr)
 	}
 	if err := appFlags.Parse(os.Args[1:]); err != nil {
 		if err != flag.ErrHelp {
@@ -118,9 +201,19 @@ func main() {
 		AlwaysRename:    config.AlwaysRename,
 		Provisioner:     NewProvisioner(&ProvisionerConfig{Url: config.ProvisionUrl}),
 		ProvisionURL:    config.ProvisionUrl,
+		ProvisionTags:   config.ProvisionTags,
 		PowerHelper:     config.PowerHelperScript,
 		PowerHelperUser: config.PowerHelperUser,
 		PowerHelperHost: config.PowerHelperHost,
+		Tracker:         NewNodeTracker(),
+		Mutations:       NewMutationLimiter(config.MaxMutations),
+		NoncompliantTag: config.NoncompliantTag,
+		Retry: RetryPolicy{
+			MaxRetries:    config.MaxRetries,
+			Backoff:       config.RetryBackoff,
+			MaxBackoff:    config.RetryMaxBackoff,
+			QuarantineTag: config.QuarantineTag,
+		},
 	}
 
 	switch config.LogFormat {
@@ -139,45 +232,111 @@ func main() {
 	}
 	log.Level = level
 
-	options.ProvisionTTL, err = time.ParseDuration(config.ProvisionTtl)
-	checkError(err, "unable to parse specified duration of '%s' : %s", err)
+	options.API, err = NewMaasAPI(config.ApiVersion)
+	checkError(err, "unable to use MAAS API version '%s' : %s", config.ApiVersion, err)
 
-	// Determine the filter, this can either be specified on the the command
-	// line as a value or a file reference. If none is specified the default
-	// will be used
-	if len(config.FilterSpec) > 0 {
-		if config.FilterSpec[0] == '@' {
-			name := os.ExpandEnv((config.FilterSpec)[1:])
-			file, err := os.OpenFile(name, os.O_RDONLY, 0)
-			checkError(err, "unable to open file '%s' to load the filter : %s", name, err)
-			decoder := json.NewDecoder(file)
-			err = decoder.Decode(&options.Filter)
-			checkError(err, "unable to parse filter configuration from file '%s' : %s", name, err)
-		} else {
-			err := json.Unmarshal([]byte(config.FilterSpec), &options.Filter)
-			checkError(err, "unable to parse filter specification: '%s' : %s", config.FilterSpec, err)
-		}
+	if config.PlanFormat != "json" && config.PlanFormat != "yaml" {
+		log.Fatalf("unknown plan format '%s', expected json or yaml", config.PlanFormat)
 	}
 
+	options.ProvisionTTL, err = time.ParseDuration(config.ProvisionTtl)
+	checkError(err, "unable to parse specified duration of '%s' : %s", config.ProvisionTtl, err)
+
+	// Determine the filter, if none is specified the default will be used
+	err = loadSpec(config.FilterSpec, &options.Filter, "host filter")
+	checkError(err, "%s", err)
+	err = options.Filter.Compile()
+	checkError(err, "invalid host filter : %s", err)
+
 	// Determine the mac to name mapping, this can either be specified on the the command
 	// line as a value or a file reference. If none is specified the default
-	// will be used
-	if len(config.Mappings) > 0 {
-		if config.Mappings[0] == '@' {
-			name := os.ExpandEnv(config.Mappings[1:])
-			file, err := os.OpenFile(name, os.O_RDONLY, 0)
-			checkError(err, "unable to open file '%s' to load the mac name mapping : %s", name, err)
-			decoder := json.NewDecoder(file)
-			err = decoder.Decode(&options.Mappings)
-			checkError(err, "unable to parse filter configuration from file '%s' : %s", name, err)
-		} else {
-			err := json.Unmarshal([]byte(config.Mappings), &options.Mappings)
-			checkError(err, "unable to parse mac name mapping: '%s' : %s", config.Mappings, err)
-		}
+	// will be used. Mappings loaded from a file are reloaded when it changes.
+	options.Names, err = NewNameMapper(config.Mappings)
+	checkError(err, "%s", err)
+	options.Names.Watch(config.MappingsReload)
+
+	// Determine the state machine charts from which the transitions are
+	// generated. Each chart in turn can either be the chart itself or a file
+	// reference. Targets for which no chart is specified use the default
+	// chart.
+	charts := map[string]string{}
+	err = loadSpec(config.Charts, &charts, "transition charts")
+	checkError(err, "%s", err)
+	TransitionCharts, err = LoadCharts(charts)
+	checkError(err, "invalid state machine chart : %s", err)
+	Transitions, err = BuildTransitions(charts)
+	checkError(err, "invalid state machine chart : %s", err)
+
+	// Determine the external power driver scripts
+	powerScripts := map[string]string{}
+	err = loadSpec(config.PowerDrivers, &powerScripts, "power drivers")
+	checkError(err, "%s", err)
+	options.PowerDrivers = NewPowerDrivers(powerScripts)
+
+	// Determine the target state selection
+	options.Targets = &TargetSelector{}
+	err = loadSpec(config.TargetSpec, options.Targets, "target state selection")
+	checkError(err, "%s", err)
+	err = options.Targets.Validate(Transitions)
+	checkError(err, "invalid target state selection : %s", err)
+
+	// Determine the deployment profiles and their selection
+	options.Profiles = &ProfileSelector{}
+	err = loadSpec(config.ProfileSpec, options.Profiles, "deployment profiles")
+	checkError(err, "%s", err)
+	err = options.Profiles.Load()
+	checkError(err, "invalid deployment profiles : %s", err)
+
+	// Determine the role selection
+	options.Roles = &RoleSelector{}
+	err = loadSpec(config.RoleSpec, options.Roles, "role selection")
+	checkError(err, "%s", err)
+	err = options.Roles.Load()
+	checkError(err, "invalid role selection : %s", err)
+
+	// Determine the provisioning profiles
+	options.Provisioning = &ProvisionSelector{}
+	err = loadSpec(config.ProvisionSpec, options.Provisioning, "provisioning profiles")
+	checkError(err, "%s", err)
+	err = options.Provisioning.Load()
+	checkError(err, "invalid provisioning profiles : %s", err)
+
+	// Determine the maintenance windows
+	options.Maintenance = &MaintenanceSchedule{}
+	err = loadSpec(config.MaintenanceSpec, options.Maintenance, "maintenance windows")
+	checkError(err, "%s", err)
+	err = options.Maintenance.Load()
+	checkError(err, "invalid maintenance windows : %s", err)
+
+	// Determine the network policies by role
+	options.Networks = NetworkPolicies{}
+	err = loadSpec(config.NetworkSpec, &options.Networks, "network policies")
+	checkError(err, "%s", err)
+	err = options.Networks.Load()
+	checkError(err, "invalid network policies : %s", err)
+
+	// Determine the storage policies and their selection
+	options.Storage = &StorageSelector{}
+	err = loadSpec(config.StorageSpec, options.Storage, "storage policies")
+	checkError(err, "%s", err)
+	err = options.Storage.Load()
+	checkError(err, "invalid storage policies : %s", err)
+
+	// Determine the hardware specifications by role
+	options.Hardware = HardwareSpecs{}
+	err = loadSpec(config.HardwareSpec, &options.Hardware, "hardware specifications")
+	checkError(err, "%s", err)
+	err = options.Hardware.Load()
+	checkError(err, "invalid hardware specifications : %s", err)
+
+	// Run a command that needs no MAAS, such as drawing the lifecycle, before
+	// requiring the API key and recording changes
+	if appFlags.NArg() > 0 && commandOffline(appFlags.Args()) {
+		os.Exit(runCommand(nil, options, appFlags.Args()))
 	}
 
 	// Get human readable strings for config output
-	mappingsAsJson, err := json.Marshal(options.Mappings)
+	mappingsAsJson, err := json.Marshal(options.Names)
 	checkError(err, "Unable to marshal MAC to hostname mappings to JSON : %s", err)
 	mappingsPrefix := ""
 
@@ -202,27 +361,68 @@ func main() {
             POWER_HELPER_USER:    %s
 	    POWER_HELPER_HOST:    %s
 	    POWER_HELPER_SCRIPT:  %s
+	    POWER_DRIVERS:        %s
 	    PROVISION_URL:        %s
 	    PROVISION_TTL:        %s
+	    PROVISION_PROFILES:   %s
+	    PROVISION_TAGS:       %t
 	    MAAS_URL:             %s
 	    MAAS_SHOW_API_KEY:    %t
 	    MAAS_API_KEY:         %s
 	    MAAS_API_KEY_FILE:    %s
 	    MAAS_API_VERSION:     %s
 	    MAAS_QUERY_INTERVAL:  %s
+	    USE_EVENTS:           %t
+	    EVENT_POLL_INTERVAL:  %s
+	    RESYNC_INTERVAL:      %s
+	    NUMBER_OF_WORKERS:    %d
+	    MAX_CONCURRENT_MUTATIONS: %d
+	    MAX_RETRIES:          %d
+	    RETRY_BACKOFF:        %s
+	    RETRY_MAX_BACKOFF:    %s
+	    QUARANTINE_TAG:       %s
 	    HOST_FILTER_SPEC:     %+v
 	    MAC_TO_NAME_MAPPINGS: %+v
+	    MAC_TO_NAME_MAPPINGS_RELOAD: %s
+	    TRANSITION_CHARTS:    %s
+	    TARGET_STATE_SPEC:    %s
+	    DEPLOYMENT_PROFILES:  %s
+	    ROLES:                %s
+	    NETWORK_POLICIES:     %s
+	    STORAGE_POLICIES:     %s
+	    HARDWARE_SPECS:       %s
+	    NONCOMPLIANT_TAG:     %s
+	    MAINTENANCE_WINDOWS:  %s
+	    AUDIT_LOG_FILE:       %s
+	    AUDIT_CONSUL_URL:     %s
+	    AUDIT_CONSUL_KEY:     %s
+	    CAMPAIGN_STATE_FILE:  %s
+	    LEADER_ELECTION_URL:  %s
+	    LEADER_ELECTION_KEY:  %s
+	    LEADER_ELECTION_TTL:  %s
+	    LEADER_IDENTITY:      %s
 	    PREVIEW_ONLY:         %t
+	    PLAN_OUTPUT:          %s
+	    PLAN_FORMAT:          %s
 	    ALWAYS_RENAME:        %t
+	    LISTEN:               %s
+	    PORT:                 %d
 	    LOG_LEVEL:            %s
 	    LOG_FORMAT:		  %s`,
-		config.PowerHelperUser, config.PowerHelperHost, config.PowerHelperScript,
-		config.ProvisionUrl, config.ProvisionTtl,
+		config.PowerHelperUser, config.PowerHelperHost, config.PowerHelperScript, config.PowerDrivers,
+		config.ProvisionUrl, config.ProvisionTtl, config.ProvisionSpec, config.ProvisionTags,
 		config.MaasUrl, config.ShowApiKey,
 		pubKey, config.ApiKeyFile, config.ApiVersion, config.QueryInterval,
-		filterPrefix+string(filterAsJson), mappingsPrefix+string(mappingsAsJson),
-		config.PreviewOnly, config.AlwaysRename,
-		config.LogLevel, config.LogFormat)
+		config.UseEvents, config.EventInterval, config.ResyncInterval,
+		config.NumberOfWorkers, config.MaxMutations,
+		config.MaxRetries, config.RetryBackoff, config.RetryMaxBackoff, config.QuarantineTag,
+		filterPrefix+string(filterAsJson), mappingsPrefix+string(mappingsAsJson), config.MappingsReload, config.Charts,
+		config.TargetSpec, config.ProfileSpec, config.RoleSpec, config.NetworkSpec,
+		config.StorageSpec, config.HardwareSpec, config.NoncompliantTag, config.MaintenanceSpec,
+		config.AuditFile, config.AuditURL, config.AuditKey,
+		config.CampaignFile, config.LeaderURL, config.LeaderKey, config.LeaderTTL, config.LeaderIdentity,
+		config.PreviewOnly, config.PlanOutput, config.PlanFormat, config.AlwaysRename,
+		config.Listen, config.Port, config.LogLevel, config.LogFormat)
 
 	// Attempt to load the API key from a file if it was not set via the environment
 	// and if the file exists
@@ -241,6 +441,9 @@ func main() {
 			}
 		}
 	}
+	if config.ApiKey == "" {
+		log.Fatalf("No MAAS API key, set MAAS_API_KEY or provide the file MAAS_API_KEY_FILE")
+	}
 
 	authClient, err := maas.NewAuthenticatedClient(config.MaasUrl, config.ApiKey, config.ApiVersion)
 	checkError(err, "Unable to use specified client key, '%s', to authenticate to the MAAS server: %s",
@@ -249,24 +452,132 @@ func main() {
 	// Create an object through which we will communicate with MAAS
 	client := maas.NewMAAS(*authClient)
 
-	// This utility essentially polls the MAAS server for node state and
-	// process the node to the next state. This is done by kicking off the
-	// process every specified duration. This means that the first processing of
-	// nodes will have "period" in the future. This is really not the behavior
-	// we want, we really want, do it now, and then do the next one in "period".
-	// So, the code does one now.
-	nodes, _ := fetchNodes(client)
-	ProcessAll(client, nodes, options)
-
-	if !(config.PreviewOnly) {
-		// Create a ticker and fetch and process the nodes every "period"
-		for {
+	// Every change made in MAAS is recorded, identified by the name of this
+	// replica, so that it can later be determined who changed a node and when
+	identity := config.LeaderIdentity
+	if identity == "" {
+		identity, err = os.Hostname()
+		checkError(err, "unable to determine the host name to identify this replica : %s", err)
+	}
+	options.Audit, err = NewAuditLog(os.ExpandEnv(config.AuditFile), config.AuditURL, config.AuditKey, identity)
+	checkError(err, "unable to use audit Consul URL '%s' : %s", config.AuditURL, err)
+
+	// Run a command, such as generating an inventory, in place of automating
+	// the nodes if one is given
+	if appFlags.NArg() > 0 {
+		os.Exit(runCommand(client, options, appFlags.Args()))
+	}
+
+	options.Campaigns, err = NewCampaignManager(os.ExpandEnv(config.CampaignFile), config.LeaderURL, config.CampaignKey)
+	checkError(err, "unable to load campaigns : %s", err)
+	err = loadSpec(config.HealthChecks, &options.Campaigns.Checks, "health checks")
+	checkError(err, "%s", err)
+
+	// In preview mode the nodes are processed once and the plan written out
+	// for review, failing if there is a node for which there is no valid
+	// transition
+	if config.PreviewOnly {
+		options.Plan = NewPlan()
+		nodes, _ := fetchNodes(client, options.API)
+		ProcessAll(client, nodes, options)
+
+		out := os.Stdout
+		if config.PlanOutput != "" {
+			name := os.ExpandEnv(config.PlanOutput)
+			out, err = os.Create(name)
+			checkError(err, "unable to create file '%s' to write the plan : %s", name, err)
+			defer out.Close()
+		}
+		err = options.Plan.Write(out, config.PlanFormat)
+		checkError(err, "unable to write the plan : %s", err)
+		if !options.Plan.Valid() {
+			log.Errorf("The plan contains nodes for which there is no valid transition")
+			out.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Process the actions for nodes on a fixed number of workers, so that a
+	// node never has more than one chain of actions in flight
+	options.Dispatcher = NewDispatcher(config.NumberOfWorkers)
+	options.Dispatcher.Start()
+
+	// When replicas are run only the elected leader processes nodes, the
+	// others stand by to take over should the leader fail. A replica that
+	// is elected resumes the campaigns saved by the previous leader and
+	// processes all the nodes straight away, as changes made while there
+	// was no leader would otherwise wait for the next pass.
+	reconcile := make(chan bool, 1)
+	if config.LeaderURL != "" {
+		options.Leader, err = NewLeaderElector(config.LeaderURL, config.LeaderKey, identity, config.LeaderTTL)
+		checkError(err, "unable to use leader election URL '%s' : %s", config.LeaderURL, err)
+		options.Leader.OnElected = func() {
+			if err := options.Campaigns.Load(); err != nil {
+				log.Errorf("Unable to resume campaigns : %s", err)
+			}
+			select {
+			case reconcile <- true:
+			default:
+				// A reconcile is already pending
+			}
+		}
+		options.Leader.Start()
+	}
+
+	context := &AppContext{
+		config:    config,
+		client:    client,
+		options:   options,
+		reconcile: reconcile,
+	}
+
+	http.Handle("/", context.router())
+
+	go func() {
+		log.Infof("Listening for HTTP request on '%s:%d'", config.Listen, config.Port)
+		err := http.ListenAndServe(fmt.Sprintf("%s:%d", config.Listen, config.Port), nil)
+		checkError(err, "Error while attempting to listen to REST requests on '%s:%d' : %s",
+			config.Listen, config.Port, err)
+	}()
+
+	// When following MAAS events only the nodes that changed are
+	// processed as they change, and all the nodes are processed at the
+	// much longer resync interval in case an event was missed
+	interval := config.QueryInterval
+	var changes <-chan []string
+	if config.UseEvents {
+		interval = config.ResyncInterval
+		changes = NewEventWatcher(client).Watch(config.EventInterval)
+	}
+
+	// Fetch and process the nodes now, and then every "period", or
+	// sooner if a reconcile of all nodes is requested or this replica
+	// is elected leader
+	for {
+		if options.Leader.IsLeader() {
 			log.Infof("query server at %s", time.Now())
-			nodes, _ := fetchNodes(client)
+			nodes, _ := fetchNodes(client, options.API)
 			ProcessAll(client, nodes, options)
+		} else {
+			leader, _ := options.Leader.Leader()
+			log.Infof("standing by at %s, leader is '%s'", time.Now(), leader)
+		}
 
-			// Sleep for the Interval and then process again.
-			time.Sleep(config.QueryInterval)
+		// Sleep for the Interval and then process again.
+		resync := time.After(interval)
+	wait:
+		for {
+			select {
+			case ids := <-changes:
+				if options.Leader.IsLeader() {
+					ProcessChanged(client, ids, options)
+				}
+			case <-resync:
+				break wait
+			case <-context.reconcile:
+				break wait
+			}
 		}
 	}
 }
@@ -0,0 +1,90 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaasAPI the details of the MAAS API that differ between API versions
+type MaasAPI struct {
+	// Version the MAAS API version, as used in the API URL
+	Version string
+
+	// Nodes the collection through which nodes are managed
+	Nodes string
+
+	// ListOp the operation that lists all the nodes of the collection
+	ListOp string
+
+	// StatusKey the attribute that holds the numeric status of a node
+	StatusKey string
+
+	// MACsKey the attribute that holds the network interfaces of a node,
+	// each of which has a mac_address
+	MACsKey string
+
+	// Statuses the number of node statuses known to the API version, see
+	// MaasNodeStatus
+	Statuses int
+
+	// Ops the names of node operations that differ from those of the 1.0 API
+	Ops map[string]string
+}
+
+// MaasAPIv1 the MAAS 1.x API
+var MaasAPIv1 = &MaasAPI{
+	Version:   "1.0",
+	Nodes:     "nodes",
+	ListOp:    "list",
+	StatusKey: "substatus",
+	MACsKey:   "macaddress_set",
+	Statuses:  int(FailedDiskErasing) + 1,
+	Ops:       map[string]string{},
+}
+
+// MaasAPIv2 the MAAS 2.x API, which manages nodes as machines
+var MaasAPIv2 = &MaasAPI{
+	Version:   "2.0",
+	Nodes:     "machines",
+	ListOp:    "",
+	StatusKey: "status",
+	MACsKey:   "interface_set",
+	Statuses:  len(names),
+	Ops: map[string]string{
+		"acquire": "allocate",
+		"start":   "deploy",
+		"stop":    "power_off",
+	},
+}
+
+// NewMaasAPI returns the API details for the given MAAS API version
+func NewMaasAPI(version string) (*MaasAPI, error) {
+	switch {
+	case strings.HasPrefix(version, "1."):
+		return MaasAPIv1, nil
+	case strings.HasPrefix(version, "2."):
+		return MaasAPIv2, nil
+	}
+	return nil, fmt.Errorf("unsupported MAAS API version '%s'", version)
+}
+
+// Op returns the name, in this API version, of the given 1.0 node operation
+func (a *MaasAPI) Op(op string) string {
+	if name, ok := a.Ops[op]; ok {
+		return name
+	}
+	return op
+}
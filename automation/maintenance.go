@@ -0,0 +1,235 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxWindowDuration the longest a maintenance window may stay open, which
+// bounds the search for the start of an open window
+const maxWindowDuration = 7 * 24 * time.Hour
+
+// cronField the values matched by one field of a cron spec
+type cronField map[int]bool
+
+// parseCronField parses a field of a cron spec, which is a comma separated
+// list of "*", a value or a range of values, each optionally followed by
+// "/" and a step
+func parseCronField(spec string, min int, max int) (cronField, error) {
+	field := cronField{}
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range '%s'", part)
+				}
+			}
+			if low < min || high > max || low > high {
+				return nil, fmt.Errorf("'%s' is out of the range %d-%d", part, min, max)
+			}
+		}
+		for v := low; v <= high; v += step {
+			field[v] = true
+		}
+	}
+	return field, nil
+}
+
+// MaintenanceWindow a recurring period in which disruptive actions may be
+// taken. The window opens at the times matched by Cron, a cron spec of the
+// form "minute hour day-of-month month day-of-week", and stays open for
+// Duration. As in cron, when both the day of the month and the day of the
+// week are restricted, i.e. neither starts with "*", a day matching either
+// one matches. Times are in the Timezone, or the local time zone if none is
+// given.
+type MaintenanceWindow struct {
+	Cron     string `json:"cron"`
+	Duration string `json:"duration"`
+	Timezone string `json:"timezone,omitempty"`
+
+	minutes, hours, days, months, weekdays cronField
+	anyDay, anyWeekday                     bool
+	duration                               time.Duration
+	location                               *time.Location
+}
+
+// load parses the cron spec, duration and time zone of the window
+func (w *MaintenanceWindow) load() error {
+	fields := strings.Fields(w.Cron)
+	if len(fields) != 5 {
+		return fmt.Errorf("cron spec '%s' must have 5 fields", w.Cron)
+	}
+	var err error
+	parsed := []*cronField{&w.minutes, &w.hours, &w.days, &w.months, &w.weekdays}
+	ranges := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	for i, spec := range fields {
+		if *parsed[i], err = parseCronField(spec, ranges[i][0], ranges[i][1]); err != nil {
+			return fmt.Errorf("invalid cron spec '%s' : %s", w.Cron, err)
+		}
+	}
+	w.anyDay = strings.HasPrefix(fields[2], "*")
+	w.anyWeekday = strings.HasPrefix(fields[4], "*")
+	// Sunday is both 0 and 7
+	if w.weekdays[7] {
+		w.weekdays[0] = true
+	}
+
+	if w.duration, err = time.ParseDuration(w.Duration); err != nil {
+		return fmt.Errorf("invalid duration '%s' : %s", w.Duration, err)
+	}
+	if w.duration <= 0 || w.duration > maxWindowDuration {
+		return fmt.Errorf("duration '%s' must be positive and at most %s", w.Duration, maxWindowDuration)
+	}
+
+	w.location = time.Local
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("invalid time zone '%s' : %s", w.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// starts returns true if the window opens at the given minute
+func (w *MaintenanceWindow) starts(t time.Time) bool {
+	if !w.minutes[t.Minute()] || !w.hours[t.Hour()] || !w.months[int(t.Month())] {
+		return false
+	}
+	day, weekday := w.days[t.Day()], w.weekdays[int(t.Weekday())]
+	if w.anyDay || w.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Open returns true if the window is open at the given time
+func (w *MaintenanceWindow) Open(now time.Time) bool {
+	t := now.In(w.location).Truncate(time.Minute)
+	for start := t; now.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.starts(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the next time after the given time at which the window
+// opens, or the zero time if it does not open within a year
+func (w *MaintenanceWindow) Next(now time.Time) time.Time {
+	t := now.In(w.location).Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(1, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if w.starts(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// MaintenanceSchedule determines the maintenance window of a node, selected
+// by a MAAS tag on the node, by the node's zone or finally the default.
+// Disruptive actions are only taken on a node while its window is open, and
+// on nodes for which no window is selected at any time.
+type MaintenanceSchedule struct {
+	Windows map[string]*MaintenanceWindow `json:"windows,omitempty"`
+	Default string                        `json:"default,omitempty"`
+	Tags    map[string]string             `json:"tags,omitempty"`
+	Zones   map[string]string             `json:"zones,omitempty"`
+}
+
+// Load parses the windows and verifies that every window that can be
+// selected exists
+func (s *MaintenanceSchedule) Load() error {
+	for name, window := range s.Windows {
+		if window == nil {
+			return fmt.Errorf("maintenance window '%s' is empty", name)
+		}
+		if err := window.load(); err != nil {
+			return fmt.Errorf("invalid maintenance window '%s' : %s", name, err)
+		}
+	}
+	if _, ok := s.Windows[s.Default]; s.Default != "" && !ok {
+		return fmt.Errorf("unknown maintenance window '%s' selected as default", s.Default)
+	}
+	for kind, selection := range map[string]map[string]string{"tag": s.Tags, "zone": s.Zones} {
+		for key, window := range selection {
+			if _, ok := s.Windows[window]; !ok {
+				return fmt.Errorf("unknown maintenance window '%s' selected for %s '%s'", window, kind, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Window returns the name and maintenance window selected for the given
+// node, or nil if none is selected
+func (s *MaintenanceSchedule) Window(node MaasNode) (string, *MaintenanceWindow) {
+	if s == nil {
+		return "", nil
+	}
+	for _, tag := range node.Tags() {
+		if name, ok := s.Tags[tag]; ok {
+			return name, s.Windows[name]
+		}
+	}
+	if name, ok := s.Zones[node.Zone()]; ok {
+		return name, s.Windows[name]
+	}
+	if s.Default != "" {
+		return s.Default, s.Windows[s.Default]
+	}
+	return "", nil
+}
+
+// timeNow the clock against which maintenance windows are checked
+var timeNow = time.Now
+
+// deferDisruptive returns a BlockedError, deferring the named disruptive
+// action, if the maintenance window of the node is not open. The deferral is
+// recorded so that it is shown in the status of the node.
+func deferDisruptive(node MaasNode, options ProcessingOptions, action string) error {
+	name, window := options.Maintenance.Window(node)
+	now := timeNow()
+	if window == nil || window.Open(now) {
+		options.Tracker.SetDeferred(node.ID(), "")
+		return nil
+	}
+
+	reason := fmt.Sprintf("%s deferred until maintenance window '%s' opens", action, name)
+	if next := window.Next(now); !next.IsZero() {
+		reason += " at " + next.Format(time.RFC3339)
+	}
+	log.Infof("DEFER: %s : %s", node.Hostname(), reason)
+	options.Tracker.SetDeferred(node.ID(), reason)
+	options.Plan.Skip(node, reason)
+	return &BlockedError{Reason: reason}
+}
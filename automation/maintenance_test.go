@@ -0,0 +1,146 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+const testMaintenanceWindows = `{
+	"windows": {
+		"weeknights": {"cron": "0 22 * * 1-5", "duration": "4h", "timezone": "UTC"},
+		"sunday": {"cron": "30 2 * * 0", "duration": "1h", "timezone": "UTC"},
+		"monthly": {"cron": "0 2 1 * *", "duration": "1h", "timezone": "UTC"},
+		"monthly-or-sunday": {"cron": "0 2 1 * 0", "duration": "1h", "timezone": "UTC"}
+	},
+	"default": "weeknights",
+	"tags": {"lab": "sunday"}
+}`
+
+func TestMaintenanceWindow(t *testing.T) {
+	schedule := &MaintenanceSchedule{}
+	if err := json.Unmarshal([]byte(testMaintenanceWindows), schedule); err != nil {
+		t.Fatalf("unable to parse maintenance windows : %s", err)
+	}
+	if err := schedule.Load(); err != nil {
+		t.Fatalf("invalid maintenance windows : %s", err)
+	}
+
+	// 2016-06-06 is a Monday
+	at := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339, s)
+		return t
+	}
+	cases := []struct {
+		window string
+		now    string
+		open   bool
+		next   string
+	}{
+		{"weeknights", "2016-06-06T21:59:00Z", false, "2016-06-06T22:00:00Z"},
+		{"weeknights", "2016-06-06T22:00:00Z", true, "2016-06-07T22:00:00Z"},
+		{"weeknights", "2016-06-07T01:59:59Z", true, "2016-06-07T22:00:00Z"},
+		{"weeknights", "2016-06-07T02:00:00Z", false, "2016-06-07T22:00:00Z"},
+		{"weeknights", "2016-06-11T01:00:00Z", true, "2016-06-13T22:00:00Z"},
+		{"weeknights", "2016-06-11T22:30:00Z", false, "2016-06-13T22:00:00Z"},
+		{"sunday", "2016-06-12T03:00:00Z", true, "2016-06-19T02:30:00Z"},
+		{"monthly", "2016-06-06T00:00:00Z", false, "2016-07-01T02:00:00Z"},
+		// As in cron, the 1st of the month or any Sunday
+		{"monthly-or-sunday", "2016-06-06T00:00:00Z", false, "2016-06-12T02:00:00Z"},
+		{"monthly-or-sunday", "2016-06-30T12:00:00Z", false, "2016-07-01T02:00:00Z"},
+		{"monthly-or-sunday", "2016-07-01T02:30:00Z", true, "2016-07-03T02:00:00Z"},
+	}
+	for _, c := range cases {
+		window := schedule.Windows[c.window]
+		now := at(c.now)
+		if open := window.Open(now); open != c.open {
+			t.Errorf("expected window '%s' open at %s to be %t", c.window, c.now, c.open)
+		}
+		if next := window.Next(now); !next.Equal(at(c.next)) {
+			t.Errorf("expected window '%s' after %s to next open at %s, got %s", c.window, c.now, c.next, next)
+		}
+	}
+
+	for _, spec := range []string{
+		`{"windows": {"w": {"cron": "0 22 * *", "duration": "1h"}}}`,
+		`{"windows": {"w": {"cron": "60 22 * * *", "duration": "1h"}}}`,
+		`{"windows": {"w": {"cron": "0 22 * * 5-1", "duration": "1h"}}}`,
+		`{"windows": {"w": {"cron": "*/0 * * * *", "duration": "1h"}}}`,
+		`{"windows": {"w": {"cron": "0 22 * * *", "duration": "forever"}}}`,
+		`{"windows": {"w": {"cron": "0 22 * * *", "duration": "1h", "timezone": "Nowhere/Special"}}}`,
+		`{"windows": {"w": {"cron": "0 22 * * *", "duration": "1h"}}, "zones": {"default": "x"}}`,
+	} {
+		invalid := &MaintenanceSchedule{}
+		if err := json.Unmarshal([]byte(spec), invalid); err != nil {
+			t.Fatalf("unable to parse maintenance windows '%s' : %s", spec, err)
+		}
+		if err := invalid.Load(); err == nil {
+			t.Errorf("expected maintenance windows '%s' to be invalid", spec)
+		}
+	}
+}
+
+func TestDeferDisruptiveActions(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+
+	server.AddNode(maasfake.Node{SystemID: "allocated", Hostname: "allocated", Status: maasfake.Allocated})
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Maintenance = &MaintenanceSchedule{}
+	if err := json.Unmarshal([]byte(testMaintenanceWindows), options.Maintenance); err != nil {
+		t.Fatalf("unable to parse maintenance windows : %s", err)
+	}
+	if err := options.Maintenance.Load(); err != nil {
+		t.Fatalf("invalid maintenance windows : %s", err)
+	}
+	defer func() { timeNow = time.Now }()
+
+	process := func(now string) {
+		timeNow = func() time.Time {
+			t, _ := time.Parse(time.RFC3339, now)
+			return t
+		}
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+	}
+
+	process("2016-06-06T12:00:00Z")
+	if node, _ := server.Node("allocated"); node.Status != maasfake.Allocated {
+		t.Errorf("expected deploy to be deferred, got status %d", node.Status)
+	}
+	state := options.Tracker.Get("allocated")
+	if !strings.Contains(state.Deferred, "2016-06-06T22:00:00Z") {
+		t.Errorf("expected deferral until the window opens, got '%s'", state.Deferred)
+	}
+	if state.Failures != 0 {
+		t.Errorf("expected deferred node not to be counted as failing, got %d failures", state.Failures)
+	}
+
+	process("2016-06-06T22:15:00Z")
+	if node, _ := server.Node("allocated"); node.Status != maasfake.Deploying {
+		t.Errorf("expected node to be deployed once the window opens, got status %d", node.Status)
+	}
+	if deferred := options.Tracker.Deferred("allocated"); deferred != "" {
+		t.Errorf("expected deferral to be cleared, got '%s'", deferred)
+	}
+}
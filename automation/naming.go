@@ -0,0 +1,373 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// NameTemplate a rule that generates the hostname of a node whose MAC
+// addresses are not explicitly mapped. The rule applies to the nodes whose
+// zone and MAC addresses match the optional regular expressions.
+type NameTemplate struct {
+	Zone     string `json:"zone,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Template string `json:"template"`
+
+	zone     *regexp.Regexp
+	mac      *regexp.Regexp
+	template *template.Template
+}
+
+// NameContext the values available to a hostname template
+type NameContext struct {
+	ID       string
+	Hostname string
+	Zone     string
+	Rack     string
+	Tags     []string
+	MACs     []string
+}
+
+// nameSpec the structure of the MAC to name mappings when hostname templates
+// are used
+type nameSpec struct {
+	Names     map[string]string `json:"names,omitempty"`
+	Templates []*NameTemplate   `json:"templates,omitempty"`
+}
+
+// NameMapper determines the hostnames of nodes from explicit MAC address to
+// name mappings and, for MAC addresses that are not mapped, from hostname
+// templates. When the mappings are loaded from a file they can be reloaded
+// when the file changes. All methods may be invoked on a nil mapper, in which
+// case no node is renamed.
+type NameMapper struct {
+	file string
+
+	mutex     sync.RWMutex
+	modTime   time.Time
+	names     map[string]string
+	templates []*NameTemplate
+
+	// the outcome of the last assignment of names to all nodes
+	assigned map[string]string
+	refused  map[string]string
+	owners   map[string]string
+}
+
+var rackTag = regexp.MustCompile("^rack[-_]?(.+)$")
+var validHostname = regexp.MustCompile("^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?$")
+
+var nameFuncs = template.FuncMap{
+	// short the last three octets of a MAC address, without separators
+	"short": func(mac string) string {
+		hex := strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+		if len(hex) > 6 {
+			hex = hex[len(hex)-6:]
+		}
+		return hex
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// NewNameMapper creates a mapper from the given specification, which is
+// either the mappings or a @ followed by the name of the file that contains
+// them
+func NewNameMapper(spec string) (*NameMapper, error) {
+	m := &NameMapper{}
+	if strings.HasPrefix(spec, "@") {
+		m.file = os.ExpandEnv(spec[1:])
+		if _, err := m.Reload(); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	names, templates, err := parseNameSpec([]byte(spec))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse mac name mapping: '%s' : %s", spec, err)
+	}
+	m.names, m.templates = names, templates
+	return m, nil
+}
+
+// parseNameSpec parses the mappings, which are either a flat JSON object of
+// MAC addresses to names or an object with "names" and "templates"
+func parseNameSpec(data []byte) (map[string]string, []*NameTemplate, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	spec := nameSpec{}
+	_, hasNames := raw["names"]
+	_, hasTemplates := raw["templates"]
+	if hasNames || hasTemplates {
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, nil, err
+		}
+	} else if err := json.Unmarshal(data, &spec.Names); err != nil {
+		return nil, nil, err
+	}
+
+	names := make(map[string]string, len(spec.Names))
+	for mac, name := range spec.Names {
+		names[strings.ToLower(mac)] = name
+	}
+	for i, t := range spec.Templates {
+		if t == nil || t.Template == "" {
+			return nil, nil, fmt.Errorf("hostname template %d is empty", i)
+		}
+		var err error
+		if t.Zone != "" {
+			if t.zone, err = regexp.Compile(t.Zone); err != nil {
+				return nil, nil, fmt.Errorf("invalid zone expression '%s' : %s", t.Zone, err)
+			}
+		}
+		if t.MAC != "" {
+			if t.mac, err = regexp.Compile(t.MAC); err != nil {
+				return nil, nil, fmt.Errorf("invalid MAC expression '%s' : %s", t.MAC, err)
+			}
+		}
+		if t.template, err = template.New(fmt.Sprintf("template-%d", i)).Funcs(nameFuncs).Option("missingkey=error").Parse(t.Template); err != nil {
+			return nil, nil, fmt.Errorf("unable to parse hostname template '%s' : %s", t.Template, err)
+		}
+	}
+	return names, spec.Templates, nil
+}
+
+// Reload reloads the mappings from their file if it has changed since it was
+// last loaded, returning true if it was reloaded. If the file cannot be
+// parsed the previous mappings remain in effect.
+func (m *NameMapper) Reload() (bool, error) {
+	if m == nil || m.file == "" {
+		return false, nil
+	}
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return false, fmt.Errorf("unable to open file '%s' to load the mac name mapping : %s", m.file, err)
+	}
+	m.mutex.RLock()
+	unchanged := info.ModTime().Equal(m.modTime)
+	m.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(m.file)
+	if err != nil {
+		return false, fmt.Errorf("unable to open file '%s' to load the mac name mapping : %s", m.file, err)
+	}
+	names, templates, err := parseNameSpec(data)
+
+	// Remember the version of the file even if it is invalid, so that the
+	// error is only reported once per change
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.modTime = info.ModTime()
+	if err != nil {
+		return false, fmt.Errorf("unable to parse mac name mapping from file '%s' : %s", m.file, err)
+	}
+	m.names, m.templates = names, templates
+	return true, nil
+}
+
+// Watch checks the file from which the mappings were loaded for changes at
+// the given interval, reloading them when it changes
+func (m *NameMapper) Watch(interval time.Duration) {
+	if m == nil || m.file == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			reloaded, err := m.Reload()
+			if err != nil {
+				log.Errorf("Unable to reload MAC to hostname mappings, keeping the previous mappings : %s", err)
+			} else if reloaded {
+				log.Infof("Reloaded MAC to hostname mappings from '%s'", m.file)
+			}
+		}
+	}()
+}
+
+// Name returns the hostname to which the given node should be renamed, from
+// the explicit mapping of one of its MAC addresses or, failing that, the
+// first template that applies to it. The empty string is returned if no
+// mapping or template applies.
+func (m *NameMapper) Name(node MaasNode) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	macs := node.MACs()
+	for _, mac := range macs {
+		if name, ok := m.names[strings.ToLower(mac)]; ok {
+			return name, nil
+		}
+	}
+	if len(macs) == 0 {
+		return "", nil
+	}
+
+	for _, t := range m.templates {
+		if t.zone != nil && !t.zone.MatchString(node.Zone()) {
+			continue
+		}
+		if t.mac != nil && !matchesAny(t.mac, macs) {
+			continue
+		}
+		context := NameContext{
+			ID:       node.ID(),
+			Hostname: node.Hostname(),
+			Zone:     node.Zone(),
+			Tags:     node.Tags(),
+			MACs:     macs,
+		}
+		for _, tag := range context.Tags {
+			if match := rackTag.FindStringSubmatch(tag); match != nil {
+				context.Rack = match[1]
+				break
+			}
+		}
+		var buf bytes.Buffer
+		if err := t.template.Execute(&buf, context); err != nil {
+			return "", fmt.Errorf("unable to generate hostname from template '%s' : %s", t.Template, err)
+		}
+		name := buf.String()
+		if !validHostname.MatchString(name) {
+			return "", fmt.Errorf("template '%s' generated the invalid hostname '%s'", t.Template, name)
+		}
+		return name, nil
+	}
+	return "", nil
+}
+
+func matchesAny(r *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if r.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortName the hostname of a node without its domain
+func shortName(node MaasNode) string {
+	name := node.Hostname()
+	if i := strings.IndexRune(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// Assign determines the hostnames of all the given nodes, refusing to rename
+// any node to a name that would also be used by another node, whether by its
+// current name or after it is renamed
+func (m *NameMapper) Assign(nodes []MaasNode) {
+	if m == nil {
+		return
+	}
+	assigned := make(map[string]string)
+	refused := make(map[string]string)
+	owners := make(map[string]string)
+	users := make(map[string][]string)
+
+	for _, node := range nodes {
+		current := shortName(node)
+		name, err := m.Name(node)
+		if err != nil {
+			refused[node.ID()] = err.Error()
+			name = ""
+		}
+		if name == "" {
+			name = current
+		} else if name != current {
+			assigned[node.ID()] = name
+		}
+		users[name] = append(users[name], node.Hostname())
+		owners[name] = node.ID()
+	}
+
+	for id, name := range assigned {
+		if len(users[name]) > 1 {
+			sort.Strings(users[name])
+			refused[id] = fmt.Sprintf("hostname '%s' would be used by more than one node %v", name, users[name])
+			delete(assigned, id)
+			log.Errorf("Refusing to rename node '%s' : %s", id, refused[id])
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.assigned, m.refused, m.owners = assigned, refused, owners
+}
+
+// Target returns the hostname to which the given node should be renamed, or
+// the empty string if it should keep its name. An error is returned if the
+// node must not be renamed because the name is, or would be, used by another
+// node.
+func (m *NameMapper) Target(node MaasNode) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	m.mutex.RLock()
+	reason, isRefused := m.refused[node.ID()]
+	name, isAssigned := m.assigned[node.ID()]
+	seen := m.owners != nil && (isRefused || isAssigned || m.owners[shortName(node)] == node.ID())
+	m.mutex.RUnlock()
+
+	switch {
+	case isRefused:
+		return "", fmt.Errorf("%s", reason)
+	case isAssigned:
+		return name, nil
+	case seen:
+		return "", nil
+	}
+
+	// The node was not part of the last assignment, so check its name
+	// against those of the nodes that were
+	name, err := m.Name(node)
+	if err != nil || name == "" || name == shortName(node) {
+		return "", err
+	}
+	m.mutex.RLock()
+	owner, taken := m.owners[name]
+	m.mutex.RUnlock()
+	if taken && owner != node.ID() {
+		return "", fmt.Errorf("hostname '%s' is used by node '%s'", name, owner)
+	}
+	return name, nil
+}
+
+// MarshalJSON returns the mappings in effect
+func (m *NameMapper) MarshalJSON() ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if len(m.templates) == 0 {
+		return json.Marshal(m.names)
+	}
+	return json.Marshal(nameSpec{Names: m.names, Templates: m.templates})
+}
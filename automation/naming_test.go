@@ -0,0 +1,145 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+func namingNode(id, hostname, zone, mac string, tags ...string) maasfake.Node {
+	return maasfake.Node{
+		SystemID: id,
+		Hostname: hostname,
+		Status:   maasfake.Deployed,
+		Zone:     zone,
+		Tags:     tags,
+		Interfaces: []maasfake.Interface{{
+			Name: "eth0",
+			MAC:  mac,
+		}},
+	}
+}
+
+func TestNameMapperTargets(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	server.AddNode(namingNode("a", "node-a", "east", "00:00:00:aa:bb:01", "rack-3"))
+	server.AddNode(namingNode("b", "node-b", "east", "00:00:00:aa:bb:02"))
+	server.AddNode(namingNode("c", "node-c", "west", "00:00:00:aa:bb:03"))
+	server.AddNode(namingNode("d", "node-d", "west", "00:00:00:aa:bb:04"))
+	server.AddNode(namingNode("e", "compute-1", "west", "00:00:00:aa:bb:05"))
+
+	mapper, err := NewNameMapper(`{
+		"names": {
+			"00:00:00:AA:BB:03": "spare",
+			"00:00:00:aa:bb:04": "spare",
+			"00:00:00:aa:bb:02": "compute-1"
+		},
+		"templates": [
+			{"zone": "^east$", "template": "{{.Zone}}-r{{.Rack}}-{{index .MACs 0 | short}}"}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("unable to create mapper : %s", err)
+	}
+
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	mapper.Assign(nodes)
+
+	cases := []struct {
+		id      string
+		name    string
+		refused bool
+	}{
+		{id: "a", name: "east-r3-aabb01"},
+		{id: "b", refused: true},
+		{id: "c", refused: true},
+		{id: "d", refused: true},
+		{id: "e"},
+	}
+	for i, c := range cases {
+		name, err := mapper.Target(nodes[i])
+		if (err != nil) != c.refused {
+			t.Errorf("node '%s': expected refused to be %t, got error %v", c.id, c.refused, err)
+		}
+		if name != c.name {
+			t.Errorf("node '%s': expected name '%s', got '%s'", c.id, c.name, name)
+		}
+	}
+}
+
+func TestNameMapperReload(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	server.AddNode(namingNode("a", "node-a", "default", "00:00:00:aa:bb:01"))
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "naming")
+	if err != nil {
+		t.Fatalf("unable to create directory : %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mappings.json")
+	if err := ioutil.WriteFile(file, []byte(`{"00:00:00:aa:bb:01": "first"}`), 0644); err != nil {
+		t.Fatalf("unable to write mappings : %s", err)
+	}
+
+	mapper, err := NewNameMapper("@" + file)
+	if err != nil {
+		t.Fatalf("unable to create mapper : %s", err)
+	}
+	if name, _ := mapper.Name(nodes[0]); name != "first" {
+		t.Errorf("expected name 'first', got '%s'", name)
+	}
+
+	modified := time.Now()
+	update := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write mappings : %s", err)
+		}
+		modified = modified.Add(time.Minute)
+		os.Chtimes(file, modified, modified)
+	}
+
+	if reloaded, err := mapper.Reload(); reloaded || err != nil {
+		t.Errorf("expected unchanged mappings not to be reloaded, got %t, %v", reloaded, err)
+	}
+	update(`{"00:00:00:aa:bb:01": "second"}`)
+	if reloaded, err := mapper.Reload(); !reloaded || err != nil {
+		t.Errorf("expected the mappings to be reloaded, got %t, %v", reloaded, err)
+	}
+	if name, _ := mapper.Name(nodes[0]); name != "second" {
+		t.Errorf("expected name 'second', got '%s'", name)
+	}
+
+	update(`{"00:00:00:aa:bb:01": `)
+	if _, err := mapper.Reload(); err == nil {
+		t.Errorf("expected invalid mappings to be reported")
+	}
+	if name, _ := mapper.Name(nodes[0]); name != "second" {
+		t.Errorf("expected the previous mappings to be kept, got '%s'", name)
+	}
+}
@@ -0,0 +1,623 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// LinkPolicy a link of an interface to a subnet, identified by its CIDR. The
+// mode is one of dhcp, static, auto or link_up. Static links are given the
+// address of the node in Addresses, by hostname or system ID, or an address
+// chosen by MAAS if the node has none.
+type LinkPolicy struct {
+	Subnet    string            `json:"subnet,omitempty"`
+	Mode      string            `json:"mode"`
+	Addresses map[string]string `json:"addresses,omitempty"`
+
+	// the address of a static link that is kept as it is
+	ip string
+}
+
+// InterfacePolicy the desired configuration of an interface. Physical
+// interfaces must exist on the node, while bond, vlan and bridge interfaces
+// are created over their parents if they do not.
+type InterfacePolicy struct {
+	Name     string        `json:"name,omitempty"`
+	Type     string        `json:"type,omitempty"`
+	Parents  []string      `json:"parents,omitempty"`
+	VLAN     int           `json:"vlan,omitempty"`
+	BondMode string        `json:"bond_mode,omitempty"`
+	Links    []*LinkPolicy `json:"links,omitempty"`
+}
+
+// NetworkPolicy the desired configuration of the interfaces of a node.
+// Interfaces that are not part of the policy are left as they are.
+type NetworkPolicy struct {
+	Interfaces []*InterfacePolicy `json:"interfaces"`
+}
+
+// NetworkPolicies the network policies by node role
+type NetworkPolicies map[string]*NetworkPolicy
+
+var linkModes = map[string]bool{
+	"dhcp":    true,
+	"static":  true,
+	"auto":    true,
+	"link_up": true,
+}
+
+// Load verifies the policies, normalizing the interface types and link
+// modes and naming vlan interfaces that are not explicitly named
+func (p NetworkPolicies) Load() error {
+	for role, policy := range p {
+		if policy == nil {
+			return fmt.Errorf("network policy of role '%s' is empty", role)
+		}
+		if err := policy.load(); err != nil {
+			return fmt.Errorf("invalid network policy of role '%s' : %s", role, err)
+		}
+	}
+	return nil
+}
+
+func (p *NetworkPolicy) load() error {
+	defined := map[string]bool{}
+	for i, iface := range p.Interfaces {
+		if iface == nil {
+			return fmt.Errorf("interface %d is empty", i)
+		}
+		iface.Type = strings.ToLower(iface.Type)
+		if iface.Type == "" {
+			iface.Type = "physical"
+		}
+		switch iface.Type {
+		case "physical":
+			if len(iface.Parents) != 0 {
+				return fmt.Errorf("physical interface '%s' cannot have parents", iface.Name)
+			}
+		case "bond":
+			if len(iface.Parents) == 0 {
+				return fmt.Errorf("bond '%s' has no parents", iface.Name)
+			}
+		case "vlan":
+			if len(iface.Parents) != 1 || iface.VLAN <= 0 {
+				return fmt.Errorf("vlan interface %d requires a single parent and a vlan", i)
+			}
+			if iface.Name == "" {
+				iface.Name = fmt.Sprintf("%s.%d", iface.Parents[0], iface.VLAN)
+			}
+		case "bridge":
+			if len(iface.Parents) != 1 {
+				return fmt.Errorf("bridge '%s' requires a single parent", iface.Name)
+			}
+		default:
+			return fmt.Errorf("unknown type '%s' of interface '%s'", iface.Type, iface.Name)
+		}
+		if iface.Name == "" {
+			return fmt.Errorf("interface %d has no name", i)
+		}
+		if defined[iface.Name] {
+			return fmt.Errorf("interface '%s' is defined more than once", iface.Name)
+		}
+		for _, link := range iface.Links {
+			if link == nil {
+				return fmt.Errorf("link of interface '%s' is empty", iface.Name)
+			}
+			link.Mode = strings.ToLower(link.Mode)
+			if !linkModes[link.Mode] {
+				return fmt.Errorf("unknown link mode '%s' on interface '%s'", link.Mode, iface.Name)
+			}
+			if link.Subnet == "" && link.Mode != "link_up" {
+				return fmt.Errorf("%s link on interface '%s' has no subnet", link.Mode, iface.Name)
+			}
+			if len(link.Addresses) > 0 && link.Mode != "static" {
+				return fmt.Errorf("%s link on interface '%s' cannot have addresses", link.Mode, iface.Name)
+			}
+		}
+		defined[iface.Name] = true
+	}
+
+	// Parents that are part of the policy must be configured first
+	for i, iface := range p.Interfaces {
+		for _, parent := range iface.Parents {
+			for _, later := range p.Interfaces[i:] {
+				if later.Name == parent {
+					return fmt.Errorf("parent '%s' of interface '%s' must be defined before it", parent, iface.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Policy returns the network policy of the given role, or nil if there is
+// none
+func (p NetworkPolicies) Policy(role string) *NetworkPolicy {
+	if role == "" {
+		return nil
+	}
+	return p[role]
+}
+
+// nodeLink a link of an interface of a node, as reported by MAAS
+type nodeLink struct {
+	ID     string
+	Mode   string
+	Subnet string
+	IP     string
+}
+
+// nodeInterface an interface of a node, as reported by MAAS
+type nodeInterface struct {
+	ID        string
+	Name      string
+	Type      string
+	Parents   []string
+	Fabric    string
+	LinkSpeed int
+	Links     []nodeLink
+}
+
+// jsonString returns the string value of a key of a MAAS object, or the
+// empty string if it is not set
+func jsonString(m map[string]maas.JSONObject, key string) string {
+	if value, ok := m[key]; ok && !value.IsNil() {
+		if s, err := value.GetString(); err == nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// jsonID returns the numeric ID of a MAAS object as a string
+func jsonID(m map[string]maas.JSONObject) (string, error) {
+	value, ok := m["id"]
+	if !ok {
+		return "", fmt.Errorf("object has no ID")
+	}
+	id, err := value.GetFloat64()
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(int(id)), nil
+}
+
+// parseInterface converts an interface object returned by MAAS
+func parseInterface(obj maas.JSONObject) (*nodeInterface, error) {
+	ifcMap, err := obj.GetMap()
+	if err != nil {
+		return nil, err
+	}
+	iface := &nodeInterface{
+		Name: jsonString(ifcMap, "name"),
+		Type: jsonString(ifcMap, "type"),
+	}
+	if iface.ID, err = jsonID(ifcMap); err != nil {
+		return nil, err
+	}
+	if vlan, ok := ifcMap["vlan"]; ok && !vlan.IsNil() {
+		if vlanMap, err := vlan.GetMap(); err == nil {
+			iface.Fabric = jsonString(vlanMap, "fabric")
+		}
+	}
+	if speed, ok := ifcMap["link_speed"]; ok && !speed.IsNil() {
+		if value, err := speed.GetFloat64(); err == nil {
+			iface.LinkSpeed = int(value)
+		}
+	}
+	if parents, ok := ifcMap["parents"]; ok && !parents.IsNil() {
+		parentArray, err := parents.GetArray()
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parentArray {
+			name, err := parent.GetString()
+			if err != nil {
+				return nil, err
+			}
+			iface.Parents = append(iface.Parents, name)
+		}
+	}
+
+	links, ok := ifcMap["links"]
+	if !ok {
+		return iface, nil
+	}
+	linkArray, err := links.GetArray()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range linkArray {
+		linkMap, err := link.GetMap()
+		if err != nil {
+			return nil, err
+		}
+		current := nodeLink{
+			Mode: strings.ToLower(jsonString(linkMap, "mode")),
+			IP:   jsonString(linkMap, "ip_address"),
+		}
+		if current.ID, err = jsonID(linkMap); err != nil {
+			return nil, err
+		}
+		if subnet, ok := linkMap["subnet"]; ok && !subnet.IsNil() {
+			subnetMap, err := subnet.GetMap()
+			if err != nil {
+				return nil, err
+			}
+			current.Subnet = jsonString(subnetMap, "cidr")
+		}
+		iface.Links = append(iface.Links, current)
+	}
+	return iface, nil
+}
+
+// dhcpPolicy the network policy of nodes whose role has none, which keeps
+// the current configuration except that links to a subnet in auto mode are
+// changed to DHCP, as required by MAAS before a node is acquired
+func dhcpPolicy(current []*nodeInterface) *NetworkPolicy {
+	policy := &NetworkPolicy{}
+	for _, iface := range current {
+		auto := false
+		links := []*LinkPolicy{}
+		for _, link := range iface.Links {
+			mode := link.Mode
+			if mode == "auto" && link.Subnet != "" {
+				mode = "dhcp"
+				auto = true
+			}
+			desired := &LinkPolicy{Subnet: link.Subnet, Mode: mode}
+			if link.Mode == "static" {
+				desired.ip = link.IP
+			}
+			links = append(links, desired)
+		}
+		if auto {
+			policy.Interfaces = append(policy.Interfaces, &InterfacePolicy{
+				Name:  iface.Name,
+				Type:  iface.Type,
+				Links: links,
+			})
+		}
+	}
+	return policy
+}
+
+// address returns the static address of the node on a link, if any
+func (l *LinkPolicy) address(node MaasNode) string {
+	if l.ip != "" {
+		return l.ip
+	}
+	if ip, ok := l.Addresses[shortName(node)]; ok {
+		return ip
+	}
+	return l.Addresses[node.ID()]
+}
+
+// matches returns true if the current link satisfies the desired link
+func (l *LinkPolicy) matches(node MaasNode, current nodeLink) bool {
+	if l.Mode != current.Mode || l.Subnet != current.Subnet {
+		return false
+	}
+	if ip := l.address(node); l.Mode == "static" && ip != "" {
+		return ip == current.IP
+	}
+	return true
+}
+
+// networkReconciler moves the interfaces of a node toward a network policy
+type networkReconciler struct {
+	client  *maas.MAASObject
+	ifaces  *maas.MAASObject
+	node    MaasNode
+	options ProcessingOptions
+	current map[string]*nodeInterface
+	changes []string
+}
+
+// nodeResource returns the named resource of a node, such as its interfaces
+// or block devices. Unlike the nodes themselves, these are managed through the
+// nodes collection in all API versions.
+func nodeResource(client *maas.MAASObject, node MaasNode, name string) *maas.MAASObject {
+	obj := client.GetSubObject("nodes").GetSubObject(node.ID()).GetSubObject(name)
+	return &obj
+}
+
+// fetchInterfaces fetches the interfaces of a node
+func fetchInterfaces(client *maas.MAASObject, node MaasNode) ([]*nodeInterface, error) {
+	ifcsListObj, err := nodeResource(client, node, "interfaces").CallGet("", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	ifcsArray, err := ifcsListObj.GetArray()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*nodeInterface, 0, len(ifcsArray))
+	for _, ifc := range ifcsArray {
+		iface, err := parseInterface(ifc)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, iface)
+	}
+	return list, nil
+}
+
+// configureNetwork fetches the interfaces of a node and changes them to
+// match the network policy of the node's role. Only the differences between
+// the policy and the current configuration are applied, so the policy can be
+// applied repeatedly. In preview mode the changes are only reported.
+func configureNetwork(client *maas.MAASObject, node MaasNode, options ProcessingOptions) ([]string, error) {
+	list, err := fetchInterfaces(client, node)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &networkReconciler{
+		client:  client,
+		ifaces:  nodeResource(client, node, "interfaces"),
+		node:    node,
+		options: options,
+		current: make(map[string]*nodeInterface),
+	}
+	for _, iface := range list {
+		r.current[iface.Name] = iface
+	}
+
+	role := options.Roles.Role(node)
+	policy := options.Networks.Policy(role)
+	if policy == nil {
+		policy = dhcpPolicy(list)
+	}
+	for _, desired := range policy.Interfaces {
+		if err := r.reconcile(desired); err != nil {
+			return r.changes, fmt.Errorf("unable to apply network policy of role '%s' to interface '%s' : %s",
+				role, desired.Name, err)
+		}
+	}
+	return r.changes, nil
+}
+
+// change records and logs a change, returning true if it should be made
+func (r *networkReconciler) change(format string, v ...interface{}) bool {
+	change := fmt.Sprintf(format, v...)
+	log.Infof("NETWORK '%s' : %s", r.node.Hostname(), change)
+	r.changes = append(r.changes, change)
+	r.options.Plan.Network(r.node, change)
+	return !r.options.Preview
+}
+
+// reconcile moves a single interface toward its desired configuration
+func (r *networkReconciler) reconcile(desired *InterfacePolicy) error {
+	iface, ok := r.current[desired.Name]
+	if !ok {
+		var err error
+		if iface, err = r.create(desired); err != nil {
+			return err
+		}
+	} else if desired.Type != "physical" || iface.Type != "" {
+		if iface.Type != desired.Type {
+			return fmt.Errorf("interface is a %s, not a %s", iface.Type, desired.Type)
+		}
+		if desired.Type != "vlan" && !sameNames(iface.Parents, desired.Parents) {
+			return fmt.Errorf("interface has parents %v, not %v", iface.Parents, desired.Parents)
+		}
+	}
+
+	// Remove the links that are not desired, then add those that are
+	// missing
+	missing := append([]*LinkPolicy{}, desired.Links...)
+	for _, link := range iface.Links {
+		found := false
+		for i, want := range missing {
+			if want.matches(r.node, link) {
+				missing = append(missing[:i], missing[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found && r.change("unlink %s from %s (%s)", iface.Name, describeSubnet(link.Subnet), link.Mode) {
+			params := url.Values{"id": []string{link.ID}}
+			_, err := r.ifaces.GetSubObject(iface.ID).CallPost("unlink_subnet", params)
+			r.options.Audit.Record(r.node, "unlink_subnet", withInterface(params, iface.Name), err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, link := range missing {
+		params := url.Values{"mode": []string{strings.ToUpper(link.Mode)}}
+		if link.Subnet != "" {
+			params.Set("subnet", link.Subnet)
+		}
+		description := link.Mode
+		if ip := link.address(r.node); link.Mode == "static" && ip != "" {
+			params.Set("ip_address", ip)
+			description += " " + ip
+		}
+		if r.change("link %s to %s (%s)", iface.Name, describeSubnet(link.Subnet), description) {
+			_, err := r.ifaces.GetSubObject(iface.ID).CallPost("link_subnet", params)
+			r.options.Audit.Record(r.node, "link_subnet", withInterface(params, iface.Name), err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// create creates a bond, vlan or bridge interface over its parents
+func (r *networkReconciler) create(desired *InterfacePolicy) (*nodeInterface, error) {
+	if desired.Type == "physical" {
+		return nil, fmt.Errorf("node has no such interface")
+	}
+	parents := make([]string, len(desired.Parents))
+	fabric := ""
+	for i, name := range desired.Parents {
+		parent, ok := r.current[name]
+		if !ok {
+			return nil, fmt.Errorf("node has no parent interface '%s'", name)
+		}
+		parents[i] = parent.ID
+		if i == 0 {
+			fabric = parent.Fabric
+		}
+	}
+
+	// Interfaces that would be created in preview mode have no ID
+	created := &nodeInterface{Name: desired.Name, Type: desired.Type, Parents: desired.Parents}
+	r.current[desired.Name] = created
+
+	params := url.Values{}
+	var op string
+	switch desired.Type {
+	case "bond":
+		op = "create_bond"
+		params.Set("name", desired.Name)
+		params["parents"] = parents
+		if desired.BondMode != "" {
+			params.Set("bond_mode", desired.BondMode)
+		}
+	case "bridge":
+		op = "create_bridge"
+		params.Set("name", desired.Name)
+		params.Set("parent", parents[0])
+	case "vlan":
+		op = "create_vlan"
+		params.Set("parent", parents[0])
+	}
+	if !r.change("create %s %s over %s", desired.Type, desired.Name, strings.Join(desired.Parents, ",")) {
+		return created, nil
+	}
+
+	if desired.Type == "vlan" {
+		vlan, err := findVLAN(r.client, fabric, desired.VLAN)
+		if err != nil {
+			return nil, err
+		}
+		params.Set("vlan", vlan)
+	}
+	for _, parent := range parents {
+		if parent == "" {
+			return nil, fmt.Errorf("parent interface has not been created")
+		}
+	}
+	obj, err := r.ifaces.CallPost(op, params)
+	r.options.Audit.Record(r.node, op, params, err)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := parseInterface(obj)
+	if err != nil {
+		return nil, err
+	}
+	r.current[desired.Name] = iface
+	return iface, nil
+}
+
+// findVLAN returns the ID of the MAAS VLAN object with the given VLAN ID on
+// the given fabric, that of the parent of the VLAN interface, as referenced
+// by a subnet. The same VLAN ID may be used on more than one fabric, so if
+// the fabric is not known the VLAN ID must identify a single VLAN object.
+func findVLAN(client *maas.MAASObject, fabric string, vid int) (string, error) {
+	subnetsObj, err := client.GetSubObject("subnets").CallGet("", url.Values{})
+	if err != nil {
+		return "", err
+	}
+	subnets, err := subnetsObj.GetArray()
+	if err != nil {
+		return "", err
+	}
+	found := []string{}
+	for _, subnet := range subnets {
+		subnetMap, err := subnet.GetMap()
+		if err != nil {
+			return "", err
+		}
+		vlan, ok := subnetMap["vlan"]
+		if !ok {
+			continue
+		}
+		vlanMap, err := vlan.GetMap()
+		if err != nil {
+			return "", err
+		}
+		if fabric != "" && jsonString(vlanMap, "fabric") != fabric {
+			continue
+		}
+		value, ok := vlanMap["vid"]
+		if !ok {
+			continue
+		}
+		if v, err := value.GetFloat64(); err != nil || int(v) != vid {
+			continue
+		}
+		id, err := jsonID(vlanMap)
+		if err != nil {
+			return "", err
+		}
+		if !containsString(found, id) {
+			found = append(found, id)
+		}
+	}
+	switch {
+	case len(found) == 0 && fabric != "":
+		return "", fmt.Errorf("no subnet is on VLAN %d of fabric '%s'", vid, fabric)
+	case len(found) == 0:
+		return "", fmt.Errorf("no subnet is on VLAN %d", vid)
+	case len(found) > 1:
+		return "", fmt.Errorf("VLAN %d is on more than one fabric, and the fabric of the parent interface is not known", vid)
+	}
+	return found[0], nil
+}
+
+func describeSubnet(subnet string) string {
+	if subnet == "" {
+		return "no subnet"
+	}
+	return subnet
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// withInterface returns a copy of the parameters of an interface operation
+// that also names the interface, as recorded in the audit log
+func withInterface(params url.Values, name string) url.Values {
+	result := url.Values{"interface": []string{name}}
+	for k, v := range params {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+const testNetworkPolicies = `{
+	"compute": {
+		"interfaces": [
+			{"name": "eth0"},
+			{"name": "bond0", "type": "bond", "parents": ["eth0", "eth1"], "bond_mode": "802.3ad",
+			 "links": [{"subnet": "10.6.0.0/24", "mode": "static", "addresses": {"node-a": "10.6.0.21"}}]},
+			{"type": "vlan", "parents": ["bond0"], "vlan": 100,
+			 "links": [{"subnet": "10.100.0.0/24", "mode": "dhcp"}]},
+			{"name": "br0", "type": "bridge", "parents": ["bond0.100"], "links": [{"mode": "link_up"}]}
+		]
+	}
+}`
+
+func newNetworkTestOptions(t *testing.T) ProcessingOptions {
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Roles = &RoleSelector{Default: "compute"}
+	if err := json.Unmarshal([]byte(testNetworkPolicies), &options.Networks); err != nil {
+		t.Fatalf("unable to parse network policies : %s", err)
+	}
+	if err := options.Networks.Load(); err != nil {
+		t.Fatalf("invalid network policies : %s", err)
+	}
+	return options
+}
+
+func TestConfigureNetwork(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	// VLAN 100 is also used on another fabric than that of the node's
+	// interfaces, and is listed first
+	server.AddFabricSubnet("storage100", "10.200.0.0/24", "fabric-storage", 100)
+	server.AddSubnet("vlan100", "10.100.0.0/24", 100)
+	id := server.AddNode(maasfake.Node{
+		Hostname: "node-a",
+		Status:   maasfake.Ready,
+		Interfaces: []maasfake.Interface{
+			testInterface("auto"),
+			{Name: "eth1", MAC: "00:11:22:33:44:56"},
+		},
+	})
+	options := newNetworkTestOptions(t)
+
+	node, err := fetchNode(client, MaasAPIv1, id)
+	if err != nil {
+		t.Fatalf("unable to fetch node : %s", err)
+	}
+
+	// Preview reports the changes without making them
+	options.Preview = true
+	changes, err := configureNetwork(client, node, options)
+	if err != nil {
+		t.Fatalf("unable to preview network policy : %s", err)
+	}
+	expected := []string{
+		"unlink eth0 from 10.6.0.0/24 (auto)",
+		"create bond bond0 over eth0,eth1",
+		"link bond0 to 10.6.0.0/24 (static 10.6.0.21)",
+		"create vlan bond0.100 over bond0",
+		"link bond0.100 to 10.100.0.0/24 (dhcp)",
+		"create bridge br0 over bond0.100",
+		"link br0 to no subnet (link_up)",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("expected no calls to MAAS in preview mode, got %v", calls)
+	}
+
+	options.Preview = false
+	changes, err = configureNetwork(client, node, options)
+	if err != nil {
+		t.Fatalf("unable to apply network policy : %s", err)
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+	ops := operations(server.Calls())
+	if !reflect.DeepEqual(ops, []string{"unlink_subnet", "create_bond", "link_subnet",
+		"create_vlan", "link_subnet", "create_bridge", "link_subnet"}) {
+		t.Errorf("unexpected calls to MAAS %v", ops)
+	}
+
+	maasNode, _ := server.Node(id)
+	types := map[string]string{}
+	for _, iface := range maasNode.Interfaces {
+		types[iface.Name] = iface.Type
+	}
+	if !reflect.DeepEqual(types, map[string]string{
+		"eth0": "physical", "eth1": "physical", "bond0": "bond", "bond0.100": "vlan", "br0": "bridge"}) {
+		t.Errorf("unexpected interfaces %v", types)
+	}
+
+	if _, err := findVLAN(client, "", 100); err == nil {
+		t.Errorf("expected a VLAN on more than one fabric to be ambiguous without a fabric")
+	}
+	if vlan, err := findVLAN(client, "fabric-storage", 100); err != nil || vlan == "100" {
+		t.Errorf("expected the VLAN of the other fabric to be found, got '%s' : %v", vlan, err)
+	}
+
+	// The policy is only applied once
+	server.ResetCalls()
+	changes, err = configureNetwork(client, node, options)
+	if err != nil {
+		t.Fatalf("unable to reapply network policy : %s", err)
+	}
+	if len(changes) != 0 || len(server.Calls()) != 0 {
+		t.Errorf("expected no changes when reapplying the policy, got %v", changes)
+	}
+}
+
+func TestNetworkPolicyValidation(t *testing.T) {
+	cases := []string{
+		`{"r": {"interfaces": [{"name": "eth0", "type": "team"}]}}`,
+		`{"r": {"interfaces": [{"name": "bond0", "type": "bond"}]}}`,
+		`{"r": {"interfaces": [{"type": "vlan", "parents": ["eth0"]}]}}`,
+		`{"r": {"interfaces": [{"name": "eth0", "links": [{"mode": "dhcp"}]}]}}`,
+		`{"r": {"interfaces": [{"name": "eth0", "links": [{"subnet": "10.0.0.0/8", "mode": "dhcp", "addresses": {"a": "10.0.0.1"}}]}]}}`,
+		`{"r": {"interfaces": [{"name": "br0", "type": "bridge", "parents": ["bond0"]}, {"name": "bond0", "type": "bond", "parents": ["eth0"]}]}}`,
+	}
+	for _, c := range cases {
+		policies := NetworkPolicies{}
+		if err := json.Unmarshal([]byte(c), &policies); err != nil {
+			t.Fatalf("unable to parse network policies '%s' : %s", c, err)
+		}
+		if err := policies.Load(); err == nil {
+			t.Errorf("expected network policies '%s' to be invalid", c)
+		}
+	}
+}
@@ -41,13 +41,27 @@ const (
 	FailedReleasing     MaasNodeStatus = 13
 	DiskErasing         MaasNodeStatus = 14
 	FailedDiskErasing   MaasNodeStatus = 15
+
+	// MAAS 2.x only
+	RescueMode               MaasNodeStatus = 16
+	EnteringRescueMode       MaasNodeStatus = 17
+	FailedEnteringRescueMode MaasNodeStatus = 18
+	ExitingRescueMode        MaasNodeStatus = 19
+	FailedExitingRescueMode  MaasNodeStatus = 20
+	Testing                  MaasNodeStatus = 21
+	FailedTesting            MaasNodeStatus = 22
 )
 
 var names = []string{"New", "Commissioning", "FailedCommissioning", "Missing", "Ready", "Reserved",
 	"Deployed", "Retired", "Broken", "Deploying", "Allocated", "FailedDeployment",
-	"Releasing", "FailedReleasing", "DiskErasing", "FailedDiskErasing"}
+	"Releasing", "FailedReleasing", "DiskErasing", "FailedDiskErasing",
+	"RescueMode", "EnteringRescueMode", "FailedEnteringRescueMode", "ExitingRescueMode",
+	"FailedExitingRescueMode", "Testing", "FailedTesting"}
 
 func (v MaasNodeStatus) String() string {
+	if v < 0 || int(v) >= len(names) {
+		return "Invalid"
+	}
 	return names[v]
 }
 
@@ -64,6 +78,28 @@ func FromString(name string) (MaasNodeStatus, error) {
 // MaasNode convenience wrapper for an MAAS node on top of a generic MAAS object
 type MaasNode struct {
 	maas.MAASObject
+	api *MaasAPI
+}
+
+// API get the version of the MAAS API through which the node was retrieved
+func (n *MaasNode) API() *MaasAPI {
+	if n.api == nil {
+		return MaasAPIv1
+	}
+	return n.api
+}
+
+// Status get the lifecycle status of the node
+func (n *MaasNode) Status() (MaasNodeStatus, error) {
+	api := n.API()
+	status, err := n.GetInteger(api.StatusKey)
+	if err != nil {
+		return Invalid, err
+	}
+	if status < 0 || status >= api.Statuses {
+		return Invalid, fmt.Errorf("Unknown MAAS %s node status %d", api.Version, status)
+	}
+	return MaasNodeStatus(status), nil
 }
 
 // GetString get attribute value as string
@@ -92,16 +128,29 @@ func (n *MaasNode) PowerState() string {
 	return state
 }
 
-func (n *MaasNode) UpdatePowerParameters(ptype string, params map[string]string) {
+// powerValues the values with which the power type and parameters of a node
+// are updated
+func powerValues(ptype string, params map[string]string) url.Values {
 	values := url.Values{}
 	values.Add("power_type", ptype)
 	for k, v := range params {
 		values.Add("power_parameters_"+k, v)
 	}
-	_, err := n.Update(values)
+	return values
+}
+
+func (n *MaasNode) UpdatePowerParameters(ptype string, params map[string]string) error {
+	_, err := n.Update(powerValues(ptype, params))
 	if err != nil {
 		log.Errorf("error updating power settings : %s", err.Error())
 	}
+	return err
+}
+
+// Description get the free form description of the node
+func (n *MaasNode) Description() string {
+	description, _ := n.GetString("description")
+	return description
 }
 
 // Hostname get the hostname
@@ -135,7 +184,7 @@ func (n *MaasNode) IPs() []string {
 
 // MACs get the MAC Addresses
 func (n *MaasNode) MACs() []string {
-	macsObj, _ := n.GetMap()["macaddress_set"]
+	macsObj, _ := n.GetMap()[n.API().MACsKey]
 	macs, _ := macsObj.GetArray()
 	if len(macs) == 0 {
 		return []string{}
@@ -159,6 +208,40 @@ func (n *MaasNode) Zone() string {
 	return v
 }
 
+// Architecture get the architecture, such as amd64/generic
+func (n *MaasNode) Architecture() string {
+	arch, _ := n.GetString("architecture")
+	return arch
+}
+
+// Pool get the resource pool, only available with MAAS 2.x
+func (n *MaasNode) Pool() string {
+	pool, ok := n.GetMap()["pool"]
+	if !ok {
+		return ""
+	}
+	attrs, err := pool.GetMap()
+	if err != nil {
+		return ""
+	}
+	v, _ := attrs["name"].GetString()
+	return v
+}
+
+// Tags get the names of the MAAS tags associated with the node
+func (n *MaasNode) Tags() []string {
+	tagsObj, _ := n.GetMap()["tag_names"]
+	tags, _ := tagsObj.GetArray()
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		s, err := tag.GetString()
+		if err == nil {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 // GetInteger get attribute value as integer
 func (n *MaasNode) GetInteger(key string) (int, error) {
 	v, err := n.GetMap()[key].GetFloat64()
@@ -167,3 +250,21 @@ func (n *MaasNode) GetInteger(key string) (int, error) {
 	}
 	return int(v), nil
 }
+
+// CPUCount get the number of CPU cores found when the node was commissioned
+func (n *MaasNode) CPUCount() int {
+	count, err := n.GetMap()["cpu_count"].GetFloat64()
+	if err != nil {
+		return 0
+	}
+	return int(count)
+}
+
+// Memory get the memory, in MiB, found when the node was commissioned
+func (n *MaasNode) Memory() int {
+	memory, err := n.GetMap()["memory"].GetFloat64()
+	if err != nil {
+		return 0
+	}
+	return int(memory)
+}
@@ -0,0 +1,227 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Rename a change of the hostname of a node
+type Rename struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// NodePlan the actions automation would take for a node
+type NodePlan struct {
+	ID           string             `json:"id" yaml:"id"`
+	Hostname     string             `json:"hostname" yaml:"hostname"`
+	Status       string             `json:"status" yaml:"status"`
+	Target       string             `json:"target" yaml:"target"`
+	Actions      []string           `json:"actions" yaml:"actions"`
+	Renames      []Rename           `json:"renames,omitempty" yaml:"renames,omitempty"`
+	Provisioning []ProvisionRequest `json:"provisioning,omitempty" yaml:"provisioning,omitempty"`
+	Network      []string           `json:"network,omitempty" yaml:"network,omitempty"`
+	Storage      []string           `json:"storage,omitempty" yaml:"storage,omitempty"`
+	Skipped      string             `json:"skipped,omitempty" yaml:"skipped,omitempty"`
+	Error        string             `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Plan records the actions automation would take for each node when run in
+// preview mode, so that they can be reviewed before automation is enabled.
+// All methods may be invoked on a nil plan, in which case nothing is
+// recorded.
+type Plan struct {
+	mutex sync.Mutex
+	nodes map[string]*NodePlan
+}
+
+// NewPlan creates an empty plan
+func NewPlan() *Plan {
+	return &Plan{
+		nodes: make(map[string]*NodePlan),
+	}
+}
+
+// entry returns the plan of the given node, creating it if needed. The
+// caller must hold the lock.
+func (p *Plan) entry(node MaasNode) *NodePlan {
+	plan, ok := p.nodes[node.ID()]
+	if !ok {
+		plan = &NodePlan{
+			ID:       node.ID(),
+			Hostname: node.Hostname(),
+			Actions:  []string{},
+		}
+		p.nodes[node.ID()] = plan
+	}
+	return plan
+}
+
+// Observe records the current and target state of a node
+func (p *Plan) Observe(node MaasNode, status string, target string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	plan := p.entry(node)
+	plan.Status = status
+	plan.Target = target
+}
+
+// Actions records the actions that would be taken for a node
+func (p *Plan) Actions(node MaasNode, actions []Action) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entry(node).Actions = ActionNames(actions)
+}
+
+// Skip records that a node would not be processed, and why
+func (p *Plan) Skip(node MaasNode, reason string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entry(node).Skipped = reason
+}
+
+// Invalid records that no valid transition exists for a node
+func (p *Plan) Invalid(node MaasNode, err error) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.entry(node).Error = err.Error()
+}
+
+// Rename records a change of the hostname of a node
+func (p *Plan) Rename(node MaasNode, name string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	plan := p.entry(node)
+	for _, rename := range plan.Renames {
+		if rename.To == name {
+			return
+		}
+	}
+	plan.Renames = append(plan.Renames, Rename{From: node.Hostname(), To: name})
+}
+
+// Provision records a request that would be made to the provisioner
+func (p *Plan) Provision(node MaasNode, request ProvisionRequest) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	plan := p.entry(node)
+	plan.Provisioning = append(plan.Provisioning, request)
+}
+
+// Network records a change that would be made to the interfaces of a node
+func (p *Plan) Network(node MaasNode, change string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	plan := p.entry(node)
+	plan.Network = append(plan.Network, change)
+}
+
+// Storage records a change that would be made to the disks of a node
+func (p *Plan) Storage(node MaasNode, change string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	plan := p.entry(node)
+	plan.Storage = append(plan.Storage, change)
+}
+
+// Valid returns false if any node has no valid transition
+func (p *Plan) Valid() bool {
+	if p == nil {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, plan := range p.nodes {
+		if plan.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Nodes returns the plans of all nodes, ordered by hostname
+func (p *Plan) Nodes() []NodePlan {
+	if p == nil {
+		return []NodePlan{}
+	}
+	p.mutex.Lock()
+	result := make([]NodePlan, 0, len(p.nodes))
+	for _, plan := range p.nodes {
+		result = append(result, *plan)
+	}
+	p.mutex.Unlock()
+	sort.Sort(plansByHostname(result))
+	return result
+}
+
+// Write writes the plan in the given format, json or yaml
+func (p *Plan) Write(w io.Writer, format string) error {
+	doc := struct {
+		Nodes []NodePlan `json:"nodes" yaml:"nodes"`
+	}{p.Nodes()}
+
+	var bytes []byte
+	var err error
+	switch format {
+	case "json":
+		bytes, err = json.MarshalIndent(doc, "", "  ")
+		bytes = append(bytes, '\n')
+	case "yaml":
+		bytes, err = yaml.Marshal(doc)
+	default:
+		return fmt.Errorf("unknown plan format '%s', expected json or yaml", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bytes)
+	return err
+}
+
+type plansByHostname []NodePlan
+
+func (a plansByHostname) Len() int           { return len(a) }
+func (a plansByHostname) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a plansByHostname) Less(i, j int) bool { return a[i].Hostname < a[j].Hostname }
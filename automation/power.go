@@ -0,0 +1,235 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Power the power settings of a node as discovered by the power helper
+// script. Parameters holds any additional settings the helper discovered,
+// which are passed through to MAAS as is.
+type Power struct {
+	Name          string            `json:"name"`
+	MacAddress    string            `json:"mac_address"`
+	PowerPassword string            `json:"power_password"`
+	PowerAddress  string            `json:"power_address"`
+	PowerUser     string            `json:"power_user,omitempty"`
+	PowerID       string            `json:"power_id,omitempty"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+}
+
+// PowerDriver maps discovered power settings to the MAAS power type and the
+// power parameters, without the power_parameters_ prefix, of a node
+type PowerDriver interface {
+	PowerParameters(power Power) (string, map[string]string, error)
+}
+
+// PowerDriverFunc adapts a function to the PowerDriver interface
+type PowerDriverFunc func(power Power) (string, map[string]string, error)
+
+// PowerParameters invokes the function
+func (f PowerDriverFunc) PowerParameters(power Power) (string, map[string]string, error) {
+	return f(power)
+}
+
+// withExtra adds the additional discovered parameters to the given
+// parameters, overriding any defaults of the driver
+func withExtra(params map[string]string, power Power) map[string]string {
+	for k, v := range power.Parameters {
+		params[k] = v
+	}
+	return params
+}
+
+// requirePower returns an error naming a required setting that is empty
+func requirePower(power Power, settings map[string]string) error {
+	for name, value := range settings {
+		if value == "" {
+			return fmt.Errorf("discovered '%s' power settings missing required '%s'", power.Name, name)
+		}
+	}
+	return nil
+}
+
+// amtDriver Intel AMT
+var amtDriver = PowerDriverFunc(func(power Power) (string, map[string]string, error) {
+	if err := requirePower(power, map[string]string{"power_address": power.PowerAddress}); err != nil {
+		return "", nil, err
+	}
+	return "amt", withExtra(map[string]string{
+		"mac_address":   power.MacAddress,
+		"power_pass":    power.PowerPassword,
+		"power_address": power.PowerAddress,
+	}, power), nil
+})
+
+// ipmiDriver IPMI over LAN, version 2.0 unless a power_driver is discovered
+var ipmiDriver = PowerDriverFunc(func(power Power) (string, map[string]string, error) {
+	if err := requirePower(power, map[string]string{"power_address": power.PowerAddress}); err != nil {
+		return "", nil, err
+	}
+	return "ipmi", withExtra(map[string]string{
+		"power_driver":  "LAN_2_0",
+		"power_address": power.PowerAddress,
+		"power_user":    power.PowerUser,
+		"power_pass":    power.PowerPassword,
+		"mac_address":   power.MacAddress,
+	}, power), nil
+})
+
+// redfishDriver DMTF Redfish, the power ID is the Redfish node ID if the BMC
+// manages more than one node
+var redfishDriver = PowerDriverFunc(func(power Power) (string, map[string]string, error) {
+	if err := requirePower(power, map[string]string{
+		"power_address": power.PowerAddress,
+		"power_user":    power.PowerUser,
+	}); err != nil {
+		return "", nil, err
+	}
+	params := map[string]string{
+		"power_address": power.PowerAddress,
+		"power_user":    power.PowerUser,
+		"power_pass":    power.PowerPassword,
+	}
+	if power.PowerID != "" {
+		params["node_id"] = power.PowerID
+	}
+	return "redfish", withExtra(params, power), nil
+})
+
+// virshDriver libvirt virtual machines, the power address is the libvirt URI
+// and the power ID the name of the domain
+var virshDriver = PowerDriverFunc(func(power Power) (string, map[string]string, error) {
+	if err := requirePower(power, map[string]string{
+		"power_address": power.PowerAddress,
+		"power_id":      power.PowerID,
+	}); err != nil {
+		return "", nil, err
+	}
+	return "virsh", withExtra(map[string]string{
+		"power_address": power.PowerAddress,
+		"power_id":      power.PowerID,
+		"power_pass":    power.PowerPassword,
+	}, power), nil
+})
+
+// PowerDrivers the power drivers, by the discovered power type name, that
+// are built into automation
+var PowerDrivers = map[string]PowerDriver{
+	"amt":     amtDriver,
+	"ipmi":    ipmiDriver,
+	"redfish": redfishDriver,
+	"virsh":   virshDriver,
+}
+
+// ScriptPowerDriver a power driver implemented by an external script. The
+// discovered power settings are written to the script's standard input as
+// JSON and the script writes a JSON object with the members "power_type" and
+// "power_parameters" to its standard output. If no power type is returned the
+// discovered power type name is used.
+type ScriptPowerDriver struct {
+	Script string
+}
+
+// PowerParameters runs the script
+func (d *ScriptPowerDriver) PowerParameters(power Power) (string, map[string]string, error) {
+	input, err := json.Marshal(power)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(d.Script, power.Name)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("power driver script '%s' failed : %s", d.Script, err)
+	}
+
+	var result struct {
+		PowerType       string            `json:"power_type"`
+		PowerParameters map[string]string `json:"power_parameters"`
+	}
+	if err = json.Unmarshal(stdout, &result); err != nil {
+		return "", nil, fmt.Errorf("unable to parse output of power driver script '%s' : %s", d.Script, err)
+	}
+	if result.PowerType == "" {
+		result.PowerType = power.Name
+	}
+	return result.PowerType, result.PowerParameters, nil
+}
+
+// NewPowerDrivers returns the built in power drivers augmented, or
+// overridden, by the given external driver scripts by power type name
+func NewPowerDrivers(scripts map[string]string) map[string]PowerDriver {
+	drivers := make(map[string]PowerDriver)
+	for name, driver := range PowerDrivers {
+		drivers[name] = driver
+	}
+	for name, script := range scripts {
+		drivers[strings.ToLower(name)] = &ScriptPowerDriver{Script: script}
+	}
+	return drivers
+}
+
+// discoverPower runs the power helper script to discover the power settings
+// of a node and configures them in MAAS using the matching power driver
+func discoverPower(node MaasNode, options ProcessingOptions) error {
+	cmd := exec.Command(options.PowerHelper,
+		append([]string{options.PowerHelperUser, options.PowerHelperHost},
+			node.MACs()...)...)
+	stdout, err := cmd.Output()
+	if err != nil {
+		log.Errorf("Failed while executing power helper script '%s' : %s",
+			options.PowerHelper, err)
+		return err
+	}
+	power := Power{}
+	err = json.Unmarshal(stdout, &power)
+	if err != nil {
+		log.Errorf("Failed to parse output of power helper script '%s' : %s",
+			options.PowerHelper, err)
+		return err
+	}
+	if power.Name == "" {
+		log.Debugf("No power settings discovered for '%s'", node.Hostname())
+		return nil
+	}
+
+	drivers := options.PowerDrivers
+	if drivers == nil {
+		drivers = PowerDrivers
+	}
+	driver, ok := drivers[strings.ToLower(power.Name)]
+	if !ok {
+		log.Warningf("Unsupported power type discovered '%s'", power.Name)
+		return nil
+	}
+	ptype, params, err := driver.PowerParameters(power)
+	if err != nil {
+		log.Errorf("Unable to determine power parameters of '%s' : %s", node.Hostname(), err)
+		return err
+	}
+
+	log.Infof("POWER TYPE: %s to '%s'", node.Hostname(), ptype)
+	if options.Preview {
+		return nil
+	}
+	err = node.UpdatePowerParameters(ptype, params)
+	options.Audit.Record(node, "update_power", powerValues(ptype, params), err)
+	return err
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+)
+
+func TestIPMIPowerDriver(t *testing.T) {
+	cases := []struct {
+		parameters map[string]string
+		driver     string
+	}{
+		{nil, "LAN_2_0"},
+		{map[string]string{"power_driver": "LAN"}, "LAN"},
+	}
+	for _, c := range cases {
+		power := Power{
+			Name:          "ipmi",
+			PowerAddress:  "10.6.0.12",
+			PowerUser:     "ADMIN",
+			PowerPassword: "secret",
+			Parameters:    c.parameters,
+		}
+		powerType, params, err := PowerDrivers["ipmi"].PowerParameters(power)
+		if err != nil {
+			t.Fatalf("unable to map power settings : %s", err)
+		}
+		if powerType != "ipmi" || params["power_driver"] != c.driver {
+			t.Errorf("expected ipmi with driver '%s', got %s with %v", c.driver, powerType, params)
+		}
+		if params["power_address"] != "10.6.0.12" {
+			t.Errorf("expected the power address to be kept, got %v", params)
+		}
+	}
+
+	if _, _, err := PowerDrivers["ipmi"].PowerParameters(Power{Name: "ipmi"}); err == nil {
+		t.Errorf("expected power settings without an address to be rejected")
+	}
+}
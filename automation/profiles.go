@@ -0,0 +1,247 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultDistroSeries the distro deployed to nodes whose profile does not
+// specify one
+const DefaultDistroSeries = "trusty"
+
+// DeploymentProfile how a node is deployed. UserData is the name of a
+// template file from which the cloud-init user data of the node is generated,
+// and KeySets the names of the SSH key sets installed on the node.
+type DeploymentProfile struct {
+	DistroSeries string   `json:"distro_series,omitempty"`
+	HweKernel    string   `json:"hwe_kernel,omitempty"`
+	UserData     string   `json:"user_data,omitempty"`
+	Comment      string   `json:"comment,omitempty"`
+	KeySets      []string `json:"key_sets,omitempty"`
+
+	userData *template.Template
+}
+
+// HostProfile selects a profile for the nodes whose hostname matches the
+// regular expression
+type HostProfile struct {
+	Match   string `json:"match"`
+	Profile string `json:"profile"`
+
+	pattern *regexp.Regexp
+}
+
+// ProfileSelector determines the deployment profile of a node. The profile
+// is selected, in order of precedence, by the first hostname expression that
+// matches the node, by a MAAS tag on the node, by the node's zone and finally
+// the default. Nodes for which no profile is selected are deployed with the
+// default distro. Nodes are also given the SSH key sets of their role.
+type ProfileSelector struct {
+	Profiles    map[string]*DeploymentProfile `json:"profiles,omitempty"`
+	Default     string                        `json:"default,omitempty"`
+	Hosts       []*HostProfile                `json:"hosts,omitempty"`
+	Tags        map[string]string             `json:"tags,omitempty"`
+	Zones       map[string]string             `json:"zones,omitempty"`
+	KeySets     map[string]*SSHKeySet         `json:"key_sets,omitempty"`
+	RoleKeySets map[string][]string           `json:"role_key_sets,omitempty"`
+}
+
+// UserDataContext the values available to a user data template
+type UserDataContext struct {
+	ID       string
+	Hostname string
+	Zone     string
+	Tags     []string
+	MACs     []string
+	Profile  string
+}
+
+// Load verifies that every profile and SSH key set that can be selected
+// exists, compiles the hostname expressions, parses the user data templates
+// and reads the SSH keys
+func (s *ProfileSelector) Load() error {
+	check := func(kind, key, profile string) error {
+		if _, ok := s.Profiles[profile]; !ok {
+			return fmt.Errorf("unknown deployment profile '%s' selected for %s '%s'", profile, kind, key)
+		}
+		return nil
+	}
+	checkKeySets := func(kind, key string, names []string) error {
+		for _, name := range names {
+			if _, ok := s.KeySets[name]; !ok {
+				return fmt.Errorf("unknown SSH key set '%s' selected for %s '%s'", name, kind, key)
+			}
+		}
+		return nil
+	}
+
+	for name, set := range s.KeySets {
+		if set == nil {
+			return fmt.Errorf("SSH key set '%s' is empty", name)
+		}
+		if err := set.load(); err != nil {
+			return fmt.Errorf("invalid SSH key set '%s' : %s", name, err)
+		}
+	}
+	for role, names := range s.RoleKeySets {
+		if err := checkKeySets("role", role, names); err != nil {
+			return err
+		}
+	}
+	for name, profile := range s.Profiles {
+		if profile == nil {
+			return fmt.Errorf("deployment profile '%s' is empty", name)
+		}
+		if err := checkKeySets("deployment profile", name, profile.KeySets); err != nil {
+			return err
+		}
+		if profile.UserData == "" {
+			continue
+		}
+		file := os.ExpandEnv(profile.UserData)
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return fmt.Errorf("unable to parse user data template of deployment profile '%s' : %s", name, err)
+		}
+		profile.userData = tmpl
+	}
+	if s.Default != "" {
+		if err := check("default", "default", s.Default); err != nil {
+			return err
+		}
+	}
+	for _, host := range s.Hosts {
+		pattern, err := regexp.Compile(host.Match)
+		if err != nil {
+			return fmt.Errorf("invalid hostname expression '%s' : %s", host.Match, err)
+		}
+		host.pattern = pattern
+		if err := check("hosts matching", host.Match, host.Profile); err != nil {
+			return err
+		}
+	}
+	for key, profile := range s.Tags {
+		if err := check("tag", key, profile); err != nil {
+			return err
+		}
+	}
+	for key, profile := range s.Zones {
+		if err := check("zone", key, profile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Profile returns the name of the deployment profile selected for the given
+// node, or the empty string if none is selected
+func (s *ProfileSelector) Profile(node MaasNode) string {
+	if s == nil {
+		return ""
+	}
+
+	name := node.Hostname()
+	for _, host := range s.Hosts {
+		if host.pattern != nil && host.pattern.MatchString(name) {
+			return host.Profile
+		}
+	}
+	for _, tag := range node.Tags() {
+		if profile, ok := s.Tags[tag]; ok {
+			return profile
+		}
+	}
+	if profile, ok := s.Zones[node.Zone()]; ok {
+		return profile
+	}
+	return s.Default
+}
+
+// DeployParameters returns the parameters of the MAAS start operation that
+// deploys the node according to its deployment profile and, for the SSH key
+// sets of its role, the given role
+func (s *ProfileSelector) DeployParameters(node MaasNode, role string) (url.Values, error) {
+	params := url.Values{"distro_series": []string{DefaultDistroSeries}}
+
+	var userData []byte
+	name := s.Profile(node)
+	profile := &DeploymentProfile{}
+	if name != "" {
+		profile = s.Profiles[name]
+	}
+	if profile.DistroSeries != "" {
+		params.Set("distro_series", profile.DistroSeries)
+	}
+	if profile.HweKernel != "" {
+		params.Set("hwe_kernel", profile.HweKernel)
+	}
+	if profile.Comment != "" {
+		params.Set("comment", profile.Comment)
+	}
+	if profile.userData != nil {
+		var buf bytes.Buffer
+		err := profile.userData.Execute(&buf, UserDataContext{
+			ID:       node.ID(),
+			Hostname: node.Hostname(),
+			Zone:     node.Zone(),
+			Tags:     node.Tags(),
+			MACs:     node.MACs(),
+			Profile:  name,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate user data of deployment profile '%s' : %s", name, err)
+		}
+		userData = buf.Bytes()
+	}
+
+	// The SSH keys are installed through their own cloud-init configuration,
+	// combined with the user data of the profile if it has any
+	if keys := s.sshCloudConfig(s.NodeKeySets(node, role)); keys != nil {
+		if userData == nil {
+			userData = keys
+		} else {
+			var err error
+			if userData, err = combineUserData(userData, keys); err != nil {
+				return nil, fmt.Errorf("unable to combine user data with SSH keys : %s", err)
+			}
+		}
+	}
+	if userData != nil {
+		params.Set("user_data", base64.StdEncoding.EncodeToString(userData))
+	}
+	return params, nil
+}
+
+// describeDeploy returns a short description of the deployment parameters
+// for logging, without the user data
+func describeDeploy(params url.Values) string {
+	parts := []string{}
+	for _, key := range []string{"distro_series", "hwe_kernel"} {
+		if value := params.Get(key); value != "" {
+			parts = append(parts, key+"="+value)
+		}
+	}
+	if params.Get("user_data") != "" {
+		parts = append(parts, "user_data")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -16,6 +16,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -47,13 +48,24 @@ func (s ProvisionStatus) String() string {
 type ProvisionRecord struct {
 	Status    ProvisionStatus `json:"status"`
 	Timestamp int64
+	Request   *ProvisionWork `json:"request,omitempty"`
+}
+
+// ProvisionWork the role and script with which the provisioner provisions
+// a node
+type ProvisionWork struct {
+	Role   string
+	Script string
 }
 
 type ProvisionRequest struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Ip   string `json:"ip"`
-	Mac  string `json:"mac"`
+	Id           string `json:"id"`
+	Name         string `json:"name"`
+	Ip           string `json:"ip"`
+	Mac          string `json:"mac"`
+	Role         string `json:"role,omitempty"`
+	RoleSelector string `json:"role_selector,omitempty"`
+	Script       string `json:"script,omitempty"`
 }
 
 type Provisioner interface {
@@ -97,7 +109,7 @@ func (p *ProvisionerConfig) Get(id string) (*ProvisionRecord, error) {
 	case http.StatusNotFound:
 		return nil, nil
 	default:
-		return nil, fmt.Errorf(resp.Status)
+		return nil, errors.New(resp.Status)
 	}
 }
 
@@ -0,0 +1,169 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// ProvisionProfile how the provisioner provisions a node once it is
+// deployed. Role is the provisioner role of the node, RoleSelector the URL
+// the provisioner queries for the role if none is given, and Script the
+// script the provisioner runs. Any that are not set are left to the
+// provisioner's defaults.
+type ProvisionProfile struct {
+	Role         string `json:"role,omitempty"`
+	RoleSelector string `json:"role_selector,omitempty"`
+	Script       string `json:"script,omitempty"`
+}
+
+// ProvisionSelector determines the provisioning profile of a node. The
+// profile is selected, in order of precedence, by a MAAS tag on the node, by
+// the node's role, by the node's zone and finally the default.
+type ProvisionSelector struct {
+	Profiles map[string]*ProvisionProfile `json:"profiles,omitempty"`
+	Default  string                       `json:"default,omitempty"`
+	Tags     map[string]string            `json:"tags,omitempty"`
+	Roles    map[string]string            `json:"roles,omitempty"`
+	Zones    map[string]string            `json:"zones,omitempty"`
+}
+
+// Load verifies that every profile that can be selected exists
+func (s *ProvisionSelector) Load() error {
+	for name, profile := range s.Profiles {
+		if profile == nil {
+			return fmt.Errorf("provisioning profile '%s' is empty", name)
+		}
+	}
+	if _, ok := s.Profiles[s.Default]; s.Default != "" && !ok {
+		return fmt.Errorf("unknown provisioning profile '%s' selected as default", s.Default)
+	}
+	for kind, selection := range map[string]map[string]string{"tag": s.Tags, "role": s.Roles, "zone": s.Zones} {
+		for key, profile := range selection {
+			if _, ok := s.Profiles[profile]; !ok {
+				return fmt.Errorf("unknown provisioning profile '%s' selected for %s '%s'", profile, kind, key)
+			}
+		}
+	}
+	return nil
+}
+
+// Profile returns the name and provisioning profile selected for the given
+// node with the given role, or nil if none is selected
+func (s *ProvisionSelector) Profile(node MaasNode, role string) (string, *ProvisionProfile) {
+	if s == nil {
+		return "", nil
+	}
+	for _, tag := range node.Tags() {
+		if name, ok := s.Tags[tag]; ok {
+			return name, s.Profiles[name]
+		}
+	}
+	if name, ok := s.Roles[role]; ok && role != "" {
+		return name, s.Profiles[name]
+	}
+	if name, ok := s.Zones[node.Zone()]; ok {
+		return name, s.Profiles[name]
+	}
+	if s.Default != "" {
+		return s.Default, s.Profiles[s.Default]
+	}
+	return "", nil
+}
+
+// Apply sets the role, role selector and script of a provisioning request
+// from the profile selected for the node
+func (s *ProvisionSelector) Apply(node MaasNode, role string, request *ProvisionRequest) {
+	name, profile := s.Profile(node, role)
+	if profile == nil {
+		return
+	}
+	log.Debugf("Provisioning node '%s' with profile '%s'", node.Hostname(), name)
+	request.Role = profile.Role
+	request.RoleSelector = profile.RoleSelector
+	request.Script = profile.Script
+}
+
+// The MAAS tags that mirror the provisioning status of a node
+const (
+	ProvisioningTag    = "provisioning"
+	ProvisionedTag     = "provisioned"
+	ProvisionFailedTag = "provision-failed"
+)
+
+// provisionTags the tag that mirrors each provisioning status
+var provisionTags = map[ProvisionStatus]string{
+	Pending:  ProvisioningTag,
+	Running:  ProvisioningTag,
+	Complete: ProvisionedTag,
+	Failed:   ProvisionFailedTag,
+}
+
+// provisionDescriptionPrefix starts the line of a node's description that
+// mirrors its provisioning status
+const provisionDescriptionPrefix = "Provisioning: "
+
+// mirrorProvisioning reflects the provisioning status of a node in MAAS, so
+// that it can be seen and filtered on in the MAAS UI. The node is tagged with
+// the tag of the status, the tags of other statuses are removed, and the
+// provisioning line of the node's description is replaced, leaving the rest
+// of the description as is.
+func mirrorProvisioning(client *maas.MAASObject, node MaasNode, options ProcessingOptions,
+	status ProvisionStatus, detail string) error {
+	if !options.ProvisionTags || options.Preview {
+		return nil
+	}
+
+	current := provisionTags[status]
+	for _, tag := range []string{ProvisioningTag, ProvisionedTag, ProvisionFailedTag} {
+		if tag == current {
+			continue
+		}
+		if err := removeNodeTag(client, node, options, tag); err != nil {
+			return fmt.Errorf("unable to remove tag '%s' : %s", tag, err)
+		}
+	}
+	if !hasTag(node, current) {
+		log.Infof("Tagging node '%s' as '%s'", node.Hostname(), current)
+		err := addNodeTag(client, node, options, current, "nodes whose post deployment provisioning is "+
+			strings.ToLower(status.String()))
+		if err != nil {
+			return fmt.Errorf("unable to add tag '%s' : %s", current, err)
+		}
+	}
+
+	line := provisionDescriptionPrefix + status.String()
+	if detail != "" {
+		line += ", " + detail
+	}
+	return describeNode(client, node, options, provisionDescriptionPrefix, line)
+}
+
+// clearProvisioning removes the provisioning status of a node from MAAS once
+// the provisioner has forgotten the node, i.e. when it is released or
+// redeployed, so that the node no longer shows as provisioned
+func clearProvisioning(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	if !options.ProvisionTags || options.Preview {
+		return nil
+	}
+	for _, tag := range []string{ProvisioningTag, ProvisionedTag, ProvisionFailedTag} {
+		if err := removeNodeTag(client, node, options, tag); err != nil {
+			return fmt.Errorf("unable to remove tag '%s' : %s", tag, err)
+		}
+	}
+	return describeNode(client, node, options, provisionDescriptionPrefix, "")
+}
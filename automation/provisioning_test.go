@@ -0,0 +1,236 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+const testProvisionProfiles = `{
+	"profiles": {
+		"compute": {"role": "compute-node"},
+		"storage": {"role": "storage-node", "script": "/etc/maas/ansible/do-storage"},
+		"lab": {"role_selector": "http://selector.cord.lab/role"}
+	},
+	"tags": {"ceph": "storage"},
+	"roles": {"compute": "compute"},
+	"zones": {"lab": "lab"}
+}`
+
+func TestProvisionProfiles(t *testing.T) {
+	cases := []struct {
+		name     string
+		zone     string
+		tags     []string
+		role     string
+		expected ProvisionRequest
+	}{
+		{
+			name:     "selected by role",
+			role:     "compute",
+			expected: ProvisionRequest{Role: "compute-node"},
+		},
+		{
+			name:     "tag takes precedence over role",
+			role:     "compute",
+			tags:     []string{"ceph"},
+			expected: ProvisionRequest{Role: "storage-node", Script: "/etc/maas/ansible/do-storage"},
+		},
+		{
+			name:     "selected by zone",
+			zone:     "lab",
+			expected: ProvisionRequest{RoleSelector: "http://selector.cord.lab/role"},
+		},
+		{
+			name: "provisioner defaults",
+			zone: "default",
+		},
+	}
+
+	for _, c := range cases {
+		server, client := newTestServer(t, MaasAPIv1)
+		server.AddNode(maasfake.Node{
+			Hostname:   "node-a",
+			Zone:       c.zone,
+			Tags:       c.tags,
+			Status:     maasfake.Deployed,
+			Interfaces: []maasfake.Interface{testInterface("dhcp")},
+		})
+		provisioner := newTestProvisioner()
+		options := newTestOptions(MaasAPIv1, provisioner)
+		options.Roles = &RoleSelector{Default: c.role}
+		options.Provisioning = &ProvisionSelector{}
+		if err := json.Unmarshal([]byte(testProvisionProfiles), options.Provisioning); err != nil {
+			t.Fatalf("unable to parse provisioning profiles : %s", err)
+		}
+		if err := options.Provisioning.Load(); err != nil {
+			t.Fatalf("invalid provisioning profiles : %s", err)
+		}
+
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("%s: unable to fetch nodes : %s", c.name, err)
+		}
+		if err := Provision(client, nodes[0], options); err != nil {
+			t.Fatalf("%s: unable to provision node : %s", c.name, err)
+		}
+		requests := provisioner.Requests()
+		if len(requests) != 1 {
+			t.Fatalf("%s: expected a single provisioning request, got %d", c.name, len(requests))
+		}
+		request := requests[0]
+		if request.Role != c.expected.Role || request.RoleSelector != c.expected.RoleSelector ||
+			request.Script != c.expected.Script {
+			t.Errorf("%s: expected role '%s', role selector '%s' and script '%s', got %+v", c.name,
+				c.expected.Role, c.expected.RoleSelector, c.expected.Script, request)
+		}
+		server.Close()
+	}
+}
+
+func TestProvisionProfileValidation(t *testing.T) {
+	cases := []string{
+		`{"profiles": {"p": null}}`,
+		`{"default": "q"}`,
+		`{"profiles": {"p": {}}, "tags": {"ceph": "q"}}`,
+		`{"profiles": {"p": {}}, "roles": {"compute": "q"}}`,
+		`{"profiles": {"p": {}}, "zones": {"lab": "q"}}`,
+	}
+	for _, c := range cases {
+		selector := &ProvisionSelector{}
+		if err := json.Unmarshal([]byte(c), selector); err != nil {
+			t.Fatalf("unable to parse provisioning profiles '%s' : %s", c, err)
+		}
+		if err := selector.Load(); err == nil {
+			t.Errorf("expected provisioning profiles '%s' to be invalid", c)
+		}
+	}
+}
+
+func TestProvisioningMirroredInMAAS(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{
+		Hostname:    "node-a",
+		Description: "rack 3, slot 12\n\nspare PSU on order\n",
+		Status:      maasfake.Deployed,
+		Tags:        []string{"provisioned"},
+		Interfaces:  []maasfake.Interface{testInterface("dhcp")},
+	})
+	provisioner := newTestProvisioner()
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionTags = true
+
+	provision := func() maasfake.Node {
+		node, err := fetchNode(client, MaasAPIv1, id)
+		if err != nil {
+			t.Fatalf("unable to fetch node : %s", err)
+		}
+		if err := Provision(client, node, options); err != nil {
+			t.Fatalf("unable to provision node : %s", err)
+		}
+		maasNode, _ := server.Node(id)
+		return maasNode
+	}
+
+	cases := []struct {
+		status ProvisionStatus
+		tag    string
+		line   string
+	}{
+		{Running, "provisioning", "Provisioning: PENDING at "},
+		{Failed, "provisioning", "Provisioning: PENDING at "},
+		{Complete, "provisioned", "Provisioning: COMPLETE at "},
+	}
+	for i, c := range cases {
+		if i > 0 {
+			provisioner.records[id].Status = c.status
+		}
+		node := provision()
+		if !reflect.DeepEqual(node.Tags, []string{c.tag}) {
+			t.Errorf("(%s) expected tags [%s], got %v", c.status, c.tag, node.Tags)
+		}
+		lines := strings.Split(node.Description, "\n")
+		if len(lines) != 5 || !reflect.DeepEqual(lines[:3], []string{"rack 3, slot 12", "", "spare PSU on order"}) ||
+			!strings.HasPrefix(lines[3], c.line) || lines[4] != "" {
+			t.Errorf("(%s) expected description to end with '%s', got '%s'", c.status, c.line, node.Description)
+		}
+	}
+
+	// The description is not updated again while the status is unchanged
+	server.ResetCalls()
+	provision()
+	for _, call := range server.Calls() {
+		if call.Method != "GET" {
+			t.Errorf("expected no changes to MAAS, got %s", call)
+		}
+	}
+}
+
+func TestProvisioningClearedOnReset(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{
+		Hostname:    "node-a",
+		Description: "rack 3, slot 12\n\nProvisioning: COMPLETE at 2016-06-01T10:00:00Z\nspare PSU on order",
+		Status:      maasfake.Ready,
+		Tags:        []string{"compute", "provisioned"},
+	})
+	provisioner := newTestProvisioner()
+	provisioner.records[id] = &ProvisionRecord{Status: Complete}
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+	options.ProvisionTags = true
+
+	reset := func() {
+		node, err := fetchNode(client, MaasAPIv1, id)
+		if err != nil {
+			t.Fatalf("unable to fetch node : %s", err)
+		}
+		if err := Reset(client, node, options); err != nil {
+			t.Fatalf("unable to reset node : %s", err)
+		}
+	}
+
+	options.Preview = true
+	reset()
+	if calls := operations(server.Calls()); len(calls) != 0 {
+		t.Errorf("expected no changes to MAAS in preview, got %v", calls)
+	}
+
+	options.Preview = false
+	reset()
+	node, _ := server.Node(id)
+	if !reflect.DeepEqual(node.Tags, []string{"compute"}) {
+		t.Errorf("expected the provisioning tags to be removed, got %v", node.Tags)
+	}
+	if node.Description != "rack 3, slot 12\n\nspare PSU on order" {
+		t.Errorf("expected the provisioning line to be removed, got '%s'", node.Description)
+	}
+	if record, _ := provisioner.Get(id); record != nil {
+		t.Errorf("expected the provisioner record to be cleared, got %+v", record)
+	}
+
+	// Nothing is changed once the node is clear
+	server.ResetCalls()
+	reset()
+	if calls := operations(server.Calls()); len(calls) != 0 {
+		t.Errorf("expected no changes to MAAS, got %v", calls)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// RetryPolicy determines how often, and how quickly, automation retries a
+// failing node before the node is quarantined
+type RetryPolicy struct {
+	MaxRetries    int
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	QuarantineTag string
+}
+
+// Delay returns the time to wait before the next attempt after the given
+// number of consecutive failures. The delay doubles with every failure, up to
+// the maximum backoff.
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	if failures < 1 || p.Backoff <= 0 {
+		return 0
+	}
+	delay := p.Backoff
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return delay
+}
+
+// Exhausted returns true if a node that has failed the given number of
+// consecutive times has no retries left, and so is to be quarantined. The
+// first failure is not a retry, so a node is attempted 1+MaxRetries times.
+func (p RetryPolicy) Exhausted(failures int) bool {
+	return failures > p.MaxRetries
+}
+
+// recoveries the MAAS operation used to attempt to recover a node from a
+// failed state. Nodes in failed states not listed require an operator.
+var recoveries = map[string]string{
+	"FailedCommissioning": "commission",
+	"FailedTesting":       "commission",
+	"FailedDeployment":    "release",
+	"FailedReleasing":     "release",
+	"FailedDiskErasing":   "release",
+}
+
+// quarantineNode stops automation of a node by tagging it in MAAS. Automation
+// resumes once an operator removes the tag.
+func quarantineNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions, reason string) error {
+	log.Errorf("QUARANTINE: %s : %s", node.Hostname(), reason)
+	options.Tracker.SetQuarantined(node.ID(), true, reason)
+
+	if options.Preview || options.Retry.QuarantineTag == "" {
+		return nil
+	}
+	err := addNodeTag(client, node, options, options.Retry.QuarantineTag,
+		"nodes for which automation has been stopped after repeated failures")
+	if err != nil {
+		log.Errorf("Unable to tag node '%s' as quarantined : %s", node.Hostname(), err)
+	}
+	return err
+}
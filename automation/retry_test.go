@@ -0,0 +1,33 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, Backoff: time.Minute, MaxBackoff: 3 * time.Minute}
+	for failures, expected := range []bool{false, false, false, true, true} {
+		if exhausted := policy.Exhausted(failures); exhausted != expected {
+			t.Errorf("expected exhausted to be %t after %d failures, got %t", expected, failures, exhausted)
+		}
+	}
+	for failures, expected := range []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if delay := policy.Delay(failures); delay != expected {
+			t.Errorf("expected a delay of %s after %d failures, got %s", expected, failures, delay)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// HostRole selects a role for the nodes whose hostname matches the regular
+// expression
+type HostRole struct {
+	Match string `json:"match"`
+	Role  string `json:"role"`
+
+	pattern *regexp.Regexp
+}
+
+// RoleSelector determines the role of a node, such as compute or storage,
+// by which the policies that shape the node are selected. The role is
+// selected, in order of precedence, by the first hostname expression that
+// matches the node, by a MAAS tag on the node, by the node's zone and finally
+// the default.
+type RoleSelector struct {
+	Default string            `json:"default,omitempty"`
+	Hosts   []*HostRole       `json:"hosts,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Zones   map[string]string `json:"zones,omitempty"`
+}
+
+// Load compiles the hostname expressions
+func (s *RoleSelector) Load() error {
+	for _, host := range s.Hosts {
+		pattern, err := regexp.Compile(host.Match)
+		if err != nil {
+			return fmt.Errorf("invalid hostname expression '%s' : %s", host.Match, err)
+		}
+		host.pattern = pattern
+	}
+	return nil
+}
+
+// Role returns the role selected for the given node, or the empty string if
+// none is selected
+func (s *RoleSelector) Role(node MaasNode) string {
+	if s == nil {
+		return ""
+	}
+
+	name := node.Hostname()
+	for _, host := range s.Hosts {
+		if host.pattern != nil && host.pattern.MatchString(name) {
+			return host.Role
+		}
+	}
+	for _, tag := range node.Tags() {
+		if role, ok := s.Tags[tag]; ok {
+			return role
+		}
+	}
+	if role, ok := s.Zones[node.Zone()]; ok {
+		return role
+	}
+	return s.Default
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// validUserName matches the names of the users that may be created on a node
+var validUserName = regexp.MustCompile("^[a-z_][a-z0-9_-]*$")
+
+// SSHKeySet the public SSH keys of a team. The keys are installed for User,
+// which is created on the node through cloud-init, or for the default user of
+// the node if no user is given. Keys are given as the key itself, or as '@'
+// followed by the name of a file with one key per line. The keys of a set
+// that is registered are also registered in MAAS with the MAAS user.
+type SSHKeySet struct {
+	User     string   `json:"user,omitempty"`
+	Keys     []string `json:"keys"`
+	Sudo     bool     `json:"sudo,omitempty"`
+	Shell    string   `json:"shell,omitempty"`
+	Register bool     `json:"register,omitempty"`
+
+	keys []string
+}
+
+// load reads the keys of the set and verifies them
+func (k *SSHKeySet) load() error {
+	if k.User != "" && !validUserName.MatchString(k.User) {
+		return fmt.Errorf("invalid user name '%s'", k.User)
+	}
+	k.keys = []string{}
+	for _, spec := range k.Keys {
+		lines := []string{spec}
+		if strings.HasPrefix(spec, "@") {
+			name := os.ExpandEnv(spec[1:])
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				return fmt.Errorf("unable to read keys from file '%s' : %s", name, err)
+			}
+			lines = strings.Split(string(data), "\n")
+		}
+		for _, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if len(strings.Fields(line)) < 2 {
+				return fmt.Errorf("invalid public key '%s'", line)
+			}
+			k.keys = append(k.keys, line)
+		}
+	}
+	if len(k.keys) == 0 {
+		return fmt.Errorf("no keys")
+	}
+	return nil
+}
+
+// sshKeyID returns the type and data of a public key, which identify the key
+// regardless of its comment
+func sshKeyID(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return key
+	}
+	return fields[0] + " " + fields[1]
+}
+
+// NodeKeySets returns the names of the SSH key sets of the given node, those
+// of its deployment profile followed by those of its role
+func (s *ProfileSelector) NodeKeySets(node MaasNode, role string) []string {
+	if s == nil {
+		return nil
+	}
+	result := []string{}
+	seen := map[string]bool{}
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, name)
+			}
+		}
+	}
+	if profile := s.Profiles[s.Profile(node)]; profile != nil {
+		add(profile.KeySets)
+	}
+	add(s.RoleKeySets[role])
+	return result
+}
+
+// cloudConfigUser the cloud-init configuration of a user created on a node
+type cloudConfigUser struct {
+	name  string
+	shell string
+	sudo  bool
+	keys  []string
+}
+
+// sshCloudConfig returns the cloud-init configuration that installs the keys
+// of the given key sets, or nil if there are no key sets
+func (s *ProfileSelector) sshCloudConfig(names []string) []byte {
+	if len(names) == 0 {
+		return nil
+	}
+	var defaultKeys []string
+	users := []*cloudConfigUser{}
+	byName := map[string]*cloudConfigUser{}
+	for _, name := range names {
+		set := s.KeySets[name]
+		if set.User == "" {
+			defaultKeys = append(defaultKeys, set.keys...)
+			continue
+		}
+		user, ok := byName[set.User]
+		if !ok {
+			user = &cloudConfigUser{name: set.User, shell: "/bin/bash"}
+			byName[set.User] = user
+			users = append(users, user)
+		}
+		if set.Shell != "" {
+			user.shell = set.Shell
+		}
+		user.sudo = user.sudo || set.Sudo
+		user.keys = append(user.keys, set.keys...)
+	}
+
+	// Strings are written as JSON strings, which are valid YAML
+	quote := func(s string) string {
+		bytes, _ := json.Marshal(s)
+		return string(bytes)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("#cloud-config\n")
+	if len(defaultKeys) > 0 {
+		buf.WriteString("ssh_authorized_keys:\n")
+		for _, key := range defaultKeys {
+			fmt.Fprintf(&buf, "  - %s\n", quote(key))
+		}
+	}
+	if len(users) > 0 {
+		buf.WriteString("users:\n  - default\n")
+		for _, user := range users {
+			fmt.Fprintf(&buf, "  - name: %s\n", quote(user.name))
+			fmt.Fprintf(&buf, "    shell: %s\n", quote(user.shell))
+			if user.sudo {
+				fmt.Fprintf(&buf, "    sudo: %s\n", quote("ALL=(ALL) NOPASSWD:ALL"))
+			}
+			buf.WriteString("    ssh_authorized_keys:\n")
+			for _, key := range user.keys {
+				fmt.Fprintf(&buf, "      - %s\n", quote(key))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// combineUserData returns a multipart MIME message, as understood by
+// cloud-init, of the user data generated from the template of a profile
+// followed by the configuration of the SSH keys, which is merged into any
+// configuration of the former
+func combineUserData(userData []byte, keys []byte) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		header textproto.MIMEHeader
+		data   []byte
+	}{
+		// cloud-init determines the type of a text/plain part from its
+		// first line, as it would if it were the only user data
+		{textproto.MIMEHeader{"Content-Type": {"text/plain; charset=\"utf-8\""}}, userData},
+		{textproto.MIMEHeader{
+			"Content-Type": {"text/cloud-config; charset=\"utf-8\""},
+			"Merge-Type":   {"list(append)+dict(recurse_array)+str()"},
+		}, keys},
+	}
+	for _, p := range parts {
+		part, err := writer.CreatePart(p.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(p.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var result bytes.Buffer
+	fmt.Fprintf(&result, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n", writer.Boundary())
+	result.WriteString("MIME-Version: 1.0\r\n\r\n")
+	result.Write(body.Bytes())
+	return result.Bytes(), nil
+}
+
+// ensureSSHKeys registers in MAAS the keys of the registered key sets of the
+// given node that MAAS does not already have
+func ensureSSHKeys(client *maas.MAASObject, node MaasNode, options ProcessingOptions, names []string) error {
+	// The keys to register, and the names of their sets, by key ID
+	wanted := map[string]string{}
+	sets := map[string]string{}
+	for _, name := range names {
+		set := options.Profiles.KeySets[name]
+		if !set.Register {
+			continue
+		}
+		for _, key := range set.keys {
+			if _, ok := wanted[sshKeyID(key)]; !ok {
+				wanted[sshKeyID(key)] = key
+				sets[sshKeyID(key)] = name
+			}
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	keysObj := client.GetSubObject("account").GetSubObject("prefs").GetSubObject("sshkeys")
+	listObj, err := keysObj.CallGet(node.API().ListOp, url.Values{})
+	if err != nil {
+		return fmt.Errorf("unable to list the SSH keys registered in MAAS : %s", err)
+	}
+	registered, err := listObj.GetArray()
+	if err != nil {
+		return err
+	}
+	for _, obj := range registered {
+		keyObj, err := obj.GetMap()
+		if err != nil {
+			return err
+		}
+		if key, err := keyObj["key"].GetString(); err == nil {
+			delete(wanted, sshKeyID(key))
+		}
+	}
+
+	missing := make([]string, 0, len(wanted))
+	for id := range wanted {
+		missing = append(missing, id)
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		log.Infof("SSH KEY: registering key of set '%s' in MAAS", sets[id])
+		if options.Preview {
+			continue
+		}
+		_, err := keysObj.CallPost("new", url.Values{"key": []string{wanted[id]}})
+		options.Audit.Record(node, "add_sshkey", url.Values{"key_set": []string{sets[id]}}, err)
+		if err != nil {
+			return fmt.Errorf("unable to register key of set '%s' in MAAS : %s", sets[id], err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+const (
+	testOpsKey     = "ssh-rsa AAAAops ops@cord"
+	testOpsKey2    = "ssh-rsa AAAAops2 oncall@cord"
+	testStorageKey = "ssh-ed25519 AAAAstorage alice@storage"
+)
+
+func TestSSHKeySets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatalf("unable to create directory : %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keysFile := filepath.Join(dir, "ops.pub")
+	if err := ioutil.WriteFile(keysFile, []byte("# operators\n"+testOpsKey+"\n"+testOpsKey2+"\n"), 0644); err != nil {
+		t.Fatalf("unable to write keys : %s", err)
+	}
+	templateFile := filepath.Join(dir, "user-data.tmpl")
+	if err := ioutil.WriteFile(templateFile, []byte("#cloud-config\nhostname: {{.Hostname}}\n"), 0644); err != nil {
+		t.Fatalf("unable to write template : %s", err)
+	}
+
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	server.AddSSHKey("ssh-rsa AAAAops2 registered-earlier")
+	server.AddNode(maasfake.Node{SystemID: "compute", Hostname: "compute", Status: maasfake.Allocated})
+	server.AddNode(maasfake.Node{SystemID: "storage", Hostname: "storage", Status: maasfake.Allocated, Tags: []string{"templated"}})
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Roles = &RoleSelector{Default: "compute", Hosts: []*HostRole{{Match: "^storage", Role: "storage"}}}
+	if err := options.Roles.Load(); err != nil {
+		t.Fatalf("invalid roles : %s", err)
+	}
+	options.Profiles = &ProfileSelector{}
+	spec := `{
+		"profiles": {
+			"plain": {"key_sets": ["ops"]},
+			"templated": {"user_data": "` + templateFile + `", "key_sets": ["ops"]}
+		},
+		"default": "plain",
+		"tags": {"templated": "templated"},
+		"key_sets": {
+			"ops": {"keys": ["@` + keysFile + `"], "register": true},
+			"storage": {"user": "storage", "keys": ["` + testStorageKey + `"], "sudo": true}
+		},
+		"role_key_sets": {"storage": ["storage"]}
+	}`
+	if err := json.Unmarshal([]byte(spec), options.Profiles); err != nil {
+		t.Fatalf("unable to parse deployment profiles : %s", err)
+	}
+	if err := options.Profiles.Load(); err != nil {
+		t.Fatalf("invalid deployment profiles : %s", err)
+	}
+
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	ProcessAll(client, nodes, options)
+
+	keys := server.SSHKeys()
+	if len(keys) != 2 || keys[1].Key != testOpsKey {
+		t.Errorf("expected only the missing operator key to be registered, got %+v", keys)
+	}
+
+	compute, _ := server.Node("compute")
+	if compute.Status != maasfake.Deploying {
+		t.Fatalf("expected node to be deployed, got status %d", compute.Status)
+	}
+	expected := "#cloud-config\nssh_authorized_keys:\n  - \"" + testOpsKey + "\"\n  - \"" + testOpsKey2 + "\"\n"
+	if compute.UserData != expected {
+		t.Errorf("expected user data\n%s\ngot\n%s", expected, compute.UserData)
+	}
+
+	storage, _ := server.Node("storage")
+	for _, expected := range []string{
+		"Content-Type: multipart/mixed",
+		"hostname: storage",
+		"Merge-Type: list(append)+dict(recurse_array)+str()",
+		"users:\n  - default\n  - name: \"storage\"\n",
+		"    sudo: \"ALL=(ALL) NOPASSWD:ALL\"\n",
+		"      - \"" + testStorageKey + "\"\n",
+	} {
+		if !strings.Contains(storage.UserData, expected) {
+			t.Errorf("expected user data to contain '%s', got\n%s", expected, storage.UserData)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"key_sets": {"ops": {"keys": ["not-a-key"]}}}`,
+		`{"key_sets": {"ops": {"user": "Bad User", "keys": ["` + testOpsKey + `"]}}}`,
+		`{"profiles": {"p": {"key_sets": ["missing"]}}}`,
+		`{"role_key_sets": {"compute": ["missing"]}}`,
+	} {
+		selector := &ProfileSelector{}
+		if err := json.Unmarshal([]byte(invalid), selector); err != nil {
+			t.Fatalf("unable to parse deployment profiles '%s' : %s", invalid, err)
+		}
+		if err := selector.Load(); err == nil {
+			t.Errorf("expected deployment profiles '%s' to be invalid", invalid)
+		}
+	}
+}
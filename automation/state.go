@@ -14,13 +14,9 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
-	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -37,87 +33,138 @@ type Transition struct {
 	Using   Action
 }
 
-type Power struct {
-	Name          string `json:"name"`
-	MacAddress    string `json:"mac_address"`
-	PowerPassword string `json:"power_password"`
-	PowerAddress  string `json:"power_address"`
-}
-
-type HostFilter struct {
-	Zones struct {
-		Include []string `json:"include,omitempty"`
-		Exclude []string `json:"exclude,omitempty"`
-	} `json:"zones,omitempty"`
-	Hosts struct {
-		Include []string `json:"include,omitempty"`
-		Exclude []string `json:"exclude,omitempty"`
-	} `json:"hosts,omitempty"`
-}
-
 // ProcessingOptions used to determine on what hosts to operate
 type ProcessingOptions struct {
 	Filter          HostFilter
-	Mappings        map[string]string
+	API             *MaasAPI
+	Targets         *TargetSelector
+	Profiles        *ProfileSelector
+	Roles           *RoleSelector
+	Networks        NetworkPolicies
+	Storage         *StorageSelector
+	Hardware        HardwareSpecs
+	NoncompliantTag string
+	Names           *NameMapper
 	Preview         bool
 	AlwaysRename    bool
 	Provisioner     Provisioner
+	Provisioning    *ProvisionSelector
+	ProvisionTags   bool
 	ProvisionURL    string
 	ProvisionTTL    time.Duration
 	PowerHelper     string
 	PowerHelperUser string
 	PowerHelperHost string
+	PowerDrivers    map[string]PowerDriver
+	Tracker         *NodeTracker
+	Dispatcher      *Dispatcher
+	Plan            *Plan
+	Mutations       MutationLimiter
+	Retry           RetryPolicy
+	Leader          *LeaderElector
+	Campaigns       *CampaignManager
+	Maintenance     *MaintenanceSchedule
+	Audit           *AuditLog
 }
 
-// Transitions the actual map
-//
-// Currently this is a hand compiled / optimized "next step" table. This should
-// really be generated from the state machine chart input. Once this has been
-// accomplished you should be able to determine the action to take given your
-// target state and your current state.
-var Transitions = map[string]map[string][]Action{
-	"Deployed": {
-		"New":                 []Action{Reset, Commission},
-		"Deployed":            []Action{Provision, Done},
-		"Ready":               []Action{Reset, Aquire},
-		"Allocated":           []Action{Reset, Deploy},
-		"Retired":             []Action{Reset, AdminState},
-		"Reserved":            []Action{Reset, AdminState},
-		"Releasing":           []Action{Reset, Wait},
-		"DiskErasing":         []Action{Reset, Wait},
-		"Deploying":           []Action{Reset, Wait},
-		"Commissioning":       []Action{Reset, Wait},
-		"Missing":             []Action{Reset, Fail},
-		"FailedReleasing":     []Action{Reset, Fail},
-		"FailedDiskErasing":   []Action{Reset, Fail},
-		"FailedDeployment":    []Action{Reset, Fail},
-		"Broken":              []Action{Reset, Fail},
-		"FailedCommissioning": []Action{Reset, Fail},
-	},
+// BlockedError is returned by an action that must not proceed for a reason
+// other than a failure of the node, so the node is not retried or
+// quarantined
+type BlockedError struct {
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return e.Reason
+}
+
+// TransientError is returned by an action that failed for a reason outside
+// the node, such as the provisioner being unavailable, so the node is retried
+// after a back off but the failure is not counted toward quarantine
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// isTransient returns true if the given error is not a failure of the node,
+// i.e. a TransientError or an error reaching MAAS over the network
+func isTransient(err error) bool {
+	switch err.(type) {
+	case *TransientError:
+		return true
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// Transitions the "next step" tables, by target state, that determine the
+// actions to take given a node's target state and its current state. The
+// tables are generated from the state machine charts at startup, see
+// BuildTransitions.
+var Transitions = map[string]map[string][]Action{}
+
+// TransitionCharts the parsed state machine charts, by target state, from
+// which Transitions are generated
+var TransitionCharts = map[string]*StateChart{}
+
+// Actions the actions that may be referenced, by name, from the labels of a
+// state machine chart
+var Actions = map[string]Action{
+	"Reset":      Reset,
+	"Provision":  Provision,
+	"Done":       Done,
+	"Deploy":     Deploy,
+	"Aquire":     Aquire,
+	"Commission": Commission,
+	"Wait":       Wait,
+	"Fail":       Fail,
+	"AdminState": AdminState,
+	"Release":    Release,
+	"Retire":     Retire,
 }
 
 const (
-	// defaultStateMachine Would be nice to drive from a graph language
+	// defaultStateMachine the lifecycle chart from which the transitions to
+	// the Deployed state are generated
 	defaultStateMachine string = `
-        (New)->(Commissioning)
+        (start)->(New)
+        (New)-[Commission]->(Commissioning)
         (Commissioning)->(FailedCommissioning)
-        (FailedCommissioning)->(New)
+        (FailedCommissioning)-[Fail]->(New)
         (Commissioning)->(Ready)
-        (Ready)->(Deploying)
-        (Ready)->(Allocated)
-        (Allocated)->(Deploying)
+        (Commissioning)->(Testing)
+        (Testing)->(FailedTesting)
+        (FailedTesting)-[Fail]->(New)
+        (Testing)->(Ready)
+        (Ready)-[Aquire]->(Allocated)
+        (Allocated)-[Deploy]->(Deploying)
         (Deploying)->(Deployed)
         (Deploying)->(FailedDeployment)
-        (FailedDeployment)->(Broken)
+        (FailedDeployment)-[Fail]->(Broken)
         (Deployed)->(Releasing)
         (Releasing)->(FailedReleasing)
-        (FailedReleasing)->(Broken)
+        (FailedReleasing)-[Fail]->(Broken)
         (Releasing)->(DiskErasing)
-        (DiskErasing)->(FailedEraseDisk)
-        (FailedEraseDisk)->(Broken)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)-[Fail]->(Broken)
         (Releasing)->(Ready)
         (DiskErasing)->(Ready)
-        (Broken)->(Ready)
+        (Broken)-[Fail]->(Ready)
+        (Missing)-[Fail]->(New)
+        (Reserved)-[AdminState]->(Ready)
+        (Retired)-[AdminState]->(Ready)
+        (EnteringRescueMode)->(RescueMode)
+        (EnteringRescueMode)->(FailedEnteringRescueMode)
+        (FailedEnteringRescueMode)-[AdminState]->(RescueMode)
+        (RescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(FailedExitingRescueMode)
+        (FailedExitingRescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(Deployed)
+        (Deployed)-[Provision]->(end)
         (Deployed)->(Provisioning)
         (Provisioning)->(HTTP PUT)
         (HTTP PUT)->(HTTP GET)
@@ -126,31 +173,163 @@ const (
         |b|->(Provisioned)
         |b|->(ProvisionError)
         (ProvisionError)->(Provisioning)`
+
+	// readyStateMachine the lifecycle chart from which the transitions to the
+	// Ready state are generated. Nodes are commissioned into the pool of ready
+	// nodes, but nodes that are in use are left alone.
+	readyStateMachine string = `
+        (start)->(New)
+        (New)-[Commission]->(Commissioning)
+        (Commissioning)->(FailedCommissioning)
+        (FailedCommissioning)-[Fail]->(New)
+        (Commissioning)->(Ready)
+        (Commissioning)->(Testing)
+        (Testing)->(FailedTesting)
+        (FailedTesting)-[Fail]->(New)
+        (Testing)->(Ready)
+        (Allocated)-[AdminState]->(Ready)
+        (Deploying)-[AdminState]->(Ready)
+        (Deployed)-[AdminState]->(Ready)
+        (FailedDeployment)-[Fail]->(Broken)
+        (Releasing)->(FailedReleasing)
+        (FailedReleasing)-[Fail]->(Broken)
+        (Releasing)->(DiskErasing)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)-[Fail]->(Broken)
+        (Releasing)->(Ready)
+        (DiskErasing)->(Ready)
+        (Broken)-[Fail]->(Ready)
+        (Missing)-[Fail]->(New)
+        (Reserved)-[AdminState]->(Ready)
+        (Retired)-[AdminState]->(Ready)
+        (EnteringRescueMode)->(RescueMode)
+        (EnteringRescueMode)->(FailedEnteringRescueMode)
+        (FailedEnteringRescueMode)-[AdminState]->(RescueMode)
+        (RescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(FailedExitingRescueMode)
+        (FailedExitingRescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(Deployed)
+        (Ready)->(end)`
+
+	// releasedStateMachine the lifecycle chart from which the transitions to
+	// the Released state are generated. Nodes that are in use are released
+	// back into the pool of ready nodes, so the goal state is Ready.
+	releasedStateMachine string = `
+        (start)->(New)
+        (New)-[Commission]->(Commissioning)
+        (Commissioning)->(FailedCommissioning)
+        (FailedCommissioning)-[Fail]->(New)
+        (Commissioning)->(Ready)
+        (Commissioning)->(Testing)
+        (Testing)->(FailedTesting)
+        (FailedTesting)-[Fail]->(New)
+        (Testing)->(Ready)
+        (Allocated)-[Release]->(Ready)
+        (Deploying)->(Deployed)
+        (Deploying)->(FailedDeployment)
+        (FailedDeployment)-[Fail]->(Broken)
+        (Deployed)-[Release]->(Releasing)
+        (Releasing)->(FailedReleasing)
+        (FailedReleasing)-[Fail]->(Broken)
+        (Releasing)->(DiskErasing)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)-[Fail]->(Broken)
+        (Releasing)->(Ready)
+        (DiskErasing)->(Ready)
+        (Broken)-[Fail]->(Ready)
+        (Missing)-[Fail]->(New)
+        (Reserved)-[AdminState]->(Ready)
+        (Retired)-[AdminState]->(Ready)
+        (EnteringRescueMode)->(RescueMode)
+        (EnteringRescueMode)->(FailedEnteringRescueMode)
+        (FailedEnteringRescueMode)-[AdminState]->(RescueMode)
+        (RescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(FailedExitingRescueMode)
+        (FailedExitingRescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(Deployed)
+        (Ready)->(end)`
+
+	// retiredStateMachine the lifecycle chart from which the transitions to
+	// the Retired state are generated. Nodes are released and powered down,
+	// after which they wait for an administrator to retire them.
+	retiredStateMachine string = `
+        (start)->(New)
+        (New)-[Retire]->(Retired)
+        (Commissioning)->(FailedCommissioning)
+        (FailedCommissioning)-[Retire]->(Retired)
+        (Commissioning)->(Ready)
+        (Commissioning)->(Testing)
+        (Testing)->(FailedTesting)
+        (FailedTesting)-[Fail]->(New)
+        (Testing)->(Ready)
+        (Ready)-[Retire]->(Retired)
+        (Allocated)-[Release]->(Ready)
+        (Deploying)->(Deployed)
+        (Deploying)->(FailedDeployment)
+        (FailedDeployment)-[Fail]->(Broken)
+        (Deployed)-[Release]->(Releasing)
+        (Releasing)->(FailedReleasing)
+        (FailedReleasing)-[Fail]->(Broken)
+        (Releasing)->(DiskErasing)
+        (DiskErasing)->(FailedDiskErasing)
+        (FailedDiskErasing)-[Fail]->(Broken)
+        (Releasing)->(Ready)
+        (DiskErasing)->(Ready)
+        (Broken)-[Retire]->(Retired)
+        (Missing)-[Fail]->(New)
+        (Reserved)-[AdminState]->(Retired)
+        (EnteringRescueMode)->(RescueMode)
+        (EnteringRescueMode)->(FailedEnteringRescueMode)
+        (FailedEnteringRescueMode)-[AdminState]->(RescueMode)
+        (RescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(FailedExitingRescueMode)
+        (FailedExitingRescueMode)-[AdminState]->(ExitingRescueMode)
+        (ExitingRescueMode)->(Deployed)
+        (Retired)->(end)`
 )
 
+// defaultCharts the charts, by target state, that ship with automation
+var defaultCharts = map[string]string{
+	"Deployed": defaultStateMachine,
+	"Ready":    readyStateMachine,
+	"Released": releasedStateMachine,
+	"Retired":  retiredStateMachine,
+}
+
+// postNodeOp invokes an operation that changes the state of a node, honoring
+// the cap on concurrent MAAS mutations, and records it in the audit log
+func postNodeOp(client *maas.MAASObject, node MaasNode, options ProcessingOptions,
+	op string, params url.Values) (maas.JSONObject, error) {
+	options.Mutations.Acquire()
+	defer options.Mutations.Release()
+	api := node.API()
+	result, err := client.GetSubObject(api.Nodes).GetSubObject(node.ID()).CallPost(api.Op(op), params)
+	options.Audit.Record(node, op, params, err)
+	return result, err
+}
+
 // updateName - changes the name of the MAAS node based on the configuration file
 func updateNodeName(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	macs := node.MACs()
-
-	// Get current node name and strip off domain name
-	current := node.Hostname()
-	if i := strings.IndexRune(current, '.'); i != -1 {
-		current = current[:i]
-	}
-	for _, mac := range macs {
-		if name, ok := options.Mappings[mac]; ok {
-			if current != name {
-				nodesObj := client.GetSubObject("nodes")
-				nodeObj := nodesObj.GetSubObject(node.ID())
-				log.Infof("RENAME '%s' to '%s'\n", node.Hostname(), name)
-
-				if !options.Preview {
-					nodeObj.Update(url.Values{"hostname": []string{name}})
-				}
-			}
-		}
+	name, err := options.Names.Target(node)
+	if err != nil {
+		log.Errorf("Refusing to rename node '%s' : %s", node.Hostname(), err)
+		return err
 	}
-	return nil
+	if name == "" {
+		return nil
+	}
+
+	nodesObj := client.GetSubObject(node.API().Nodes)
+	nodeObj := nodesObj.GetSubObject(node.ID())
+	log.Infof("RENAME '%s' to '%s'\n", node.Hostname(), name)
+	options.Plan.Rename(node, name)
+
+	if !options.Preview {
+		params := url.Values{"hostname": []string{name}}
+		_, err = nodeObj.Update(params)
+		options.Audit.Record(node, "rename", params, err)
+	}
+	return err
 }
 
 // Reset we are at the target state, nothing to do
@@ -161,11 +340,17 @@ var Reset = func(client *maas.MAASObject, node MaasNode, options ProcessingOptio
 		updateNodeName(client, node, options)
 	}
 
-	err := options.Provisioner.Clear(node.ID())
-	if err != nil {
+	if options.ProvisionURL == "" {
+		return nil
+	}
+	if err := options.Provisioner.Clear(node.ID()); err != nil {
 		log.Errorf("Attempting to clear provisioning state of node '%s' : %s", node.ID(), err)
+		return &TransientError{Err: err}
 	}
-	return err
+	if err := clearProvisioning(client, node, options); err != nil {
+		log.Warnf("Unable to clear the provisioning status of node '%s' in MAAS : %s", node.Hostname(), err)
+	}
+	return nil
 }
 
 // Provision we are at the target state, nothing to do
@@ -176,6 +361,7 @@ var Provision = func(client *maas.MAASObject, node MaasNode, options ProcessingO
 		updateNodeName(client, node, options)
 	}
 
+	var mirrorErr error
 	record, err := options.Provisioner.Get(node.ID())
 	if err != nil {
 		log.Warningf("unable to retrieve provisioning state of node '%s' : %s", node.Hostname(), err)
@@ -201,10 +387,10 @@ var Provision = func(client *maas.MAASObject, node MaasNode, options ProcessingO
 				log.Errorf("Unable to determine IP address of '%s', thus unable to provision node '%s'",
 					node.Hostname(), node.ID())
 				if err == nil {
-					err = fmt.Errorf("Unable to determine IP address of host '%s'", node.Hostname)
+					err = fmt.Errorf("Unable to determine IP address of host '%s'", node.Hostname())
 				} else {
 					err = fmt.Errorf("Unable to determine IP address of host '%s' : %s",
-						node.Hostname, err)
+						node.Hostname(), err)
 				}
 				return err
 			}
@@ -216,16 +402,26 @@ var Provision = func(client *maas.MAASObject, node MaasNode, options ProcessingO
 		if len(macs) > 0 {
 			mac = macs[0]
 		}
-		log.Debugf("POSTing '%s' (%s) to '%s'", node.Hostname(), node.ID(), options.ProvisionURL)
-		err = options.Provisioner.Provision(&ProvisionRequest{
+		request := ProvisionRequest{
 			Id:   node.ID(),
 			Name: node.Hostname(),
 			Ip:   ip,
 			Mac:  mac,
-		})
+		}
+		options.Provisioning.Apply(node, options.Roles.Role(node), &request)
+		options.Plan.Provision(node, request)
+		if options.Preview {
+			log.Infof("PROVISION: %s", node.Hostname())
+			return nil
+		}
+		log.Debugf("POSTing '%s' (%s) to '%s'", node.Hostname(), node.ID(), options.ProvisionURL)
+		err = options.Provisioner.Provision(&request)
 
 		if err != nil {
 			log.Errorf("unable to provision '%s' (%s) : %s", node.ID(), node.Hostname(), err)
+			mirrorErr = mirrorProvisioning(client, node, options, Failed, err.Error())
+		} else {
+			mirrorErr = mirrorProvisioning(client, node, options, Pending, "")
 		}
 
 	} else if options.ProvisionTTL > 0 &&
@@ -233,11 +429,17 @@ var Provision = func(client *maas.MAASObject, node MaasNode, options ProcessingO
 		log.Errorf("Provisioning of node '%s' has passed provisioning TTL of '%v'",
 			node.Hostname(), options.ProvisionTTL)
 		options.Provisioner.Clear(node.ID())
+		mirrorErr = mirrorProvisioning(client, node, options, Failed,
+			fmt.Sprintf("passed provisioning TTL of '%v'", options.ProvisionTTL))
 	} else {
 		log.Debugf("Not invoking provisioning for '%s', current state is '%s'", node.Hostname(),
 			record.Status.String())
+		mirrorErr = mirrorProvisioning(client, node, options, record.Status, "")
 	}
 
+	if mirrorErr != nil {
+		log.Warnf("Unable to mirror the provisioning status of node '%s' in MAAS : %s", node.Hostname(), mirrorErr)
+	}
 	return nil
 }
 
@@ -248,6 +450,8 @@ var Done = func(client *maas.MAASObject, node MaasNode, options ProcessingOption
 	// nice to log it once when the device transitions from a non COMPLETE
 	// state to a complete state, but that would require keeping state.
 	log.Debugf("COMPLETE: %s", node.Hostname())
+	options.Tracker.Recovered(node.ID())
+	options.Tracker.SetDeferred(node.ID(), "")
 
 	if options.AlwaysRename {
 		updateNodeName(client, node, options)
@@ -264,12 +468,34 @@ var Deploy = func(client *maas.MAASObject, node MaasNode, options ProcessingOpti
 		updateNodeName(client, node, options)
 	}
 
+	if err := checkCompliance(client, node, options); err != nil {
+		return err
+	}
+
+	if err := deferDisruptive(node, options, "deploy"); err != nil {
+		return err
+	}
+
+	if err := configureStorage(client, node, options); err != nil {
+		log.Errorf("DEPLOY '%s' : '%s'", node.Hostname(), err)
+		return err
+	}
+
+	role := options.Roles.Role(node)
+	params, err := options.Profiles.DeployParameters(node, role)
+	if err != nil {
+		log.Errorf("DEPLOY '%s' : '%s'", node.Hostname(), err)
+		return err
+	}
+	if err := ensureSSHKeys(client, node, options, options.Profiles.NodeKeySets(node, role)); err != nil {
+		log.Errorf("DEPLOY '%s' : '%s'", node.Hostname(), err)
+		return err
+	}
+	log.Debugf("DEPLOY: %s with profile '%s' : %s", node.Hostname(),
+		options.Profiles.Profile(node), describeDeploy(params))
+
 	if !options.Preview {
-		nodesObj := client.GetSubObject("nodes")
-		myNode := nodesObj.GetSubObject(node.ID())
-		// Start the node with the trusty distro. This should really be looked up or
-		// a parameter default
-		_, err := myNode.CallPost("start", url.Values{"distro_series": []string{"trusty"}})
+		_, err := postNodeOp(client, node, options, "start", params)
 		if err != nil {
 			log.Errorf("DEPLOY '%s' : '%s'", node.Hostname(), err)
 			return err
@@ -278,101 +504,84 @@ var Deploy = func(client *maas.MAASObject, node MaasNode, options ProcessingOpti
 	return nil
 }
 
-// Aquire aquire a machine to a specific operator
-var Aquire = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Infof("AQUIRE: %s", node.Hostname())
-	nodesObj := client.GetSubObject("nodes")
+// Release cause a node to be released back into the pool of ready nodes
+var Release = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.Infof("RELEASE: %s", node.Hostname())
 
 	if options.AlwaysRename {
 		updateNodeName(client, node, options)
 	}
 
+	if err := deferDisruptive(node, options, "release"); err != nil {
+		return err
+	}
+
 	if !options.Preview {
-		// With a new version of MAAS we have to make sure the node is linked
-		// to the subnet vid DHCP before we move to the Aquire state. To do this
-		// We need to unlink the interface to the subnet and then relink it.
-		//
-		// Iterate through all the interfaces on the node, searching for ones
-		// that are valid and not DHCP and move them to DHCP
-		ifcsObj := client.GetSubObject("nodes").GetSubObject(node.ID()).GetSubObject("interfaces")
-		ifcsListObj, err := ifcsObj.CallGet("", url.Values{})
+		_, err := postNodeOp(client, node, options, "release", url.Values{})
 		if err != nil {
+			log.Errorf("RELEASE '%s' : '%s'", node.Hostname(), err)
 			return err
 		}
+	}
+	return nil
+}
+
+// Retire power down a node that is to be retired. MAAS does not provide a way
+// to retire a node through its API, so once powered down the node is held
+// until an administrator retires it.
+var Retire = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	if options.AlwaysRename {
+		updateNodeName(client, node, options)
+	}
 
-		ifcsArray, err := ifcsListObj.GetArray()
+	if node.PowerState() != "on" {
+		log.Infof("RETIRE: %s, awaiting administrator", node.Hostname())
+		return nil
+	}
+
+	if err := deferDisruptive(node, options, "power down"); err != nil {
+		return err
+	}
+
+	log.Infof("POWER DOWN: %s", node.Hostname())
+	if !options.Preview {
+		_, err := postNodeOp(client, node, options, "stop", url.Values{"stop_mode": []string{"soft"}})
 		if err != nil {
+			log.Errorf("Retire '%s' : changing power state to off : '%s'", node.Hostname(), err)
 			return err
 		}
+	}
+	return nil
+}
 
-		for _, ifc := range ifcsArray {
-			ifcMap, err := ifc.GetMap()
-			if err != nil {
-				return err
-			}
+// Aquire aquire a machine to a specific operator
+var Aquire = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	log.Infof("AQUIRE: %s", node.Hostname())
+	api := node.API()
+	nodesObj := client.GetSubObject(api.Nodes)
 
-			// Iterate over the links assocated with the interface, looking for
-			// links with a subnect as well as a mode of "auto"
-			links, ok := ifcMap["links"]
-			if ok {
-				linkArray, err := links.GetArray()
-				if err != nil {
-					return err
-				}
+	if options.AlwaysRename {
+		updateNodeName(client, node, options)
+	}
 
-				for _, link := range linkArray {
-					linkMap, err := link.GetMap()
-					if err != nil {
-						return err
-					}
-					subnet, ok := linkMap["subnet"]
-					if ok {
-						subnetMap, err := subnet.GetMap()
-						if err != nil {
-							return err
-						}
-
-						val, err := linkMap["mode"].GetString()
-						if err != nil {
-							return err
-						}
-
-						if val == "auto" {
-							// Found one we like, so grab the subnet from the data and
-							// then relink this as DHCP
-							cidr, err := subnetMap["cidr"].GetString()
-							if err != nil {
-								return err
-							}
-
-							fifcID, err := ifcMap["id"].GetFloat64()
-							if err != nil {
-								return err
-							}
-							ifcID := strconv.Itoa(int(fifcID))
-
-							flID, err := linkMap["id"].GetFloat64()
-							if err != nil {
-								return err
-							}
-							lID := strconv.Itoa(int(flID))
-
-							ifcObj := ifcsObj.GetSubObject(ifcID)
-							_, err = ifcObj.CallPost("unlink_subnet", url.Values{"id": []string{lID}})
-							if err != nil {
-								return err
-							}
-							_, err = ifcObj.CallPost("link_subnet", url.Values{"mode": []string{"DHCP"}, "subnet": []string{cidr}})
-							if err != nil {
-								return err
-							}
-						}
-					}
-				}
-			}
-		}
-		_, err = nodesObj.CallPost("acquire",
-			url.Values{"name": []string{node.Hostname()}})
+	if err := checkCompliance(client, node, options); err != nil {
+		return err
+	}
+
+	// With a new version of MAAS we have to make sure the node is linked
+	// to the subnet via DHCP before we move to the Aquire state. Nodes whose
+	// role has a network policy are instead configured by that policy.
+	if _, err := configureNetwork(client, node, options); err != nil {
+		log.Errorf("AQUIRE '%s' : '%s'", node.Hostname(), err)
+		return err
+	}
+
+	if !options.Preview {
+		params := url.Values{"name": []string{node.Hostname()}}
+		options.Mutations.Acquire()
+		_, err := nodesObj.CallPost(api.Op("acquire"), params)
+		options.Mutations.Release()
+		options.Audit.Record(node, "acquire", params, err)
 		if err != nil {
 			log.Errorf("AQUIRE '%s' : '%s'", node.Hostname(), err)
 			return err
@@ -391,12 +600,13 @@ var Commission = func(client *maas.MAASObject, node MaasNode, options Processing
 	switch state {
 	case "on":
 		// Attempt to turn the node off
+		if err := deferDisruptive(node, options, "power down"); err != nil {
+			return err
+		}
 		log.Infof("POWER DOWN: %s", node.Hostname())
 		if !options.Preview {
 			//POST /api/1.0/nodes/{system_id}/ op=stop
-			nodesObj := client.GetSubObject("nodes")
-			nodeObj := nodesObj.GetSubObject(node.ID())
-			_, err := nodeObj.CallPost("stop", url.Values{"stop_mode": []string{"soft"}})
+			_, err := postNodeOp(client, node, options, "stop", url.Values{"stop_mode": []string{"soft"}})
 			if err != nil {
 				log.Errorf("Commission '%s' : changing power start to off : '%s'", node.Hostname(), err)
 			}
@@ -405,14 +615,14 @@ var Commission = func(client *maas.MAASObject, node MaasNode, options Processing
 		break
 	case "off":
 		// We are off so move to commissioning
+		if err := deferDisruptive(node, options, "commission"); err != nil {
+			return err
+		}
 		log.Infof("COMISSION: %s", node.Hostname())
 		if !options.Preview {
-			nodesObj := client.GetSubObject("nodes")
-			nodeObj := nodesObj.GetSubObject(node.ID())
-
 			updateNodeName(client, node, options)
 
-			_, err := nodeObj.CallPost("commission", url.Values{})
+			_, err := postNodeOp(client, node, options, "commission", url.Values{})
 			if err != nil {
 				log.Errorf("Commission '%s' : '%s'", node.Hostname(), err)
 			}
@@ -425,35 +635,9 @@ var Commission = func(client *maas.MAASObject, node MaasNode, options Processing
 
 		// If a power helper script is set, we have an unknown power state, and
 		// we have not power type then attempt to use the helper script to discover
-		// and set the power settings
+		// the power settings and a power driver to set them
 		if options.PowerHelper != "" && node.PowerType() == "" {
-			cmd := exec.Command(options.PowerHelper,
-				append([]string{options.PowerHelperUser, options.PowerHelperHost},
-					node.MACs()...)...)
-			stdout, err := cmd.Output()
-			if err != nil {
-				log.Errorf("Failed while executing power helper script '%s' : %s",
-					options.PowerHelper, err)
-				return err
-			}
-			power := Power{}
-			err = json.Unmarshal(stdout, &power)
-			if err != nil {
-				log.Errorf("Failed to parse output of power helper script '%s' : %s",
-					options.PowerHelper, err)
-				return err
-			}
-			switch power.Name {
-			case "amt":
-				params := map[string]string{
-					"mac_address":   power.MacAddress,
-					"power_pass":    power.PowerPassword,
-					"power_address": power.PowerAddress,
-				}
-				node.UpdatePowerParameters(power.Name, params)
-			default:
-				log.Warningf("Unsupported power type discovered '%s'", power.Name)
-			}
+			return discoverPower(node, options)
 		}
 		break
 	}
@@ -466,9 +650,39 @@ var Wait = func(client *maas.MAASObject, node MaasNode, options ProcessingOption
 	return nil
 }
 
-// Fail a state from which we cannot, currently, automatically recover
+// Fail a failed state. If a recovery exists for the state it is attempted,
+// backing off between attempts, until the retries are exhausted at which
+// point the node is quarantined.
 var Fail = func(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	log.Infof("FAIL: %s", node.Hostname())
+	nodeStatus, err := node.Status()
+	if err != nil {
+		return err
+	}
+	status := nodeStatus.String()
+	op, ok := recoveries[status]
+	if !ok {
+		log.Infof("FAIL: %s", node.Hostname())
+		return nil
+	}
+
+	// The node has failed once to reach the failed state, and again for
+	// every attempt to recover it
+	attempts := options.Tracker.Failures(node.ID())
+	if options.Retry.Exhausted(1 + attempts) {
+		return quarantineNode(client, node, options,
+			fmt.Sprintf("still %s after %d attempts to recover", status, attempts))
+	}
+
+	log.Infof("RECOVER: %s from %s using %s, attempt %d of %d", node.Hostname(), status, op,
+		attempts+1, options.Retry.MaxRetries)
+	if !options.Preview {
+		_, err = postNodeOp(client, node, options, op, url.Values{})
+		if err != nil {
+			log.Errorf("Recover '%s' : '%s'", node.Hostname(), err)
+			return err
+		}
+		options.Tracker.Failed(node.ID(), options.Retry)
+	}
 	return nil
 }
 
@@ -500,89 +714,157 @@ func findActions(target string, current string) ([]Action, error) {
 func ProcessActions(actions []Action, client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
 	var err error
 	for _, action := range actions {
-		if err = action(client, node, options); err != nil {
+		// Actions queued before leadership was lost are left to the new
+		// leader
+		if !options.Leader.IsLeader() {
+			log.Warnf("Not processing node '%s' as no longer the leader", node.Hostname())
+			break
+		}
+		err = action(client, node, options)
+		options.Tracker.Record(node.ID(), ActionName(action), err)
+		if _, ok := err.(*BlockedError); ok {
+			log.Infof("Action for node '%s' blocked : %s", node.Hostname(), err)
+			break
+		}
+		if err != nil && isTransient(err) {
+			log.Warnf("Action for node '%s' failed, will retry : %s", node.Hostname(), err)
+			options.Tracker.Postpone(node.ID(), options.Retry.Delay(1))
+			break
+		}
+		if err != nil {
 			log.Errorf("Error while processing action for node '%s' : %s",
 				node.Hostname(), err)
+
+			// Back off before the next attempt, and if the node keeps failing
+			// quarantine it
+			failures := options.Tracker.Failed(node.ID(), options.Retry)
+			if options.Retry.Exhausted(failures) {
+				quarantineNode(client, node, options,
+					fmt.Sprintf("%d consecutive failures, last error : %s", failures, err))
+			}
 			break
 		}
 	}
 	return err
 }
 
+// resolveNode returns the target state of a node, that of the campaign the
+// node is part of if any, and why automation is not to move the node toward
+// it, if it is not. The quarantine and compliance of the node are brought in
+// line with its MAAS tags on the way. Processing and planning a node share
+// it, so that a plan shows what processing would do.
+func resolveNode(node MaasNode, options ProcessingOptions) (string, string) {
+	target := options.Targets.Target(node)
+	if campaign := options.Campaigns.Target(node); campaign != "" {
+		target = campaign
+	}
+	if options.Tracker.Paused(node.ID()) {
+		return target, "paused"
+	}
+
+	// A node is quarantined for as long as it carries the quarantine tag, so
+	// an operator resumes automation of a node by removing the tag
+	if tag := options.Retry.QuarantineTag; tag != "" {
+		tagged := hasTag(node, tag)
+		if tagged && !options.Tracker.Quarantined(node.ID()) {
+			options.Tracker.SetQuarantined(node.ID(), true, fmt.Sprintf("tagged '%s' in MAAS", tag))
+		} else if !tagged && !options.Preview && options.Tracker.Quarantined(node.ID()) {
+			log.Infof("node '%s' is no longer quarantined, resuming automation", node.Hostname())
+			options.Tracker.SetQuarantined(node.ID(), false, "")
+		}
+	}
+	if options.Tracker.Quarantined(node.ID()) {
+		return target, "quarantined"
+	}
+	// A node whose hardware does not meet its specification is held back for
+	// as long as it carries the noncompliant tag
+	if tag := options.NoncompliantTag; tag != "" {
+		if hasTag(node, tag) {
+			// The reason is kept in the description of the node, so that it
+			// is known again after a restart
+			if options.Tracker.Noncompliant(node.ID()) == "" {
+				reason := describedAs(node, noncompliantDescriptionPrefix)
+				if reason == "" {
+					reason = fmt.Sprintf("tagged '%s' in MAAS", tag)
+				}
+				options.Tracker.SetNoncompliant(node.ID(), reason)
+			}
+			return target, "noncompliant, " + options.Tracker.Noncompliant(node.ID())
+		} else if !options.Preview {
+			options.Tracker.SetNoncompliant(node.ID(), "")
+		}
+	}
+	if options.Tracker.BackingOff(node.ID()) {
+		return target, "backing off"
+	}
+	return target, ""
+}
+
 // ProcessNode something
 func ProcessNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
-	substatus, err := node.GetInteger("substatus")
+	nodeStatus, err := node.Status()
 	if err != nil {
 		return err
 	}
-	actions, err := findActions("Deployed", MaasNodeStatus(substatus).String())
+	status := nodeStatus.String()
+	target, skip := resolveNode(node, options)
+	options.Tracker.Observe(node, status, target)
+	options.Plan.Observe(node, status, target)
+	if skip != "" {
+		log.Debugf("node '%s' is %s, ignoring", node.Hostname(), skip)
+		options.Plan.Skip(node, skip)
+		return nil
+	}
+
+	actions, err := findActions(target, status)
 	if err != nil {
+		options.Tracker.Record(node.ID(), "", err)
+		options.Plan.Invalid(node, err)
 		return err
 	}
+	options.Plan.Actions(node, actions)
 
-	if options.Preview {
+	if options.Preview || options.Dispatcher == nil {
 		ProcessActions(actions, client, node, options)
-	} else {
-		go ProcessActions(actions, client, node, options)
+	} else if !options.Dispatcher.Dispatch(NodeWork{client, node, actions, options}) {
+		log.Debugf("actions for node '%s' already in flight, ignoring", node.Hostname())
 	}
 	return nil
 }
 
-func buildFilter(filter []string) ([]*regexp.Regexp, error) {
-
-	results := make([]*regexp.Regexp, len(filter))
-	for i, v := range filter {
-		r, err := regexp.Compile(v)
-		if err != nil {
-			return nil, err
-		}
-		results[i] = r
+// processFiltered processes a node unless it is excluded by the host filter
+func processFiltered(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	nodeStatus, err := node.Status()
+	if err != nil {
+		return err
 	}
-	return results, nil
-}
-
-func matchedFilter(include []*regexp.Regexp, target string) bool {
-	for _, e := range include {
-		if e.MatchString(target) {
-			return true
-		}
+	if reason := options.Filter.Excludes(node, nodeStatus.String()); reason != "" {
+		log.Debugf("ignoring node '%s' as it is excluded by the host filter : %s",
+			node.Hostname(), reason)
+		options.Tracker.Exclude(node, nodeStatus.String(), reason)
+		options.Plan.Skip(node, "excluded, "+reason)
+		return nil
 	}
-	return false
+	return ProcessNode(client, node, options)
 }
 
-// ProcessAll something
+// ProcessAll processes all the given nodes that are not excluded by the host
+// filter
 func ProcessAll(client *maas.MAASObject, nodes []MaasNode, options ProcessingOptions) []error {
 	errors := make([]error, len(nodes))
-	includeHosts, err := buildFilter(options.Filter.Hosts.Include)
-	if err != nil {
-		log.Fatalf("[error] invalid regular expression for include filter '%s' : %s", options.Filter.Hosts.Include, err)
-	}
 
-	includeZones, err := buildFilter(options.Filter.Zones.Include)
-	if err != nil {
-		log.Fatalf("[error] invalid regular expression for include filter '%v' : %s", options.Filter.Zones.Include, err)
-	}
+	// Determine the hostnames of all nodes up front, so that no node is
+	// renamed to a name that another node has or will have
+	options.Names.Assign(nodes)
+	options.Campaigns.Progress(client, nodes, options)
 
 	for i, node := range nodes {
-		// For hostnames we always match on an empty filter
-		if len(includeHosts) >= 0 && matchedFilter(includeHosts, node.Hostname()) {
-
-			// For zones we don't match on an empty filter
-			if len(includeZones) >= 0 && matchedFilter(includeZones, node.Zone()) {
-				err := ProcessNode(client, node, options)
-				if err != nil {
-					errors[i] = err
-				} else {
-					errors[i] = nil
-				}
-			} else {
-				log.Debugf("ignoring node '%s' as its zone '%s' didn't match include zone name filter '%v'",
-					node.Hostname(), node.Zone(), options.Filter.Zones.Include)
-			}
-		} else {
-			log.Debugf("ignoring node '%s' as it didn't match include hostname filter '%v'",
-				node.Hostname(), options.Filter.Hosts.Include)
-		}
+		errors[i] = processFiltered(client, node, options)
+	}
+
+	if quarantined := options.Tracker.QuarantinedHostnames(); len(quarantined) > 0 {
+		log.Warnf("%d node(s) quarantined, automation stopped until the '%s' tag is removed : %s",
+			len(quarantined), options.Retry.QuarantineTag, strings.Join(quarantined, ", "))
 	}
 	return errors
 }
@@ -0,0 +1,439 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gerrit.opencord.org/maas/maasfake"
+	maas "github.com/juju/gomaasapi"
+)
+
+func TestMain(m *testing.M) {
+	log.Out = ioutil.Discard
+
+	var err error
+	Transitions, err = BuildTransitions(map[string]string{})
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// testProvisioner a provisioner that records provisioning requests, which
+// remain running until completed by the test
+type testProvisioner struct {
+	mutex    sync.Mutex
+	records  map[string]*ProvisionRecord
+	requests []ProvisionRequest
+	clearErr error
+}
+
+func newTestProvisioner() *testProvisioner {
+	return &testProvisioner{records: make(map[string]*ProvisionRecord)}
+}
+
+func (p *testProvisioner) Get(id string) (*ProvisionRecord, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.records[id], nil
+}
+
+func (p *testProvisioner) Provision(prov *ProvisionRequest) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.requests = append(p.requests, *prov)
+	p.records[prov.Id] = &ProvisionRecord{Status: Running, Timestamp: time.Now().Unix()}
+	return nil
+}
+
+func (p *testProvisioner) Clear(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.clearErr != nil {
+		return p.clearErr
+	}
+	delete(p.records, id)
+	return nil
+}
+
+func (p *testProvisioner) Requests() []ProvisionRequest {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]ProvisionRequest{}, p.requests...)
+}
+
+// newTestServer starts a fake MAAS with a single subnet and a client for it
+func newTestServer(t *testing.T, api *MaasAPI) (*maasfake.Server, *maas.MAASObject) {
+	server := maasfake.NewServer()
+	server.AddSubnet("management", "10.6.0.0/24", 2)
+	auth, err := maas.NewAuthenticatedClient(server.URL(), maasfake.APIKey, api.Version)
+	if err != nil {
+		server.Close()
+		t.Fatalf("unable to create MAAS client : %s", err)
+	}
+	return server, maas.NewMAAS(*auth)
+}
+
+func newTestOptions(api *MaasAPI, provisioner Provisioner) ProcessingOptions {
+	options := ProcessingOptions{
+		API:         api,
+		Targets:     &TargetSelector{},
+		Profiles:    &ProfileSelector{},
+		Provisioner: provisioner,
+		Tracker:     NewNodeTracker(),
+		Retry: RetryPolicy{
+			MaxRetries:    2,
+			QuarantineTag: "quarantine",
+		},
+	}
+	options.Filter.Hosts.Include = []string{".*"}
+	options.Filter.Zones.Include = []string{"default"}
+	if err := options.Filter.Compile(); err != nil {
+		panic(err)
+	}
+	return options
+}
+
+// testInterface a network interface with an address on the test subnet
+func testInterface(mode string) maasfake.Interface {
+	return maasfake.Interface{
+		MAC: "00:11:22:33:44:55",
+		Links: []maasfake.Link{
+			{Mode: mode, Subnet: "10.6.0.0/24", IP: "10.6.0.10"},
+		},
+	}
+}
+
+// operations summarizes the calls made to MAAS by their operation, or their
+// method if there is no operation
+func operations(calls []maasfake.Call) []string {
+	result := []string{}
+	for _, call := range calls {
+		if call.Op != "" {
+			result = append(result, call.Op)
+		} else {
+			result = append(result, call.Method)
+		}
+	}
+	return result
+}
+
+func TestProcessAll(t *testing.T) {
+	cases := []struct {
+		name   string
+		node   maasfake.Node
+		target string
+		ops    []string
+		status maasfake.Status
+	}{
+		{
+			name:   "new node is commissioned",
+			node:   maasfake.Node{Status: maasfake.New},
+			ops:    []string{"commission"},
+			status: maasfake.Ready,
+		},
+		{
+			name:   "new node that is powered on is powered down",
+			node:   maasfake.Node{Status: maasfake.New, PowerState: "on"},
+			ops:    []string{"stop"},
+			status: maasfake.New,
+		},
+		{
+			name: "ready node is linked for DHCP and acquired",
+			node: maasfake.Node{
+				Status:     maasfake.Ready,
+				Interfaces: []maasfake.Interface{testInterface("auto")},
+			},
+			ops:    []string{"unlink_subnet", "link_subnet", "acquire"},
+			status: maasfake.Allocated,
+		},
+		{
+			name:   "allocated node is deployed",
+			node:   maasfake.Node{Status: maasfake.Allocated},
+			ops:    []string{"start"},
+			status: maasfake.Deployed,
+		},
+		{
+			name:   "deployed node is left alone",
+			node:   maasfake.Node{Status: maasfake.Deployed},
+			ops:    []string{},
+			status: maasfake.Deployed,
+		},
+		{
+			name:   "failed commissioning is commissioned again",
+			node:   maasfake.Node{Status: maasfake.FailedCommissioning},
+			ops:    []string{"commission"},
+			status: maasfake.Ready,
+		},
+		{
+			name:   "deployed node is left alone when the target is ready",
+			node:   maasfake.Node{Status: maasfake.Deployed},
+			target: "Ready",
+			ops:    []string{},
+			status: maasfake.Deployed,
+		},
+		{
+			name:   "deployed node is released when the target is released",
+			node:   maasfake.Node{Status: maasfake.Deployed},
+			target: "Released",
+			ops:    []string{"release"},
+			status: maasfake.Ready,
+		},
+		{
+			name:   "node outside the zone filter is ignored",
+			node:   maasfake.Node{Status: maasfake.New, Zone: "elsewhere"},
+			ops:    []string{},
+			status: maasfake.New,
+		},
+	}
+
+	for _, api := range []*MaasAPI{MaasAPIv1, MaasAPIv2} {
+		for _, c := range cases {
+			server, client := newTestServer(t, api)
+
+			node := c.node
+			node.Hostname = "node-a"
+			id := server.AddNode(node)
+
+			options := newTestOptions(api, newTestProvisioner())
+			options.Targets.Default = c.target
+			nodes, err := fetchNodes(client, api)
+			if err != nil {
+				t.Fatalf("%s (%s): unable to fetch nodes : %s", c.name, api.Version, err)
+			}
+			for _, err := range ProcessAll(client, nodes, options) {
+				if err != nil {
+					t.Errorf("%s (%s): unexpected error : %s", c.name, api.Version, err)
+				}
+			}
+
+			expected := make([]string, len(c.ops))
+			for i, op := range c.ops {
+				expected[i] = api.Op(op)
+			}
+			if ops := operations(server.Calls()); !reflect.DeepEqual(ops, expected) {
+				t.Errorf("%s (%s): expected operations %v, got %v", c.name, api.Version, expected, ops)
+			}
+			server.Advance(time.Hour)
+			if result, _ := server.Node(id); result.Status != c.status {
+				t.Errorf("%s (%s): expected status %d, got %d", c.name, api.Version, c.status, result.Status)
+			}
+			server.Close()
+		}
+	}
+}
+
+func TestProcessAllDeploysNewNode(t *testing.T) {
+	for _, api := range []*MaasAPI{MaasAPIv1, MaasAPIv2} {
+		server, client := newTestServer(t, api)
+		id := server.AddNode(maasfake.Node{
+			Hostname:   "node-a",
+			Interfaces: []maasfake.Interface{testInterface("dhcp")},
+		})
+		provisioner := newTestProvisioner()
+		options := newTestOptions(api, provisioner)
+
+		for cycle := 0; cycle < 20 && len(provisioner.Requests()) == 0; cycle++ {
+			nodes, err := fetchNodes(client, api)
+			if err != nil {
+				t.Fatalf("(%s) unable to fetch nodes : %s", api.Version, err)
+			}
+			ProcessAll(client, nodes, options)
+			server.Advance(5 * time.Minute)
+		}
+
+		node, _ := server.Node(id)
+		if node.Status != maasfake.Deployed {
+			t.Errorf("(%s) expected node to be deployed, got status %d", api.Version, node.Status)
+		}
+		if node.DistroSeries != DefaultDistroSeries {
+			t.Errorf("(%s) expected distro '%s', got '%s'", api.Version, DefaultDistroSeries, node.DistroSeries)
+		}
+		requests := provisioner.Requests()
+		if len(requests) != 1 {
+			t.Fatalf("(%s) expected a single provisioning request, got %d", api.Version, len(requests))
+		}
+		if requests[0].Id != id || requests[0].Ip != "10.6.0.10" || requests[0].Mac != "00:11:22:33:44:55" {
+			t.Errorf("(%s) unexpected provisioning request %+v", api.Version, requests[0])
+		}
+		server.Close()
+	}
+}
+
+func TestProcessAllQuarantinesFailingNode(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{
+		Hostname: "node-a",
+		Fail:     map[string]bool{"commission": true},
+	})
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+
+	for cycle := 0; cycle < 10; cycle++ {
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+		server.Advance(time.Hour)
+	}
+
+	node, _ := server.Node(id)
+	if node.Status != maasfake.FailedCommissioning {
+		t.Errorf("expected node to have failed commissioning, got status %d", node.Status)
+	}
+	if !reflect.DeepEqual(node.Tags, []string{"quarantine"}) {
+		t.Errorf("expected node to be tagged as quarantined, got tags %v", node.Tags)
+	}
+	if !options.Tracker.Quarantined(id) {
+		t.Errorf("expected node to be tracked as quarantined")
+	}
+
+	commissions := 0
+	for _, op := range operations(server.Calls()) {
+		if op == "commission" {
+			commissions++
+		}
+	}
+	if commissions != 1+options.Retry.MaxRetries {
+		t.Errorf("expected %d attempts to commission, got %d", 1+options.Retry.MaxRetries, commissions)
+	}
+}
+
+func TestProcessActionsQuarantinesFailingNode(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{Hostname: "node-a", Status: maasfake.Ready})
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	failing := func(*maas.MAASObject, MaasNode, ProcessingOptions) error {
+		return fmt.Errorf("invalid request")
+	}
+
+	// The node is quarantined by the failure that exhausts its retries, and
+	// not before
+	for attempt := 1; attempt <= 1+options.Retry.MaxRetries; attempt++ {
+		if options.Tracker.Quarantined(id) {
+			t.Fatalf("expected node not to be quarantined before attempt %d", attempt)
+		}
+		ProcessActions([]Action{failing}, client, nodes[0], options)
+	}
+	if !options.Tracker.Quarantined(id) {
+		t.Errorf("expected node to be quarantined after %d attempts", 1+options.Retry.MaxRetries)
+	}
+}
+
+func TestProcessAllProvisionerOutage(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	id := server.AddNode(maasfake.Node{Hostname: "node-a"})
+	provisioner := newTestProvisioner()
+	provisioner.clearErr = fmt.Errorf("connection refused")
+	options := newTestOptions(MaasAPIv1, provisioner)
+	options.ProvisionURL = "http://provisioner:4243/provision/"
+
+	for cycle := 0; cycle < 5; cycle++ {
+		nodes, err := fetchNodes(client, MaasAPIv1)
+		if err != nil {
+			t.Fatalf("unable to fetch nodes : %s", err)
+		}
+		ProcessAll(client, nodes, options)
+	}
+
+	node, _ := server.Node(id)
+	if len(node.Tags) != 0 || options.Tracker.Quarantined(id) {
+		t.Errorf("expected node not to be quarantined, got tags %v", node.Tags)
+	}
+	if failures := options.Tracker.Failures(id); failures != 0 {
+		t.Errorf("expected no failures to be counted, got %d", failures)
+	}
+	if ops := operations(server.Calls()); len(ops) != 0 {
+		t.Errorf("expected no changes while the provisioner is unavailable, got %v", ops)
+	}
+
+	options.Retry.Backoff = time.Minute
+	nodes, _ := fetchNodes(client, MaasAPIv1)
+	ProcessAll(client, nodes, options)
+	if !options.Tracker.BackingOff(id) {
+		t.Errorf("expected node to back off while the provisioner is unavailable")
+	}
+
+	options.ProvisionURL = ""
+	options.Tracker.Postpone(id, 0)
+	nodes, _ = fetchNodes(client, MaasAPIv1)
+	ProcessAll(client, nodes, options)
+	if node, _ := server.Node(id); node.Status != maasfake.Commissioning {
+		t.Errorf("expected node to be commissioned without a provisioner, got status %d", node.Status)
+	}
+}
+
+func TestProcessAllPreviewPlan(t *testing.T) {
+	server, client := newTestServer(t, MaasAPIv1)
+	defer server.Close()
+	server.AddNode(maasfake.Node{SystemID: "node-a", Hostname: "node-a", Status: maasfake.New})
+	server.AddNode(maasfake.Node{
+		SystemID:   "node-b",
+		Hostname:   "node-b",
+		Status:     maasfake.Deployed,
+		Interfaces: []maasfake.Interface{testInterface("dhcp")},
+	})
+	server.AddNode(maasfake.Node{SystemID: "node-c", Hostname: "node-c", Status: maasfake.Ready})
+
+	options := newTestOptions(MaasAPIv1, newTestProvisioner())
+	options.Preview = true
+	options.Plan = NewPlan()
+	options.AlwaysRename = true
+	options.Names, _ = NewNameMapper(`{"00:11:22:33:44:55": "compute-1"}`)
+	options.Targets.Hosts = map[string]string{"node-c": "Unknown"}
+
+	nodes, err := fetchNodes(client, MaasAPIv1)
+	if err != nil {
+		t.Fatalf("unable to fetch nodes : %s", err)
+	}
+	ProcessAll(client, nodes, options)
+
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("expected no calls to MAAS in preview mode, got %v", calls)
+	}
+	if options.Plan.Valid() {
+		t.Errorf("expected the plan to be invalid")
+	}
+
+	plans := options.Plan.Nodes()
+	if len(plans) != 3 {
+		t.Fatalf("expected a plan for 3 nodes, got %d", len(plans))
+	}
+	if !reflect.DeepEqual(plans[0].Actions, []string{"Reset", "Commission"}) {
+		t.Errorf("unexpected actions for new node %v", plans[0].Actions)
+	}
+	if !reflect.DeepEqual(plans[1].Renames, []Rename{{"node-b", "compute-1"}}) {
+		t.Errorf("unexpected renames for deployed node %v", plans[1].Renames)
+	}
+	if len(plans[1].Provisioning) != 1 || plans[1].Provisioning[0].Ip != "10.6.0.10" {
+		t.Errorf("unexpected provisioning for deployed node %+v", plans[1].Provisioning)
+	}
+	if plans[2].Error == "" {
+		t.Errorf("expected an error for node without a valid transition")
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NodeState what automation knows about a node it manages
+type NodeState struct {
+	ID         string           `json:"id"`
+	Hostname   string           `json:"hostname"`
+	Zone       string           `json:"zone"`
+	Status     string           `json:"status"`
+	Target     string           `json:"target"`
+	LastAction string           `json:"last_action,omitempty"`
+	LastError  string           `json:"last_error,omitempty"`
+	LastUpdate int64            `json:"last_update,omitempty"`
+	Paused     bool             `json:"paused"`
+	Excluded   string           `json:"excluded,omitempty"`
+	InFlight   bool             `json:"in_flight"`
+	Provision  *ProvisionRecord `json:"provision,omitempty"`
+
+	Failures         int    `json:"failures,omitempty"`
+	LastFailure      int64  `json:"last_failure,omitempty"`
+	RetryAt          int64  `json:"retry_at,omitempty"`
+	Quarantined      bool   `json:"quarantined"`
+	QuarantineReason string `json:"quarantine_reason,omitempty"`
+	Noncompliant     string `json:"noncompliant,omitempty"`
+	Deferred         string `json:"deferred,omitempty"`
+}
+
+// NodeTracker tracks the state of the nodes managed by automation. It is safe
+// for concurrent use, and all methods may be invoked on a nil tracker, in
+// which case nothing is tracked.
+type NodeTracker struct {
+	mutex sync.RWMutex
+	nodes map[string]*NodeState
+}
+
+// NewNodeTracker creates an empty tracker
+func NewNodeTracker() *NodeTracker {
+	return &NodeTracker{
+		nodes: make(map[string]*NodeState),
+	}
+}
+
+// entry returns the state of the given node, creating it if needed. The
+// caller must hold the write lock.
+func (t *NodeTracker) entry(id string) *NodeState {
+	state, ok := t.nodes[id]
+	if !ok {
+		state = &NodeState{ID: id}
+		t.nodes[id] = state
+	}
+	return state
+}
+
+// Observe records the latest MAAS view of a node along with its target state
+func (t *NodeTracker) Observe(node MaasNode, status string, target string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.entry(node.ID())
+	state.Hostname = node.Hostname()
+	state.Zone = node.Zone()
+	state.Status = status
+	state.Target = target
+	state.Excluded = ""
+}
+
+// Exclude records the latest MAAS view of a node that is excluded from
+// automation, along with the rule that excludes it
+func (t *NodeTracker) Exclude(node MaasNode, status string, reason string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.entry(node.ID())
+	state.Hostname = node.Hostname()
+	state.Zone = node.Zone()
+	state.Status = status
+	state.Target = ""
+	state.Excluded = reason
+}
+
+// Record records the outcome of an action invoked against a node
+func (t *NodeTracker) Record(id string, action string, err error) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.entry(id)
+	state.LastAction = action
+	state.LastError = ""
+	if err != nil {
+		state.LastError = err.Error()
+	}
+	state.LastUpdate = time.Now().Unix()
+}
+
+// SetPaused pauses or resumes automation of a node
+func (t *NodeTracker) SetPaused(id string, paused bool) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entry(id).Paused = paused
+}
+
+// Paused returns true if automation of the given node is paused
+func (t *NodeTracker) Paused(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	return ok && state.Paused
+}
+
+// Failed records a failure of a node and schedules the next attempt
+// according to the given policy. The number of consecutive failures is
+// returned.
+func (t *NodeTracker) Failed(id string, policy RetryPolicy) int {
+	if t == nil {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.entry(id)
+	now := time.Now()
+	state.Failures++
+	state.LastFailure = now.Unix()
+	state.RetryAt = now.Add(policy.Delay(state.Failures)).Unix()
+	return state.Failures
+}
+
+// Postpone delays the next attempt to process a node without counting a
+// failure
+func (t *NodeTracker) Postpone(id string, delay time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entry(id).RetryAt = time.Now().Add(delay).Unix()
+}
+
+// Failures returns the number of consecutive failures of a node
+func (t *NodeTracker) Failures(id string) int {
+	if t == nil {
+		return 0
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	if !ok {
+		return 0
+	}
+	return state.Failures
+}
+
+// BackingOff returns true if a node failed and its next attempt is not yet due
+func (t *NodeTracker) BackingOff(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	return ok && state.RetryAt > time.Now().Unix()
+}
+
+// Recovered clears the failures of a node
+func (t *NodeTracker) Recovered(id string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state, ok := t.nodes[id]
+	if ok {
+		state.Failures = 0
+		state.LastFailure = 0
+		state.RetryAt = 0
+	}
+}
+
+// SetQuarantined marks a node as quarantined, or not, along with the reason
+func (t *NodeTracker) SetQuarantined(id string, quarantined bool, reason string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	state := t.entry(id)
+	state.Quarantined = quarantined
+	state.QuarantineReason = reason
+	if !quarantined {
+		state.Failures = 0
+		state.LastFailure = 0
+		state.RetryAt = 0
+	}
+}
+
+// Quarantined returns true if the given node is quarantined
+func (t *NodeTracker) Quarantined(id string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	return ok && state.Quarantined
+}
+
+// SetNoncompliant records why the hardware of a node does not meet its
+// specification, or clears it if the reason is empty
+func (t *NodeTracker) SetNoncompliant(id string, reason string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entry(id).Noncompliant = reason
+}
+
+// Noncompliant returns why the hardware of the given node does not meet its
+// specification, or the empty string if it is not known to be noncompliant
+func (t *NodeTracker) Noncompliant(id string) string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	if !ok {
+		return ""
+	}
+	return state.Noncompliant
+}
+
+// SetDeferred records why a disruptive action on a node is deferred, or
+// clears it if the reason is empty
+func (t *NodeTracker) SetDeferred(id string, reason string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entry(id).Deferred = reason
+}
+
+// Deferred returns why a disruptive action on the given node is deferred, or
+// the empty string if none is
+func (t *NodeTracker) Deferred(id string) string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	if !ok {
+		return ""
+	}
+	return state.Deferred
+}
+
+// QuarantinedHostnames returns the hostnames of all quarantined nodes
+func (t *NodeTracker) QuarantinedHostnames() []string {
+	result := []string{}
+	for _, state := range t.List() {
+		if state.Quarantined {
+			result = append(result, state.Hostname)
+		}
+	}
+	return result
+}
+
+// Get returns a copy of the state of the given node, or nil if the node is
+// not known
+func (t *NodeTracker) Get(id string) *NodeState {
+	if t == nil {
+		return nil
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	state, ok := t.nodes[id]
+	if !ok {
+		return nil
+	}
+	copy := *state
+	return &copy
+}
+
+// List returns a copy of the state of all known nodes, ordered by hostname
+func (t *NodeTracker) List() []NodeState {
+	if t == nil {
+		return []NodeState{}
+	}
+	t.mutex.RLock()
+	result := make([]NodeState, 0, len(t.nodes))
+	for _, state := range t.nodes {
+		result = append(result, *state)
+	}
+	t.mutex.RUnlock()
+	sort.Sort(byHostname(result))
+	return result
+}
+
+type byHostname []NodeState
+
+func (a byHostname) Len() int           { return len(a) }
+func (a byHostname) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHostname) Less(i, j int) bool { return a[i].Hostname < a[j].Hostname }
+
+// ActionName returns the name under which the given action is registered in
+// Actions, so that it can be reported
+func ActionName(action Action) string {
+	ptr := reflect.ValueOf(action).Pointer()
+	for name, candidate := range Actions {
+		if reflect.ValueOf(candidate).Pointer() == ptr {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+// ActionNames returns the names of the given actions
+func ActionNames(actions []Action) []string {
+	result := make([]string, len(actions))
+	for i, action := range actions {
+		result[i] = ActionName(action)
+	}
+	return result
+}
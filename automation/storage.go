@@ -0,0 +1,429 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// RAIDPolicy a software RAID created over the named disks of a node, after
+// the storage layout is applied. If no disks are named, all the disks other
+// than the root and cache devices are used.
+type RAIDPolicy struct {
+	Name    string   `json:"name"`
+	Level   string   `json:"level"`
+	Devices []string `json:"devices,omitempty"`
+	Spares  []string `json:"spares,omitempty"`
+}
+
+// StoragePolicy how the disks of a node are laid out before it is deployed.
+// The layout is one of the MAAS storage layouts, flat, lvm or bcache, and is
+// applied to the root device, the first disk unless one is named. Sizes are
+// given in bytes or with a K, M, G, T or P suffix.
+type StoragePolicy struct {
+	Layout      string      `json:"layout,omitempty"`
+	RootDevice  string      `json:"root_device,omitempty"`
+	RootSize    string      `json:"root_size,omitempty"`
+	BootSize    string      `json:"boot_size,omitempty"`
+	VGName      string      `json:"vg_name,omitempty"`
+	LVName      string      `json:"lv_name,omitempty"`
+	LVSize      string      `json:"lv_size,omitempty"`
+	CacheDevice string      `json:"cache_device,omitempty"`
+	CacheMode   string      `json:"cache_mode,omitempty"`
+	CacheSize   string      `json:"cache_size,omitempty"`
+	RAID        *RAIDPolicy `json:"raid,omitempty"`
+}
+
+// StorageSelector determines the storage policy of a node, selected by a
+// MAAS tag on the node or, failing that, by the node's role. Nodes for which
+// no policy is selected are deployed with the MAAS default layout.
+type StorageSelector struct {
+	Policies map[string]*StoragePolicy `json:"policies,omitempty"`
+	Tags     map[string]string         `json:"tags,omitempty"`
+	Roles    map[string]string         `json:"roles,omitempty"`
+}
+
+// raidMinimumDevices the number of devices required by each RAID level
+var raidMinimumDevices = map[string]int{
+	"raid-0":  2,
+	"raid-1":  2,
+	"raid-5":  3,
+	"raid-6":  4,
+	"raid-10": 4,
+}
+
+var cacheModes = map[string]bool{
+	"writeback":    true,
+	"writethrough": true,
+	"writearound":  true,
+}
+
+// parseSize converts a size in bytes, or with a K, M, G, T or P suffix as
+// accepted by MAAS, to bytes
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	value := strings.ToUpper(strings.TrimSpace(size))
+	if n := len(value); n > 0 {
+		if i := strings.IndexByte("KMGTP", value[n-1]); i != -1 {
+			for ; i >= 0; i-- {
+				multiplier *= 1000
+			}
+			value = value[:n-1]
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// Load verifies the storage policies and that every policy that can be
+// selected exists
+func (s *StorageSelector) Load() error {
+	for name, policy := range s.Policies {
+		if policy == nil {
+			return fmt.Errorf("storage policy '%s' is empty", name)
+		}
+		if err := policy.load(); err != nil {
+			return fmt.Errorf("invalid storage policy '%s' : %s", name, err)
+		}
+	}
+	for kind, selection := range map[string]map[string]string{"tag": s.Tags, "role": s.Roles} {
+		for key, policy := range selection {
+			if _, ok := s.Policies[policy]; !ok {
+				return fmt.Errorf("unknown storage policy '%s' selected for %s '%s'", policy, kind, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *StoragePolicy) load() error {
+	p.Layout = strings.ToLower(p.Layout)
+	if p.Layout == "" {
+		p.Layout = "flat"
+	}
+	switch p.Layout {
+	case "flat", "lvm", "bcache":
+	default:
+		return fmt.Errorf("unknown storage layout '%s'", p.Layout)
+	}
+	for _, size := range []string{p.RootSize, p.BootSize, p.LVSize, p.CacheSize} {
+		if size == "" {
+			continue
+		}
+		if _, err := parseSize(size); err != nil {
+			return err
+		}
+	}
+	if p.CacheMode != "" && !cacheModes[p.CacheMode] {
+		return fmt.Errorf("unknown cache mode '%s'", p.CacheMode)
+	}
+	if p.Layout != "lvm" && (p.VGName != "" || p.LVName != "" || p.LVSize != "") {
+		return fmt.Errorf("volume settings require the lvm layout")
+	}
+	if p.Layout != "bcache" && (p.CacheDevice != "" || p.CacheMode != "" || p.CacheSize != "") {
+		return fmt.Errorf("cache settings require the bcache layout")
+	}
+	if p.RAID != nil {
+		if p.RAID.Name == "" {
+			return fmt.Errorf("RAID has no name")
+		}
+		if _, ok := raidMinimumDevices[p.RAID.Level]; !ok {
+			return fmt.Errorf("unknown RAID level '%s'", p.RAID.Level)
+		}
+	}
+	return nil
+}
+
+// Policy returns the name of the storage policy selected for the given node
+// with the given role, and the policy, or nil if none is selected
+func (s *StorageSelector) Policy(node MaasNode, role string) (string, *StoragePolicy) {
+	if s == nil {
+		return "", nil
+	}
+	for _, tag := range node.Tags() {
+		if name, ok := s.Tags[tag]; ok {
+			return name, s.Policies[name]
+		}
+	}
+	if name, ok := s.Roles[role]; ok && role != "" {
+		return name, s.Policies[name]
+	}
+	return "", nil
+}
+
+// blockDevice a physical disk of a node, as reported by MAAS
+type blockDevice struct {
+	ID   string
+	Name string
+	Size int64
+	Tags []string
+}
+
+func (d *blockDevice) hasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchBlockDevices fetches the physical disks of a node found when it was
+// commissioned
+func fetchBlockDevices(client *maas.MAASObject, node MaasNode) ([]*blockDevice, error) {
+	listObj, err := nodeResource(client, node, "blockdevices").CallGet("", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	list, err := listObj.GetArray()
+	if err != nil {
+		return nil, err
+	}
+	devices := []*blockDevice{}
+	for _, obj := range list {
+		deviceMap, err := obj.GetMap()
+		if err != nil {
+			return nil, err
+		}
+		if kind := jsonString(deviceMap, "type"); kind != "" && kind != "physical" {
+			continue
+		}
+		device := &blockDevice{Name: jsonString(deviceMap, "name")}
+		if device.ID, err = jsonID(deviceMap); err != nil {
+			return nil, err
+		}
+		if size, ok := deviceMap["size"]; ok {
+			value, err := size.GetFloat64()
+			if err != nil {
+				return nil, err
+			}
+			device.Size = int64(value)
+		}
+		if tags, ok := deviceMap["tags"]; ok && !tags.IsNil() {
+			tagArray, err := tags.GetArray()
+			if err != nil {
+				return nil, err
+			}
+			for _, tag := range tagArray {
+				if name, err := tag.GetString(); err == nil {
+					device.Tags = append(device.Tags, name)
+				}
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// storagePlan the MAAS calls that apply a storage policy to a node
+type storagePlan struct {
+	layout url.Values
+	raid   url.Values
+}
+
+// plan verifies that the given disks can satisfy the policy and determines
+// the parameters of the MAAS calls that apply it
+func (p *StoragePolicy) plan(devices []*blockDevice) (*storagePlan, error) {
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("node has no commissioned disks")
+	}
+	byName := make(map[string]*blockDevice, len(devices))
+	for _, device := range devices {
+		byName[device.Name] = device
+	}
+	find := func(purpose, name string) (*blockDevice, error) {
+		device, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%s '%s' is not a disk of the node", purpose, name)
+		}
+		return device, nil
+	}
+	fits := func(purpose, size string, device *blockDevice) error {
+		if size == "" {
+			return nil
+		}
+		bytes, _ := parseSize(size)
+		if bytes > device.Size {
+			return fmt.Errorf("%s of %s does not fit on disk '%s' of %d bytes", purpose, size, device.Name, device.Size)
+		}
+		return nil
+	}
+
+	root := devices[0]
+	if p.RootDevice != "" {
+		var err error
+		if root, err = find("root device", p.RootDevice); err != nil {
+			return nil, err
+		}
+	}
+	rootSize, _ := parseSize(p.RootSize)
+	bootSize, _ := parseSize(p.BootSize)
+	if rootSize+bootSize > root.Size {
+		return nil, fmt.Errorf("root and boot partitions of %d bytes do not fit on disk '%s' of %d bytes",
+			rootSize+bootSize, root.Name, root.Size)
+	}
+	if err := fits("logical volume", p.LVSize, root); err != nil {
+		return nil, err
+	}
+
+	result := &storagePlan{layout: url.Values{
+		"storage_layout": []string{p.Layout},
+		"root_device":    []string{root.ID},
+	}}
+	for key, value := range map[string]string{
+		"root_size": p.RootSize, "boot_size": p.BootSize,
+		"vg_name": p.VGName, "lv_name": p.LVName, "lv_size": p.LVSize,
+		"cache_mode": p.CacheMode, "cache_size": p.CacheSize,
+	} {
+		if value != "" {
+			result.layout.Set(key, value)
+		}
+	}
+
+	var cache *blockDevice
+	if p.Layout == "bcache" {
+		if p.CacheDevice != "" {
+			var err error
+			if cache, err = find("cache device", p.CacheDevice); err != nil {
+				return nil, err
+			}
+		} else {
+			for _, device := range devices {
+				if device != root && device.hasTag("ssd") {
+					cache = device
+					break
+				}
+			}
+			if cache == nil {
+				return nil, fmt.Errorf("bcache layout requires an ssd other than the root device '%s'", root.Name)
+			}
+		}
+		if cache == root {
+			return nil, fmt.Errorf("cache device '%s' is the root device", cache.Name)
+		}
+		if err := fits("cache", p.CacheSize, cache); err != nil {
+			return nil, err
+		}
+		result.layout.Set("cache_device", cache.ID)
+	}
+
+	if p.RAID == nil {
+		return result, nil
+	}
+	members := []*blockDevice{}
+	if len(p.RAID.Devices) > 0 {
+		for _, name := range p.RAID.Devices {
+			device, err := find("RAID device", name)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, device)
+		}
+	} else {
+		for _, device := range devices {
+			if device != root && device != cache && !containsString(p.RAID.Spares, device.Name) {
+				members = append(members, device)
+			}
+		}
+	}
+	spares := []*blockDevice{}
+	for _, name := range p.RAID.Spares {
+		device, err := find("RAID spare", name)
+		if err != nil {
+			return nil, err
+		}
+		spares = append(spares, device)
+	}
+	for _, device := range append(append([]*blockDevice{}, members...), spares...) {
+		if device == root || device == cache {
+			return nil, fmt.Errorf("disk '%s' cannot be part of the RAID as it is used by the %s layout", device.Name, p.Layout)
+		}
+	}
+	if min := raidMinimumDevices[p.RAID.Level]; len(members) < min {
+		return nil, fmt.Errorf("%s requires %d disks, but only %d are available", p.RAID.Level, min, len(members))
+	}
+
+	result.raid = url.Values{
+		"name":  []string{p.RAID.Name},
+		"level": []string{p.RAID.Level},
+	}
+	for _, device := range members {
+		result.raid.Add("block_devices", device.ID)
+	}
+	for _, device := range spares {
+		result.raid.Add("spare_devices", device.ID)
+	}
+	return result, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// configureStorage applies the storage policy of a node to its disks, if it
+// has one. An error is returned if the disks found when the node was
+// commissioned cannot satisfy the policy. In preview mode the changes are
+// only reported.
+func configureStorage(client *maas.MAASObject, node MaasNode, options ProcessingOptions) error {
+	name, policy := options.Storage.Policy(node, options.Roles.Role(node))
+	if policy == nil {
+		return nil
+	}
+	devices, err := fetchBlockDevices(client, node)
+	if err != nil {
+		return err
+	}
+	plan, err := policy.plan(devices)
+	if err != nil {
+		log.Errorf("STORAGE '%s' : disks cannot satisfy storage policy '%s' : %s", node.Hostname(), name, err)
+		return fmt.Errorf("disks cannot satisfy storage policy '%s' : %s", name, err)
+	}
+
+	change := fmt.Sprintf("set %s layout from policy '%s'", policy.Layout, name)
+	log.Infof("STORAGE '%s' : %s", node.Hostname(), change)
+	options.Plan.Storage(node, change)
+	if !options.Preview {
+		if _, err := postNodeOp(client, node, options, "set_storage_layout", plan.layout); err != nil {
+			return err
+		}
+	}
+
+	if plan.raid != nil {
+		change = fmt.Sprintf("create %s %s", policy.RAID.Level, policy.RAID.Name)
+		log.Infof("STORAGE '%s' : %s", node.Hostname(), change)
+		options.Plan.Storage(node, change)
+		if !options.Preview {
+			raids := nodeResource(client, node, "raids")
+			_, err := raids.CallPost("", plan.raid)
+			options.Audit.Record(node, "create_raid", plan.raid, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+)
+
+const testStoragePolicies = `{
+	"policies": {
+		"plain": {"layout": "flat", "root_size": "100G"},
+		"cached": {"layout": "bcache", "cache_mode": "writeback"},
+		"raided": {"layout": "lvm", "vg_name": "vg0", "raid": {"name": "md0", "level": "raid-5"}}
+	},
+	"tags": {"cached": "cached"},
+	"roles": {"compute": "plain", "storage": "raided"}
+}`
+
+const gigabyte = 1000 * 1000 * 1000
+
+func TestConfigureStorage(t *testing.T) {
+	disk := func(size int64, tags ...string) maasfake.BlockDevice {
+		return maasfake.BlockDevice{Size: size * gigabyte, Tags: tags}
+	}
+
+	cases := []struct {
+		name    string
+		role    string
+		tags    []string
+		disks   []maasfake.BlockDevice
+		layout  string
+		raid    []string
+		invalid bool
+	}{
+		{
+			name:   "flat layout selected by role",
+			role:   "compute",
+			disks:  []maasfake.BlockDevice{disk(500)},
+			layout: "flat",
+		},
+		{
+			name:    "root partition does not fit",
+			role:    "compute",
+			disks:   []maasfake.BlockDevice{disk(50)},
+			invalid: true,
+		},
+		{
+			name:   "bcache layout selected by tag",
+			role:   "compute",
+			tags:   []string{"cached"},
+			disks:  []maasfake.BlockDevice{disk(500, "rotary"), disk(100, "ssd")},
+			layout: "bcache",
+		},
+		{
+			name:    "bcache layout without an ssd",
+			tags:    []string{"cached"},
+			disks:   []maasfake.BlockDevice{disk(500, "rotary"), disk(500, "rotary")},
+			invalid: true,
+		},
+		{
+			name:   "RAID over the remaining disks",
+			role:   "storage",
+			disks:  []maasfake.BlockDevice{disk(100), disk(500), disk(500), disk(500)},
+			layout: "lvm",
+			raid:   []string{"sdb", "sdc", "sdd"},
+		},
+		{
+			name:    "too few disks for RAID",
+			role:    "storage",
+			disks:   []maasfake.BlockDevice{disk(100), disk(500), disk(500)},
+			invalid: true,
+		},
+		{
+			name:  "no policy",
+			role:  "edge",
+			disks: []maasfake.BlockDevice{disk(500)},
+		},
+	}
+
+	for _, c := range cases {
+		server, client := newTestServer(t, MaasAPIv2)
+		id := server.AddNode(maasfake.Node{
+			Hostname:     "node-a",
+			Status:       maasfake.Allocated,
+			Tags:         c.tags,
+			BlockDevices: c.disks,
+		})
+		options := newTestOptions(MaasAPIv2, newTestProvisioner())
+		options.Roles = &RoleSelector{Default: c.role}
+		options.Storage = &StorageSelector{}
+		if err := json.Unmarshal([]byte(testStoragePolicies), options.Storage); err != nil {
+			t.Fatalf("unable to parse storage policies : %s", err)
+		}
+		if err := options.Storage.Load(); err != nil {
+			t.Fatalf("invalid storage policies : %s", err)
+		}
+
+		node, err := fetchNode(client, MaasAPIv2, id)
+		if err != nil {
+			t.Fatalf("%s: unable to fetch node : %s", c.name, err)
+		}
+		err = configureStorage(client, node, options)
+		if (err != nil) != c.invalid {
+			t.Errorf("%s: expected invalid to be %t, got error %v", c.name, c.invalid, err)
+		}
+
+		maasNode, _ := server.Node(id)
+		if maasNode.StorageLayout != c.layout {
+			t.Errorf("%s: expected layout '%s', got '%s'", c.name, c.layout, maasNode.StorageLayout)
+		}
+		var raid []string
+		if len(maasNode.RAIDs) > 0 {
+			raid = maasNode.RAIDs[0].Devices
+		}
+		if !reflect.DeepEqual(raid, c.raid) {
+			t.Errorf("%s: expected RAID of %v, got %v", c.name, c.raid, raid)
+		}
+		server.Close()
+	}
+}
+
+func TestStoragePolicyValidation(t *testing.T) {
+	cases := []string{
+		`{"policies": {"p": {"layout": "zfs"}}}`,
+		`{"policies": {"p": {"layout": "flat", "root_size": "big"}}}`,
+		`{"policies": {"p": {"layout": "flat", "vg_name": "vg0"}}}`,
+		`{"policies": {"p": {"layout": "bcache", "cache_mode": "fast"}}}`,
+		`{"policies": {"p": {"raid": {"name": "md0", "level": "raid-4"}}}}`,
+		`{"policies": {"p": {}}, "roles": {"compute": "q"}}`,
+	}
+	for _, c := range cases {
+		selector := &StorageSelector{}
+		if err := json.Unmarshal([]byte(c), selector); err != nil {
+			t.Fatalf("unable to parse storage policies '%s' : %s", c, err)
+		}
+		if err := selector.Load(); err == nil {
+			t.Errorf("expected storage policies '%s' to be invalid", c)
+		}
+	}
+}
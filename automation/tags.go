@@ -0,0 +1,132 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	maas "github.com/juju/gomaasapi"
+)
+
+// hasTag returns true if the node is tagged with the given tag
+func hasTag(node MaasNode, tag string) bool {
+	for _, t := range node.Tags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureTag creates the given tag in MAAS if it does not already exist,
+// recording the creation against the node that required it
+func ensureTag(client *maas.MAASObject, node MaasNode, options ProcessingOptions, tag string, comment string) error {
+	tagsObj := client.GetSubObject("tags")
+	if _, err := tagsObj.GetSubObject(tag).Get(); err == nil {
+		return nil
+	}
+	params := url.Values{
+		"name":    []string{tag},
+		"comment": []string{comment},
+	}
+	_, err := tagsObj.CallPost("new", params)
+	options.Audit.Record(node, "create_tag", params, err)
+	return err
+}
+
+// addNodeTag tags the node with the given tag, creating the tag if required
+func addNodeTag(client *maas.MAASObject, node MaasNode, options ProcessingOptions, tag string, comment string) error {
+	if hasTag(node, tag) {
+		return nil
+	}
+	if err := ensureTag(client, node, options, tag, comment); err != nil {
+		return err
+	}
+	_, err := client.GetSubObject("tags").GetSubObject(tag).CallPost("update_nodes",
+		url.Values{"add": []string{node.ID()}})
+	options.Audit.Record(node, "add_tag", url.Values{"tag": []string{tag}}, err)
+	return err
+}
+
+// removeNodeTag removes the given tag from the node, if it has it
+func removeNodeTag(client *maas.MAASObject, node MaasNode, options ProcessingOptions, tag string) error {
+	if !hasTag(node, tag) {
+		return nil
+	}
+	_, err := client.GetSubObject("tags").GetSubObject(tag).CallPost("update_nodes",
+		url.Values{"remove": []string{node.ID()}})
+	options.Audit.Record(node, "remove_tag", url.Values{"tag": []string{tag}}, err)
+	return err
+}
+
+// describeNode replaces the line of a node's description that starts with the
+// given prefix with the given line, stamped with the current time, or removes
+// it if the line is empty. The rest of the description is left exactly as
+// is, so that automation can report on a node in MAAS alongside the
+// operator's notes.
+func describeNode(client *maas.MAASObject, node MaasNode, options ProcessingOptions, prefix string, line string) error {
+	lines := []string{}
+	at := -1
+	if description := node.Description(); description != "" {
+		for _, l := range strings.Split(description, "\n") {
+			if !strings.HasPrefix(l, prefix) {
+				lines = append(lines, l)
+				continue
+			}
+			// Only the time changes when the line is reported again
+			if line != "" && strings.HasPrefix(l, line+" at ") {
+				return nil
+			}
+			if at < 0 {
+				at = len(lines)
+			}
+		}
+	}
+	if line != "" {
+		// A new line goes last, ahead of any final line break
+		if at < 0 {
+			at = len(lines)
+			if at > 0 && lines[at-1] == "" {
+				at--
+			}
+		}
+		stamped := line + " at " + time.Now().UTC().Format(time.RFC3339)
+		lines = append(lines[:at], append([]string{stamped}, lines[at:]...)...)
+	} else if at < 0 {
+		return nil
+	}
+	params := url.Values{"description": []string{strings.Join(lines, "\n")}}
+	_, err := client.GetSubObject(node.API().Nodes).GetSubObject(node.ID()).Update(params)
+	options.Audit.Record(node, "update_description", params, err)
+	return err
+}
+
+// describedAs returns the line of a node's description that starts with the
+// given prefix, without the prefix and the time it was stamped with, or the
+// empty string if there is none
+func describedAs(node MaasNode, prefix string) string {
+	for _, l := range strings.Split(node.Description(), "\n") {
+		if !strings.HasPrefix(l, prefix) {
+			continue
+		}
+		l = strings.TrimPrefix(l, prefix)
+		if at := strings.LastIndex(l, " at "); at >= 0 {
+			l = l[:at]
+		}
+		return l
+	}
+	return ""
+}
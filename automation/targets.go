@@ -0,0 +1,95 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultTarget the target state of nodes for which no target is selected
+const DefaultTarget = "Deployed"
+
+// TargetSelector determines the target lifecycle state of a node. The
+// target is selected, in order of precedence, by the node's hostname or
+// system id, by a MAAS tag on the node, by the node's zone and finally the
+// default.
+type TargetSelector struct {
+	Default string            `json:"default,omitempty"`
+	Hosts   map[string]string `json:"hosts,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Zones   map[string]string `json:"zones,omitempty"`
+}
+
+// Target returns the target state for the given node
+func (s *TargetSelector) Target(node MaasNode) string {
+	if s == nil {
+		return DefaultTarget
+	}
+
+	name := node.Hostname()
+	if i := strings.IndexRune(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	if target, ok := s.Hosts[name]; ok {
+		return target
+	}
+	if target, ok := s.Hosts[node.ID()]; ok {
+		return target
+	}
+	for _, tag := range node.Tags() {
+		if target, ok := s.Tags[tag]; ok {
+			return target
+		}
+	}
+	if target, ok := s.Zones[node.Zone()]; ok {
+		return target
+	}
+	if s.Default != "" {
+		return s.Default
+	}
+	return DefaultTarget
+}
+
+// Validate verifies that every target that can be selected has a table of
+// transitions
+func (s *TargetSelector) Validate(transitions map[string]map[string][]Action) error {
+	check := func(kind, key, target string) error {
+		if _, ok := transitions[target]; !ok {
+			return fmt.Errorf("no transitions to target state '%s' selected for %s '%s'", target, kind, key)
+		}
+		return nil
+	}
+	if s.Default != "" {
+		if err := check("default", "default", s.Default); err != nil {
+			return err
+		}
+	}
+	for key, target := range s.Hosts {
+		if err := check("host", key, target); err != nil {
+			return err
+		}
+	}
+	for key, target := range s.Tags {
+		if err := check("tag", key, target); err != nil {
+			return err
+		}
+	}
+	for key, target := range s.Zones {
+		if err := check("zone", key, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1417 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maasfake provides an in-process fake of the MAAS region controller
+// API, sufficient to test the services that drive MAAS through gomaasapi.
+//
+// The server implements the nodes (machines with the 2.0 API), devices,
+// subnets, interfaces, tags and SSH keys endpoints. Node operations move nodes through
+// the MAAS lifecycle; operations that take time in MAAS, such as
+// commissioning or deploying, complete when the simulated clock of the server
+// is advanced past their duration.
+package maasfake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey an API key with which gomaasapi clients can connect to the server.
+// The server does not authenticate requests, so any well formed key works.
+const APIKey = "fake:fake:fake"
+
+// DefaultFabric the fabric of the VLANs of interfaces and subnets for which no
+// fabric is given
+const DefaultFabric = "fabric-0"
+
+// vlansPerFabric bounds the VIDs of a fabric, from which the IDs of VLAN
+// objects are derived
+const vlansPerFabric = 4096
+
+// Status the MAAS lifecycle status of a node
+type Status int
+
+// MAAS node statuses
+const (
+	New                 Status = 0
+	Commissioning       Status = 1
+	FailedCommissioning Status = 2
+	Missing             Status = 3
+	Ready               Status = 4
+	Reserved            Status = 5
+	Deployed            Status = 6
+	Retired             Status = 7
+	Broken              Status = 8
+	Deploying           Status = 9
+	Allocated           Status = 10
+	FailedDeployment    Status = 11
+	Releasing           Status = 12
+	FailedReleasing     Status = 13
+	DiskErasing         Status = 14
+	FailedDiskErasing   Status = 15
+)
+
+// statusNames the statuses by name, as given in node fixtures
+var statusNames = map[string]Status{
+	"New":                 New,
+	"Commissioning":       Commissioning,
+	"FailedCommissioning": FailedCommissioning,
+	"Missing":             Missing,
+	"Ready":               Ready,
+	"Reserved":            Reserved,
+	"Deployed":            Deployed,
+	"Retired":             Retired,
+	"Broken":              Broken,
+	"Deploying":           Deploying,
+	"Allocated":           Allocated,
+	"FailedDeployment":    FailedDeployment,
+	"Releasing":           Releasing,
+	"FailedReleasing":     FailedReleasing,
+	"DiskErasing":         DiskErasing,
+	"FailedDiskErasing":   FailedDiskErasing,
+}
+
+// UnmarshalJSON decodes a status given either as its number or its name,
+// i.e. "Ready"
+func (s *Status) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var value int
+		if err := json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("invalid node status %s", data)
+		}
+		*s = Status(value)
+		return nil
+	}
+	status, ok := statusNames[name]
+	if !ok {
+		return fmt.Errorf("unknown node status '%s'", name)
+	}
+	*s = status
+	return nil
+}
+
+// Timing how long, in simulated time, MAAS takes to complete operations
+type Timing struct {
+	Commission time.Duration
+	Deploy     time.Duration
+	Release    time.Duration
+}
+
+// DefaultTiming the timing of a new server
+var DefaultTiming = Timing{
+	Commission: 10 * time.Minute,
+	Deploy:     15 * time.Minute,
+	Release:    2 * time.Minute,
+}
+
+// Link a link of an interface to a subnet, identified by its CIDR
+type Link struct {
+	ID     int
+	Mode   string
+	Subnet string
+	IP     string
+}
+
+// Interface a network interface of a node or device, with its link speed in
+// Mbps. Type is physical, unless the interface was created as a bond, vlan or
+// bridge over the named parents. The interface is on the VLAN with the given
+// VID of the named fabric, DefaultFabric if none is given.
+type Interface struct {
+	ID        int
+	Name      string
+	Type      string
+	Parents   []string
+	MAC       string
+	Fabric    string
+	VLAN      int
+	LinkSpeed int
+	Links     []Link
+}
+
+// BlockDevice a physical disk of a node, of the given size in bytes. Tags
+// such as "ssd" or "rotary" describe the disk.
+type BlockDevice struct {
+	ID   int
+	Name string
+	Size int64
+	Tags []string
+}
+
+// RAID a software RAID created over the named block devices of a node
+type RAID struct {
+	ID      int
+	Name    string
+	Level   string
+	Devices []string
+	Spares  []string
+}
+
+// Node a node managed by MAAS, with its memory in MiB. Fail lists the
+// operations, such as "commission", "start" or "release", that leave the node
+// in the matching failed state when they complete. UserData is the decoded
+// cloud-init user data with which the node was last deployed.
+type Node struct {
+	SystemID        string
+	Hostname        string
+	Description     string
+	Status          Status
+	PowerType       string
+	PowerState      string
+	PowerParameters map[string]string
+	Zone            string
+	Pool            string
+	Architecture    string
+	CPUCount        int
+	Memory          int
+	Tags            []string
+	Interfaces      []Interface
+	BlockDevices    []BlockDevice
+	StorageLayout   string
+	RAIDs           []RAID
+	DistroSeries    string
+	UserData        string
+	Fail            map[string]bool
+
+	pending *transition
+}
+
+// Device a device, such as a switch, registered in MAAS
+type Device struct {
+	SystemID   string
+	Hostname   string
+	Interfaces []Interface
+}
+
+// Subnet a subnet known to MAAS, on the VLAN with the given VID of the named
+// fabric
+type Subnet struct {
+	ID     int
+	Name   string
+	CIDR   string
+	Fabric string
+	VLAN   int
+}
+
+// Event an entry of the MAAS event log about a node
+type Event struct {
+	ID          int
+	Node        string
+	Hostname    string
+	Type        string
+	Description string
+	Created     time.Time
+}
+
+// Call a request received by the server that changed, or attempted to
+// change, its state
+type Call struct {
+	Method string
+	Path   string
+	Op     string
+	Params url.Values
+}
+
+// String a short description of the call, such as "POST nodes/node-1 start"
+func (c Call) String() string {
+	if c.Op == "" {
+		return c.Method + " " + c.Path
+	}
+	return c.Method + " " + c.Path + " " + c.Op
+}
+
+// SSHKey a public SSH key registered with the MAAS user
+type SSHKey struct {
+	ID  int
+	Key string
+}
+
+// transition a change of status that completes at a point in simulated time
+type transition struct {
+	at     time.Time
+	status Status
+	power  string
+}
+
+// Server the fake MAAS server
+type Server struct {
+	Timing Timing
+
+	server  *httptest.Server
+	mutex   sync.Mutex
+	now     time.Time
+	lastID  int
+	nodes   map[string]*Node
+	devices map[string]*Device
+	subnets []*Subnet
+	fabrics []string
+	tags    map[string]string
+	calls   []Call
+	events  []Event
+	sshKeys []SSHKey
+}
+
+// NewServer starts a fake MAAS server, which should be closed when no longer
+// needed
+func NewServer() *Server {
+	s := &Server{
+		Timing:  DefaultTiming,
+		now:     time.Unix(0, 0).UTC(),
+		nodes:   make(map[string]*Node),
+		devices: make(map[string]*Device),
+		fabrics: []string{DefaultFabric},
+		tags:    make(map[string]string),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL the base URL of the server, to be used as the MAAS URL of a client
+func (s *Server) URL() string {
+	return s.server.URL + "/MAAS"
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Now the current simulated time
+func (s *Server) Now() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.now
+}
+
+// Advance moves the simulated time forward, completing any operations that
+// are due
+func (s *Server) Advance(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.now = s.now.Add(d)
+	for _, node := range s.nodes {
+		if node.pending != nil && !node.pending.at.After(s.now) {
+			node.Status = node.pending.status
+			node.PowerState = node.pending.power
+			node.pending = nil
+			s.event(node, "Node changed status", fmt.Sprintf("status %d", node.Status))
+		}
+	}
+}
+
+// AddEvent adds an entry to the event log of the given node
+func (s *Server) AddEvent(id string, eventType string, description string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node := &Node{SystemID: id}
+	if n, ok := s.nodes[id]; ok {
+		node = n
+	}
+	s.event(node, eventType, description)
+}
+
+// Events returns the event log
+func (s *Server) Events() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+// event adds an entry to the event log. The caller must hold the lock.
+func (s *Server) event(node *Node, eventType string, description string) {
+	s.events = append(s.events, Event{
+		ID:          len(s.events) + 1,
+		Node:        node.SystemID,
+		Hostname:    node.Hostname,
+		Type:        eventType,
+		Description: description,
+		Created:     s.now,
+	})
+}
+
+// fabric returns the index of the named fabric, adding the fabric if it is
+// new. The caller must hold the lock.
+func (s *Server) fabric(name string) int {
+	if name == "" {
+		name = DefaultFabric
+	}
+	for i, fabric := range s.fabrics {
+		if fabric == name {
+			return i
+		}
+	}
+	s.fabrics = append(s.fabrics, name)
+	return len(s.fabrics) - 1
+}
+
+// vlanJSON the VLAN with the given VID of the named fabric. VLAN objects are
+// identified by the index of their fabric and their VID, so that the VLANs of
+// the default fabric have their VID as their ID. The caller must hold the
+// lock.
+func (s *Server) vlanJSON(fabric string, vid int) map[string]interface{} {
+	index := s.fabric(fabric)
+	return map[string]interface{}{
+		"id":        index*vlansPerFabric + vid,
+		"vid":       vid,
+		"fabric":    s.fabrics[index],
+		"fabric_id": index,
+	}
+}
+
+// vlan returns the fabric and VID of the VLAN object with the given ID. The
+// caller must hold the lock.
+func (s *Server) vlan(value string) (string, int, error) {
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 || id/vlansPerFabric >= len(s.fabrics) {
+		return "", 0, badRequest("Invalid VLAN '%s'", value)
+	}
+	return s.fabrics[id/vlansPerFabric], id % vlansPerFabric, nil
+}
+
+func (s *Server) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// interfaces assigns IDs to the given interfaces
+func (s *Server) interfaces(ifaces []Interface) []Interface {
+	result := make([]Interface, len(ifaces))
+	for i, iface := range ifaces {
+		iface.ID = s.nextID()
+		if iface.Name == "" {
+			iface.Name = fmt.Sprintf("eth%d", i)
+		}
+		if iface.Type == "" {
+			iface.Type = "physical"
+		}
+		iface.Parents = append([]string{}, iface.Parents...)
+		iface.Links = append([]Link{}, iface.Links...)
+		for j := range iface.Links {
+			iface.Links[j].ID = s.nextID()
+		}
+		result[i] = iface
+	}
+	return result
+}
+
+// AddNode adds a node to the server and returns its system ID, which is
+// generated if the node does not specify one. Nodes are powered off unless a
+// power state is specified.
+func (s *Server) AddNode(node Node) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if node.SystemID == "" {
+		node.SystemID = fmt.Sprintf("node-%d", s.nextID())
+	}
+	if node.PowerState == "" {
+		node.PowerState = "off"
+	}
+	if node.Zone == "" {
+		node.Zone = "default"
+	}
+	if node.Architecture == "" {
+		node.Architecture = "amd64/generic"
+	}
+	node.Tags = append([]string{}, node.Tags...)
+	node.Interfaces = s.interfaces(node.Interfaces)
+	node.BlockDevices = append([]BlockDevice{}, node.BlockDevices...)
+	for i := range node.BlockDevices {
+		node.BlockDevices[i].ID = s.nextID()
+		if node.BlockDevices[i].Name == "" {
+			node.BlockDevices[i].Name = fmt.Sprintf("sd%c", 'a'+i)
+		}
+	}
+	node.RAIDs = append([]RAID{}, node.RAIDs...)
+	for _, tag := range node.Tags {
+		if _, ok := s.tags[tag]; !ok {
+			s.tags[tag] = ""
+		}
+	}
+	s.nodes[node.SystemID] = &node
+	return node.SystemID
+}
+
+// LoadNodes adds the nodes of a fixture, a JSON array of nodes with the
+// fields of Node, to the server and returns their system IDs. Statuses may be
+// given by name, i.e. {"Hostname": "node-1", "Status": "Ready"}.
+func (s *Server) LoadNodes(r io.Reader) ([]string, error) {
+	var nodes []Node
+	if err := json.NewDecoder(r).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = s.AddNode(node)
+	}
+	return ids, nil
+}
+
+// AddDevice adds a device with an interface for each of the given MAC
+// addresses and returns its system ID
+func (s *Server) AddDevice(hostname string, macs ...string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.addDevice(hostname, macs)
+}
+
+func (s *Server) addDevice(hostname string, macs []string) string {
+	ifaces := make([]Interface, len(macs))
+	for i, mac := range macs {
+		ifaces[i].MAC = mac
+	}
+	device := &Device{
+		SystemID:   fmt.Sprintf("device-%d", s.nextID()),
+		Hostname:   hostname,
+		Interfaces: s.interfaces(ifaces),
+	}
+	s.devices[device.SystemID] = device
+	return device.SystemID
+}
+
+// AddSubnet adds a subnet on the given VLAN of the default fabric
+func (s *Server) AddSubnet(name string, cidr string, vlan int) {
+	s.AddFabricSubnet(name, cidr, DefaultFabric, vlan)
+}
+
+// AddFabricSubnet adds a subnet on the given VLAN of the named fabric
+func (s *Server) AddFabricSubnet(name string, cidr string, fabric string, vlan int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subnets = append(s.subnets, &Subnet{
+		ID:     s.nextID(),
+		Name:   name,
+		CIDR:   cidr,
+		Fabric: s.fabrics[s.fabric(fabric)],
+		VLAN:   vlan,
+	})
+}
+
+// Node returns a copy of the node with the given system ID
+func (s *Server) Node(id string) (Node, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	node, ok := s.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return *node, true
+}
+
+// Devices returns a copy of all devices, ordered by hostname
+func (s *Server) Devices() []Device {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]Device, 0, len(s.devices))
+	for _, device := range s.devices {
+		result = append(result, *device)
+	}
+	sort.Sort(byHostname(result))
+	return result
+}
+
+// Calls returns the requests, in order, that changed, or attempted to
+// change, the state of the server
+func (s *Server) Calls() []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// ResetCalls forgets the requests received so far
+func (s *Server) ResetCalls() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls = nil
+}
+
+type byHostname []Device
+
+func (a byHostname) Len() int           { return len(a) }
+func (a byHostname) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byHostname) Less(i, j int) bool { return a[i].Hostname < a[j].Hostname }
+
+// apiError an error returned to the client with the given HTTP status
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, v ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, v...)}
+}
+
+func conflict(format string, v ...interface{}) error {
+	return &apiError{http.StatusConflict, fmt.Sprintf(format, v...)}
+}
+
+func badRequest(format string, v ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, v...)}
+}
+
+// request a request to the API, with the path split after the API version
+type request struct {
+	method  string
+	version string
+	parts   []string
+	op      string
+	params  url.Values
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 4 || parts[0] != "MAAS" || parts[1] != "api" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &request{
+		method:  r.Method,
+		version: parts[2],
+		parts:   parts[3:],
+		op:      r.URL.Query().Get("op"),
+		params:  r.PostForm,
+	}
+	if req.method == "GET" {
+		req.params = r.URL.Query()
+	}
+
+	s.mutex.Lock()
+	if req.method != "GET" {
+		s.calls = append(s.calls, Call{
+			Method: req.method,
+			Path:   strings.Join(req.parts, "/"),
+			Op:     req.op,
+			Params: req.params,
+		})
+	}
+	result, err := s.dispatch(req)
+	s.mutex.Unlock()
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			status = e.status
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// dispatch routes a request to its handler. The caller must hold the lock.
+func (s *Server) dispatch(req *request) (interface{}, error) {
+	parts := req.parts
+	switch parts[0] {
+	case "nodes", "machines":
+		switch {
+		case len(parts) == 1:
+			return s.nodesOp(req)
+		case len(parts) == 2:
+			if _, ok := s.devices[parts[1]]; ok && parts[0] == "nodes" {
+				return s.deviceOp(req, parts[1])
+			}
+			return s.nodeOp(req, parts[1])
+		case len(parts) == 3 && parts[2] == "blockdevices":
+			return s.blockDevicesOp(req, parts[1])
+		case len(parts) == 3 && parts[2] == "raids":
+			return s.raidsOp(req, parts[1])
+		case len(parts) == 3 && parts[2] == "interfaces":
+			return s.interfacesOp(req, parts[1])
+		case len(parts) == 4 && parts[2] == "interfaces":
+			return s.interfaceOp(req, parts[1], parts[3])
+		}
+	case "devices":
+		switch len(parts) {
+		case 1:
+			return s.devicesOp(req)
+		case 2:
+			return s.deviceOp(req, parts[1])
+		}
+	case "subnets":
+		if len(parts) == 1 && req.method == "GET" {
+			result := make([]interface{}, len(s.subnets))
+			for i, subnet := range s.subnets {
+				result[i] = s.subnetJSON(subnet)
+			}
+			return result, nil
+		}
+	case "events":
+		if len(parts) == 1 && req.method == "GET" && req.op == "query" {
+			return s.eventsQuery(req)
+		}
+	case "account":
+		if len(parts) == 3 && parts[1] == "prefs" && parts[2] == "sshkeys" {
+			return s.sshKeysOp(req)
+		}
+	case "tags":
+		switch len(parts) {
+		case 1:
+			return s.tagsOp(req)
+		case 2:
+			return s.tagOp(req, parts[1])
+		}
+	}
+	return nil, notFound("Unknown resource '%s'", strings.Join(parts, "/"))
+}
+
+// ops the names of the 2.0 node operations that differ from those of 1.0
+var ops = map[string]string{
+	"allocate":  "acquire",
+	"deploy":    "start",
+	"power_off": "stop",
+}
+
+func (s *Server) nodesOp(req *request) (interface{}, error) {
+	op := req.op
+	if name, ok := ops[op]; ok {
+		op = name
+	}
+	switch {
+	case req.method == "GET" && (op == "list" || op == ""):
+		ids := make([]string, 0, len(s.nodes))
+		for id := range s.nodes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		result := make([]interface{}, len(ids))
+		for i, id := range ids {
+			result[i] = s.nodeJSON(req.version, s.nodes[id])
+		}
+		return result, nil
+	case req.method == "POST" && op == "acquire":
+		name := req.params.Get("name")
+		for _, node := range s.nodes {
+			if name != "" && node.Hostname != name {
+				continue
+			}
+			if node.Status == Ready {
+				node.Status = Allocated
+				s.event(node, "User action", "acquire")
+				return s.nodeJSON(req.version, node), nil
+			}
+		}
+		return nil, conflict("No available node matches constraints: name=%s", name)
+	}
+	return nil, badRequest("Unsupported operation '%s' on nodes", req.op)
+}
+
+func (s *Server) nodeOp(req *request, id string) (interface{}, error) {
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, notFound("No node with system ID '%s'", id)
+	}
+
+	switch req.method {
+	case "GET":
+		return s.nodeJSON(req.version, node), nil
+	case "PUT":
+		if hostname := req.params.Get("hostname"); hostname != "" {
+			node.Hostname = hostname
+		}
+		if _, ok := req.params["description"]; ok {
+			node.Description = req.params.Get("description")
+		}
+		if ptype := req.params.Get("power_type"); ptype != "" {
+			node.PowerType = ptype
+			node.PowerParameters = make(map[string]string)
+		}
+		for key := range req.params {
+			if strings.HasPrefix(key, "power_parameters_") {
+				if node.PowerParameters == nil {
+					node.PowerParameters = make(map[string]string)
+				}
+				node.PowerParameters[strings.TrimPrefix(key, "power_parameters_")] = req.params.Get(key)
+			}
+		}
+		return s.nodeJSON(req.version, node), nil
+	case "POST":
+		op := req.op
+		if name, ok := ops[op]; ok {
+			op = name
+		}
+		if err := s.nodeTransition(node, op, req.params); err != nil {
+			return nil, err
+		}
+		s.event(node, "User action", op)
+		return s.nodeJSON(req.version, node), nil
+	}
+	return nil, badRequest("Unsupported method '%s' on node '%s'", req.method, id)
+}
+
+// schedule starts a transition of a node that completes after the given
+// duration, or fails if the operation is to fail
+func (s *Server) schedule(node *Node, op string, d time.Duration, status Status, failed Status, power string) {
+	if node.Fail[op] {
+		status = failed
+	}
+	node.pending = &transition{
+		at:     s.now.Add(d),
+		status: status,
+		power:  power,
+	}
+}
+
+// nodeTransition applies a node operation. The caller must hold the lock.
+func (s *Server) nodeTransition(node *Node, op string, params url.Values) error {
+	switch op {
+	case "commission":
+		switch node.Status {
+		case New, Ready, FailedCommissioning, Broken:
+		default:
+			return conflict("Node '%s' cannot be commissioned in status %d", node.SystemID, node.Status)
+		}
+		node.Status = Commissioning
+		node.PowerState = "on"
+		s.schedule(node, op, s.Timing.Commission, Ready, FailedCommissioning, "off")
+	case "start":
+		switch node.Status {
+		case Allocated:
+			node.Status = Deploying
+			node.PowerState = "on"
+			node.DistroSeries = params.Get("distro_series")
+			node.UserData = ""
+			if data := params.Get("user_data"); data != "" {
+				decoded, err := base64.StdEncoding.DecodeString(data)
+				if err != nil {
+					return badRequest("Invalid user data : %s", err)
+				}
+				node.UserData = string(decoded)
+			}
+			s.schedule(node, op, s.Timing.Deploy, Deployed, FailedDeployment, "on")
+		case Deployed:
+			node.PowerState = "on"
+		default:
+			return conflict("Node '%s' cannot be started in status %d", node.SystemID, node.Status)
+		}
+	case "stop":
+		node.PowerState = "off"
+	case "set_storage_layout":
+		switch node.Status {
+		case Ready, Allocated:
+		default:
+			return conflict("Storage of node '%s' cannot be configured in status %d", node.SystemID, node.Status)
+		}
+		switch layout := params.Get("storage_layout"); layout {
+		case "flat", "lvm", "bcache":
+			node.StorageLayout = layout
+			node.RAIDs = nil
+		default:
+			return badRequest("Unknown storage layout '%s'", layout)
+		}
+	case "release":
+		switch node.Status {
+		case Allocated:
+			node.Status = Ready
+		case Deploying, Deployed, FailedDeployment, FailedReleasing, FailedDiskErasing:
+			node.Status = Releasing
+			node.PowerState = "off"
+			node.DistroSeries = ""
+			s.schedule(node, op, s.Timing.Release, Ready, FailedReleasing, "off")
+		default:
+			return conflict("Node '%s' cannot be released in status %d", node.SystemID, node.Status)
+		}
+	default:
+		return badRequest("Unsupported operation '%s' on node '%s'", op, node.SystemID)
+	}
+	return nil
+}
+
+func (s *Server) blockDevicesOp(req *request, id string) (interface{}, error) {
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, notFound("No node with system ID '%s'", id)
+	}
+	if req.method != "GET" {
+		return nil, badRequest("Unsupported method '%s' on block devices", req.method)
+	}
+	result := make([]interface{}, len(node.BlockDevices))
+	for i, device := range node.BlockDevices {
+		result[i] = s.blockDeviceJSON(req.version, node.SystemID, device)
+	}
+	return result, nil
+}
+
+func (s *Server) raidsOp(req *request, id string) (interface{}, error) {
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, notFound("No node with system ID '%s'", id)
+	}
+	switch {
+	case req.method == "GET":
+		result := make([]interface{}, len(node.RAIDs))
+		for i, raid := range node.RAIDs {
+			result[i] = raidJSON(raid)
+		}
+		return result, nil
+	case req.method == "POST" && (req.op == "" || req.op == "create"):
+		name := func(value string) (string, error) {
+			for _, device := range node.BlockDevices {
+				if strconv.Itoa(device.ID) == value {
+					return device.Name, nil
+				}
+			}
+			return "", badRequest("Unknown block device '%s'", value)
+		}
+		raid := RAID{ID: s.nextID(), Name: req.params.Get("name"), Level: req.params.Get("level")}
+		for _, value := range req.params["block_devices"] {
+			device, err := name(value)
+			if err != nil {
+				return nil, err
+			}
+			raid.Devices = append(raid.Devices, device)
+		}
+		for _, value := range req.params["spare_devices"] {
+			device, err := name(value)
+			if err != nil {
+				return nil, err
+			}
+			raid.Spares = append(raid.Spares, device)
+		}
+		if raid.Name == "" || raid.Level == "" || len(raid.Devices) == 0 {
+			return nil, badRequest("A RAID requires a name, level and block devices")
+		}
+		node.RAIDs = append(node.RAIDs, raid)
+		return raidJSON(raid), nil
+	}
+	return nil, badRequest("Unsupported operation '%s' on RAIDs", req.op)
+}
+
+// eventsQuery returns the oldest events after the given ID, or the latest
+// events if none is given, newest first as MAAS does
+func (s *Server) eventsQuery(req *request) (interface{}, error) {
+	limit := 100
+	if value := req.params.Get("limit"); value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil || l <= 0 {
+			return nil, badRequest("Invalid limit '%s'", value)
+		}
+		limit = l
+	}
+	var selected []Event
+	if value := req.params.Get("after"); value != "" {
+		after, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, badRequest("Invalid event ID '%s'", value)
+		}
+		for _, event := range s.events {
+			if event.ID > after && len(selected) < limit {
+				selected = append(selected, event)
+			}
+		}
+	} else {
+		start := len(s.events) - limit
+		if start < 0 {
+			start = 0
+		}
+		selected = s.events[start:]
+	}
+
+	events := make([]interface{}, len(selected))
+	for i, event := range selected {
+		events[len(selected)-1-i] = map[string]interface{}{
+			"id":          event.ID,
+			"node":        event.Node,
+			"hostname":    event.Hostname,
+			"type":        event.Type,
+			"description": event.Description,
+			"created":     event.Created.Format("Mon, 02 Jan. 2006 15:04:05"),
+		}
+	}
+	return map[string]interface{}{
+		"count":  len(events),
+		"events": events,
+	}, nil
+}
+
+// owner returns the interfaces of the node or device with the given ID
+func (s *Server) owner(id string) ([]Interface, error) {
+	if node, ok := s.nodes[id]; ok {
+		return node.Interfaces, nil
+	}
+	if device, ok := s.devices[id]; ok {
+		return device.Interfaces, nil
+	}
+	return nil, notFound("No node with system ID '%s'", id)
+}
+
+func (s *Server) interfacesOp(req *request, id string) (interface{}, error) {
+	ifaces, err := s.owner(id)
+	if err != nil {
+		return nil, err
+	}
+	if req.method == "POST" {
+		return s.createInterface(req, id, ifaces)
+	}
+	if req.method != "GET" {
+		return nil, badRequest("Unsupported method '%s' on interfaces", req.method)
+	}
+	result := make([]interface{}, len(ifaces))
+	for i := range ifaces {
+		result[i] = s.interfaceJSON(req.version, id, &ifaces[i])
+	}
+	return result, nil
+}
+
+// createInterface creates a bond, vlan or bridge interface on a node
+func (s *Server) createInterface(req *request, id string, ifaces []Interface) (interface{}, error) {
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, badRequest("Interfaces can only be created on nodes")
+	}
+	byID := func(value string) *Interface {
+		for i := range ifaces {
+			if strconv.Itoa(ifaces[i].ID) == value {
+				return &ifaces[i]
+			}
+		}
+		return nil
+	}
+	parents := []*Interface{}
+	for _, value := range append(req.params["parents"], req.params["parent"]...) {
+		parent := byID(value)
+		if parent == nil {
+			return nil, badRequest("Unknown parent interface '%s'", value)
+		}
+		parents = append(parents, parent)
+	}
+	if len(parents) == 0 {
+		return nil, badRequest("No parent interface specified")
+	}
+
+	iface := Interface{
+		ID:     s.nextID(),
+		Name:   req.params.Get("name"),
+		MAC:    parents[0].MAC,
+		Fabric: parents[0].Fabric,
+		VLAN:   parents[0].VLAN,
+	}
+	for _, parent := range parents {
+		iface.Parents = append(iface.Parents, parent.Name)
+	}
+	switch req.op {
+	case "create_bond":
+		iface.Type = "bond"
+	case "create_bridge":
+		iface.Type = "bridge"
+	case "create_vlan":
+		iface.Type = "vlan"
+		fabric, vlan, err := s.vlan(req.params.Get("vlan"))
+		if err != nil {
+			return nil, err
+		}
+		if fabric != s.fabrics[s.fabric(parents[0].Fabric)] {
+			return nil, badRequest("VLAN %d of fabric '%s' is not on the fabric of interface '%s'",
+				vlan, fabric, parents[0].Name)
+		}
+		iface.VLAN = vlan
+		iface.Name = fmt.Sprintf("%s.%d", parents[0].Name, vlan)
+	default:
+		return nil, badRequest("Unsupported operation '%s' on interfaces", req.op)
+	}
+	if iface.Name == "" {
+		return nil, badRequest("No name specified for the %s", iface.Type)
+	}
+	for _, existing := range ifaces {
+		if existing.Name == iface.Name {
+			return nil, conflict("Interface '%s' already exists on node '%s'", iface.Name, id)
+		}
+	}
+	node.Interfaces = append(node.Interfaces, iface)
+	return s.interfaceJSON(req.version, id, &node.Interfaces[len(node.Interfaces)-1]), nil
+}
+
+func (s *Server) interfaceOp(req *request, id string, ifaceID string) (interface{}, error) {
+	ifaces, err := s.owner(id)
+	if err != nil {
+		return nil, err
+	}
+	var iface *Interface
+	for i := range ifaces {
+		if strconv.Itoa(ifaces[i].ID) == ifaceID {
+			iface = &ifaces[i]
+		}
+	}
+	if iface == nil {
+		return nil, notFound("No interface '%s' on node '%s'", ifaceID, id)
+	}
+
+	switch {
+	case req.method == "GET":
+	case req.method == "PUT":
+		if name := req.params.Get("name"); name != "" {
+			iface.Name = name
+		}
+		if vlan := req.params.Get("vlan"); vlan != "" {
+			fabric, v, err := s.vlan(vlan)
+			if err != nil {
+				return nil, err
+			}
+			iface.Fabric, iface.VLAN = fabric, v
+		}
+	case req.method == "POST" && req.op == "unlink_subnet":
+		links := []Link{}
+		for _, link := range iface.Links {
+			if strconv.Itoa(link.ID) != req.params.Get("id") {
+				links = append(links, link)
+			}
+		}
+		if len(links) == len(iface.Links) {
+			return nil, notFound("No link '%s' on interface '%s'", req.params.Get("id"), ifaceID)
+		}
+		iface.Links = links
+	case req.method == "POST" && req.op == "link_subnet":
+		cidr := req.params.Get("subnet")
+		if s.subnet(cidr) == nil && !(cidr == "" && strings.ToLower(req.params.Get("mode")) == "link_up") {
+			return nil, badRequest("Unknown subnet '%s'", cidr)
+		}
+		iface.Links = append(iface.Links, Link{
+			ID:     s.nextID(),
+			Mode:   strings.ToLower(req.params.Get("mode")),
+			Subnet: cidr,
+			IP:     req.params.Get("ip_address"),
+		})
+	default:
+		return nil, badRequest("Unsupported operation '%s' on interface '%s'", req.op, ifaceID)
+	}
+	return s.interfaceJSON(req.version, id, iface), nil
+}
+
+func (s *Server) devicesOp(req *request) (interface{}, error) {
+	switch {
+	case req.method == "GET" && (req.op == "list" || req.op == ""):
+		ids := make([]string, 0, len(s.devices))
+		for id := range s.devices {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		result := make([]interface{}, len(ids))
+		for i, id := range ids {
+			result[i] = s.deviceJSON(req.version, s.devices[id])
+		}
+		return result, nil
+	case req.method == "POST" && (req.op == "new" || req.op == ""):
+		hostname := req.params.Get("hostname")
+		macs := req.params["mac_addresses"]
+		if len(macs) == 0 {
+			return nil, badRequest("A device requires at least one MAC address")
+		}
+		for _, device := range s.devices {
+			if device.Hostname == hostname {
+				return nil, badRequest("Node with hostname '%s' already exists", hostname)
+			}
+		}
+		id := s.addDevice(hostname, macs)
+		return s.deviceJSON(req.version, s.devices[id]), nil
+	}
+	return nil, badRequest("Unsupported operation '%s' on devices", req.op)
+}
+
+func (s *Server) deviceOp(req *request, id string) (interface{}, error) {
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, notFound("No device with system ID '%s'", id)
+	}
+	switch req.method {
+	case "GET":
+	case "PUT":
+		if hostname := req.params.Get("hostname"); hostname != "" {
+			device.Hostname = hostname
+		}
+	default:
+		return nil, badRequest("Unsupported method '%s' on device '%s'", req.method, id)
+	}
+	return s.deviceJSON(req.version, device), nil
+}
+
+// AddSSHKey registers a public SSH key with the MAAS user and returns its ID
+func (s *Server) AddSSHKey(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.nextID()
+	s.sshKeys = append(s.sshKeys, SSHKey{ID: id, Key: key})
+	return id
+}
+
+// SSHKeys returns the public SSH keys registered with the MAAS user
+func (s *Server) SSHKeys() []SSHKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SSHKey{}, s.sshKeys...)
+}
+
+func (s *Server) sshKeysOp(req *request) (interface{}, error) {
+	switch {
+	case req.method == "GET" && (req.op == "list" || req.op == ""):
+		result := make([]interface{}, len(s.sshKeys))
+		for i, key := range s.sshKeys {
+			result[i] = s.sshKeyJSON(req.version, key)
+		}
+		return result, nil
+	case req.method == "POST" && req.op == "new":
+		key := strings.TrimSpace(req.params.Get("key"))
+		if len(strings.Fields(key)) < 2 {
+			return nil, badRequest("Invalid SSH public key")
+		}
+		for _, existing := range s.sshKeys {
+			if existing.Key == key {
+				return nil, badRequest("This key has already been added for this user")
+			}
+		}
+		created := SSHKey{ID: s.nextID(), Key: key}
+		s.sshKeys = append(s.sshKeys, created)
+		return s.sshKeyJSON(req.version, created), nil
+	}
+	return nil, badRequest("Unsupported operation '%s' on SSH keys", req.op)
+}
+
+func (s *Server) tagsOp(req *request) (interface{}, error) {
+	switch {
+	case req.method == "GET":
+		names := make([]string, 0, len(s.tags))
+		for name := range s.tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result := make([]interface{}, len(names))
+		for i, name := range names {
+			result[i] = s.tagJSON(req.version, name)
+		}
+		return result, nil
+	case req.method == "POST" && req.op == "new":
+		name := req.params.Get("name")
+		if name == "" {
+			return nil, badRequest("A tag requires a name")
+		}
+		if _, ok := s.tags[name]; ok {
+			return nil, badRequest("Tag with name '%s' already exists", name)
+		}
+		s.tags[name] = req.params.Get("comment")
+		return s.tagJSON(req.version, name), nil
+	}
+	return nil, badRequest("Unsupported operation '%s' on tags", req.op)
+}
+
+func (s *Server) tagOp(req *request, name string) (interface{}, error) {
+	if _, ok := s.tags[name]; !ok {
+		return nil, notFound("No tag '%s'", name)
+	}
+	switch {
+	case req.method == "GET":
+		return s.tagJSON(req.version, name), nil
+	case req.method == "POST" && req.op == "update_nodes":
+		added, removed := 0, 0
+		for _, id := range req.params["add"] {
+			if node, ok := s.nodes[id]; ok && !hasTag(node, name) {
+				node.Tags = append(node.Tags, name)
+				added++
+			}
+		}
+		for _, id := range req.params["remove"] {
+			if node, ok := s.nodes[id]; ok && hasTag(node, name) {
+				tags := []string{}
+				for _, tag := range node.Tags {
+					if tag != name {
+						tags = append(tags, tag)
+					}
+				}
+				node.Tags = tags
+				removed++
+			}
+		}
+		return map[string]int{"added": added, "removed": removed}, nil
+	}
+	return nil, badRequest("Unsupported operation '%s' on tag '%s'", req.op, name)
+}
+
+func hasTag(node *Node, tag string) bool {
+	for _, t := range node.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) subnet(cidr string) *Subnet {
+	for _, subnet := range s.subnets {
+		if subnet.CIDR == cidr || strconv.Itoa(subnet.ID) == cidr {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func uri(version string, parts ...string) string {
+	return "/MAAS/api/" + version + "/" + strings.Join(parts, "/") + "/"
+}
+
+func (s *Server) nodeJSON(version string, node *Node) map[string]interface{} {
+	collection := "nodes"
+	if strings.HasPrefix(version, "2.") {
+		collection = "machines"
+	}
+	macs := make([]interface{}, len(node.Interfaces))
+	ifaces := make([]interface{}, len(node.Interfaces))
+	ips := []string{}
+	for i := range node.Interfaces {
+		iface := &node.Interfaces[i]
+		macs[i] = map[string]interface{}{"mac_address": iface.MAC}
+		ifaces[i] = s.interfaceJSON(version, node.SystemID, iface)
+		for _, link := range iface.Links {
+			if link.IP != "" {
+				ips = append(ips, link.IP)
+			}
+		}
+	}
+	result := map[string]interface{}{
+		"system_id":      node.SystemID,
+		"hostname":       node.Hostname,
+		"description":    node.Description,
+		"status":         int(node.Status),
+		"substatus":      int(node.Status),
+		"architecture":   node.Architecture,
+		"cpu_count":      node.CPUCount,
+		"memory":         node.Memory,
+		"power_type":     node.PowerType,
+		"power_state":    node.PowerState,
+		"distro_series":  node.DistroSeries,
+		"zone":           map[string]interface{}{"name": node.Zone},
+		"tag_names":      append([]string{}, node.Tags...),
+		"macaddress_set": macs,
+		"interface_set":  ifaces,
+		"ip_addresses":   ips,
+		"resource_uri":   uri(version, collection, node.SystemID),
+	}
+	if collection == "machines" {
+		result["pool"] = map[string]interface{}{"name": node.Pool}
+	}
+	return result
+}
+
+func (s *Server) deviceJSON(version string, device *Device) map[string]interface{} {
+	macs := make([]interface{}, len(device.Interfaces))
+	ifaces := make([]interface{}, len(device.Interfaces))
+	for i := range device.Interfaces {
+		iface := &device.Interfaces[i]
+		macs[i] = map[string]interface{}{"mac_address": iface.MAC}
+		ifaces[i] = s.interfaceJSON(version, device.SystemID, iface)
+	}
+	return map[string]interface{}{
+		"system_id":      device.SystemID,
+		"hostname":       device.Hostname,
+		"macaddress_set": macs,
+		"interface_set":  ifaces,
+		"resource_uri":   uri(version, "devices", device.SystemID),
+	}
+}
+
+func (s *Server) interfaceJSON(version string, owner string, iface *Interface) map[string]interface{} {
+	links := make([]interface{}, len(iface.Links))
+	for i, link := range iface.Links {
+		l := map[string]interface{}{
+			"id":   link.ID,
+			"mode": link.Mode,
+		}
+		if subnet := s.subnet(link.Subnet); subnet != nil {
+			l["subnet"] = s.subnetJSON(subnet)
+		}
+		if link.IP != "" {
+			l["ip_address"] = link.IP
+		}
+		links[i] = l
+	}
+	return map[string]interface{}{
+		"id":           iface.ID,
+		"name":         iface.Name,
+		"type":         iface.Type,
+		"parents":      append([]string{}, iface.Parents...),
+		"mac_address":  iface.MAC,
+		"link_speed":   iface.LinkSpeed,
+		"vlan":         s.vlanJSON(iface.Fabric, iface.VLAN),
+		"links":        links,
+		"resource_uri": uri(version, "nodes", owner, "interfaces", strconv.Itoa(iface.ID)),
+	}
+}
+
+func (s *Server) blockDeviceJSON(version string, owner string, device BlockDevice) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           device.ID,
+		"name":         device.Name,
+		"type":         "physical",
+		"size":         device.Size,
+		"tags":         append([]string{}, device.Tags...),
+		"path":         "/dev/" + device.Name,
+		"resource_uri": uri(version, "nodes", owner, "blockdevices", strconv.Itoa(device.ID)),
+	}
+}
+
+func raidJSON(raid RAID) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      raid.ID,
+		"name":    raid.Name,
+		"level":   raid.Level,
+		"devices": append([]string{}, raid.Devices...),
+		"spares":  append([]string{}, raid.Spares...),
+	}
+}
+
+func (s *Server) subnetJSON(subnet *Subnet) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   subnet.ID,
+		"name": subnet.Name,
+		"cidr": subnet.CIDR,
+		"vlan": s.vlanJSON(subnet.Fabric, subnet.VLAN),
+	}
+}
+
+func (s *Server) sshKeyJSON(version string, key SSHKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           key.ID,
+		"key":          key.Key,
+		"resource_uri": fmt.Sprintf("/MAAS/api/%s/account/prefs/sshkeys/%d/", version, key.ID),
+	}
+}
+
+func (s *Server) tagJSON(version string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         name,
+		"comment":      s.tags[name],
+		"resource_uri": uri(version, "tags", name),
+	}
+}
@@ -16,6 +16,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/Sirupsen/logrus"
@@ -122,7 +123,7 @@ func (c *AppContext) getProvisionedState(rec AddressRec) (*StatusMsg, error) {
 	if resp.StatusCode != 404 && int(resp.StatusCode/100) != 2 {
 		log.Errorf("Error while retrieving provisioning state for device '%s (%s, %s)' : %s",
 			rec.Name, rec.IP, rec.MAC, resp.Status)
-		return nil, fmt.Errorf(resp.Status)
+		return nil, errors.New(resp.Status)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 404 {
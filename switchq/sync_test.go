@@ -0,0 +1,103 @@
+// Copyright 2016 Open Networking Foundation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"gerrit.opencord.org/maas/maasfake"
+	maas "github.com/juju/gomaasapi"
+)
+
+// syncedDevice the state of a device in MAAS after a synchronization
+type syncedDevice struct {
+	Hostname  string
+	MAC       string
+	Interface string
+	VLAN      int
+}
+
+func TestSyncToMaas(t *testing.T) {
+	log.Out = ioutil.Discard
+
+	cases := []struct {
+		name     string
+		existing []AddressRec
+		switches []AddressRec
+		expected []syncedDevice
+	}{
+		{
+			name:     "new switch is added to the subnet of its address",
+			switches: []AddressRec{{Name: "leaf-1", IP: "10.6.1.5", MAC: "cc:37:ab:00:00:01"}},
+			expected: []syncedDevice{{"leaf-1", "cc:37:ab:00:00:01", "ma1", 5}},
+		},
+		{
+			name:     "switch already in MAAS is left alone",
+			existing: []AddressRec{{Name: "leaf-1", MAC: "CC:37:AB:00:00:01"}},
+			switches: []AddressRec{{Name: "leaf-1", IP: "10.6.1.5", MAC: "cc:37:ab:00:00:01"}},
+			expected: []syncedDevice{{"leaf-1", "CC:37:AB:00:00:01", "eth0", 0}},
+		},
+		{
+			name:     "switch with a known name but new MAC is added under a unique name",
+			existing: []AddressRec{{Name: "leaf-1", MAC: "cc:37:ab:00:00:01"}},
+			switches: []AddressRec{{Name: "leaf-1", IP: "10.6.1.6", MAC: "cc:37:ab:00:00:02"}},
+			expected: []syncedDevice{
+				{"leaf-1", "cc:37:ab:00:00:01", "eth0", 0},
+				{"leaf-1-cc37ab000002", "cc:37:ab:00:00:02", "ma1", 5},
+			},
+		},
+		{
+			name:     "switch with a known MAC but new name is renamed",
+			existing: []AddressRec{{Name: "leaf-1", MAC: "cc:37:ab:00:00:01"}},
+			switches: []AddressRec{{Name: "spine-1", IP: "10.6.1.5", MAC: "cc:37:ab:00:00:01"}},
+			expected: []syncedDevice{{"spine-1", "cc:37:ab:00:00:01", "eth0", 0}},
+		},
+		{
+			name:     "switch outside all subnets is added without a VLAN",
+			switches: []AddressRec{{Name: "leaf-1", IP: "192.168.0.5", MAC: "cc:37:ab:00:00:01"}},
+			expected: []syncedDevice{{"leaf-1", "cc:37:ab:00:00:01", "eth0", 0}},
+		},
+	}
+
+	for _, c := range cases {
+		server := maasfake.NewServer()
+		server.AddSubnet("fabric", "10.6.1.0/24", 5)
+		for _, rec := range c.existing {
+			server.AddDevice(rec.Name, rec.MAC)
+		}
+		auth, err := maas.NewAuthenticatedClient(server.URL(), maasfake.APIKey, "1.0")
+		if err != nil {
+			server.Close()
+			t.Fatalf("%s: unable to create MAAS client : %s", c.name, err)
+		}
+		context := &AppContext{maasClient: maas.NewMAAS(*auth)}
+
+		request := make(chan []AddressRec, 1)
+		request <- c.switches
+		close(request)
+		context.syncToMaas(request)
+
+		devices := []syncedDevice{}
+		for _, device := range server.Devices() {
+			iface := device.Interfaces[0]
+			devices = append(devices, syncedDevice{device.Hostname, iface.MAC, iface.Name, iface.VLAN})
+		}
+		if !reflect.DeepEqual(devices, c.expected) {
+			t.Errorf("%s: expected devices %+v, got %+v", c.name, c.expected, devices)
+		}
+		server.Close()
+	}
+}